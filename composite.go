@@ -2,6 +2,7 @@ package limage
 
 import (
 	"image/color"
+	"math"
 	"math/rand"
 
 	"vimagination.zapto.org/limage/internal"
@@ -86,6 +87,20 @@ var compositeNames = [...]string{
 	"Destination Out",
 	"Source Atop",
 	"Destination Atop",
+	"Color Erase",
+	"Chroma",
+	"Lightness",
+	"Vivid Light",
+	"Pin Light",
+	"Linear Light",
+	"Hard Mix",
+	"Exclusion",
+	"Linear Burn",
+	"Luminance",
+	"Erase",
+	"Merge",
+	"Split",
+	"Pass Through",
 }
 
 // String returns the name of the composition.
@@ -97,58 +112,27 @@ func (c Composite) String() string {
 	return compositeNames[0]
 }
 
-// Composite performs the composition of two layers.
-func (c Composite) Composite(b, t color.Color) color.Color {
-	bottom := internal.ColourToNRGBA(b)
-	top := internal.ColourToNRGBA(t)
+// clipsBackdrop returns true for the compositions that remove the bottom colour
+// where the top colour is transparent, and so also apply outside of the bounds
+// of a layer.
+func (c Composite) clipsBackdrop() bool {
+	return c == CompositeDestinationIn || c == CompositeDestinationAtop
+}
 
-	var f func(uint16, uint16) uint16
+// Composite performs the composition of two layers, using the automatic
+// composite mode and colour spaces.
+func (c Composite) Composite(b, t color.Color) color.Color {
+	return c.compositeWith(internal.ColourToNRGBA(b), internal.ColourToNRGBA(t), CompositeModeAuto, ColorSpaceAuto, ColorSpaceAuto)
+}
 
+// composite performs the compositions that are not calculated by blending, and
+// so do not use a composite mode or colour spaces.
+func (c Composite) composite(bottom, top color.NRGBA64) color.NRGBA64 {
 	switch c {
-	case CompositeMultiply:
-		f = compositeMultiply
-	case CompositeScreen:
-		f = compositeScreen
-	case CompositeOverlay:
-		f = compositeOverlay
-	case CompositeDifference:
-		f = compositeDifference
-	case CompositeAddition:
-		f = compositeAddition
-	case CompositeSubtract:
-		f = compositeSubtract
-	case CompositeDarkenOnly:
-		f = compositeDarkenOnly
-	case CompositeLightenOnly:
-		f = compositeLightenOnly
-	case CompositeDivide:
-		f = compositeDivide
-	case CompositeDodge:
-		f = compositeDodge
-	case CompositeBurn:
-		f = compositeBurn
-	case CompositeHardLight:
-		f = compositeHardLight
-	case CompositeSoftLight:
-		f = compositeSoftLight
-	case CompositeGrainExtract:
-		f = compositeGrainExtract
-	case CompositeGrainMerge:
-		f = compositeGrainMerge
 	case CompositeBehind:
 		return bottom
 	case CompositeDissolve:
 		return compositeDissolve(bottom, top)
-	case CompositeHue:
-		return compositeHue(bottom, top)
-	case CompositeSaturation:
-		return compositeSaturation(bottom, top)
-	case CompositeColor:
-		return compositeColor(bottom, top)
-	case CompositeValue:
-		return compositeValue(bottom, top)
-	case CompositeLuminosity:
-		return compositeColor(top, bottom)
 	case CompositePlus:
 		return compositePlus(bottom, top)
 	case CompositeDestinationIn:
@@ -156,25 +140,20 @@ func (c Composite) Composite(b, t color.Color) color.Color {
 	case CompositeDestinationOut:
 		return compositeDstOut(bottom, top)
 	case CompositeSourceAtop:
-		return compositeAtop(bottom, top)
+		return compositeSrcAtop(bottom, top)
 	case CompositeDestinationAtop:
-		return compositeAtop(top, bottom)
-	default: // Normal
+		return compositeDstAtop(bottom, top)
+	case CompositeColorErase:
+		return compositeColorErase(bottom, top)
+	case CompositeErase:
+		return compositeErase(bottom, top)
+	case CompositeMerge:
+		return compositeMerge(bottom, top)
+	case CompositeSplit:
+		return compositeSplit(bottom, top)
+	default:
 		return compositeNormal(bottom, top)
 	}
-
-	if bottom.A == 0 {
-		return color.NRGBA{}
-	}
-
-	ma := internal.Min(bottom.A, top.A)
-
-	return color.NRGBA64{
-		R: blend(bottom.A, bottom.R, ma, f(bottom.R, top.R)),
-		G: blend(bottom.A, bottom.G, ma, f(bottom.R, top.G)),
-		B: blend(bottom.A, bottom.B, ma, f(bottom.R, top.B)),
-		A: bottom.A,
-	}
 }
 
 func compositeNormal(bottom, top color.NRGBA64) color.NRGBA64 {
@@ -307,7 +286,7 @@ func compositeGrainMerge(x, y uint16) uint16 {
 	return clamp(uint32(x) + uint32(y) + 0x7fff)
 }
 
-func compositeHue(bottom, top color.NRGBA64) color.Color {
+func compositeHue(bottom, top color.NRGBA64) color.NRGBA64 {
 	br, bg, bb, _ := top.RGBA()
 
 	if br == bg && br == bb {
@@ -318,46 +297,297 @@ func compositeHue(bottom, top color.NRGBA64) color.Color {
 	b := lcolor.RGBToHSV(top)
 	a.H = b.H
 
-	return a
+	return a.ToNRGBA()
 }
 
-func compositeSaturation(bottom, top color.NRGBA64) color.Color {
+func compositeSaturation(bottom, top color.NRGBA64) color.NRGBA64 {
 	a := lcolor.RGBToHSV(bottom)
 	b := lcolor.RGBToHSV(top)
 	a.S = b.S
-	return a
+
+	return a.ToNRGBA()
 }
 
-func compositeColor(bottom, top color.NRGBA64) color.Color {
+func compositeColor(bottom, top color.NRGBA64) color.NRGBA64 {
 	a := lcolor.RGBToHSL(bottom)
 	b := lcolor.RGBToHSL(top)
 	b.L = a.L
 
-	return b
+	return b.ToNRGBA()
 }
 
-func compositeValue(bottom, top color.NRGBA64) color.Color {
+func compositeValue(bottom, top color.NRGBA64) color.NRGBA64 {
 	a := lcolor.RGBToHSV(bottom)
 	b := lcolor.RGBToHSV(top)
 	a.V = b.V
 
-	return a
+	return a.ToNRGBA()
+}
+
+// compositeVividLight burns or dodges the bottom colour depending on the top
+// colour. As in GIMP, the quotient of a division by zero is taken to be zero,
+// so that a black top colour gives white and a white one gives black.
+func compositeVividLight(x, y uint16) uint16 {
+	if y <= 0x7fff {
+		d := uint32(y) << 1
+		if d == 0 {
+			return 0xffff
+		}
+
+		n := 0xffff * uint32(0xffff-x) / d
+		if n > 0xffff {
+			return 0
+		}
+
+		return uint16(0xffff - n)
+	}
+
+	if y == 0xffff {
+		return 0
+	}
+
+	return clamp(0xffff * uint32(x) / (uint32(0xffff-y) << 1))
+}
+
+func compositePinLight(x, y uint16) uint16 {
+	if y > 0x7fff {
+		return internal.Max(x, uint16(uint32(y)<<1-0xffff))
+	}
+
+	return internal.Min(x, y<<1)
+}
+
+func compositeLinearLight(x, y uint16) uint16 {
+	n := uint32(x) + uint32(y)<<1
+	if n < 0xffff {
+		return 0
+	}
+
+	return clamp(n - 0xffff)
+}
+
+func compositeHardMix(x, y uint16) uint16 {
+	if uint32(x)+uint32(y) < 0xffff {
+		return 0
+	}
+
+	return 0xffff
+}
+
+func compositeExclusion(x, y uint16) uint16 {
+	return uint16(uint32(x) + uint32(y) - (uint32(x)*uint32(y)/0xffff)<<1)
+}
+
+func compositeLinearBurn(x, y uint16) uint16 {
+	n := uint32(x) + uint32(y)
+	if n < 0xffff {
+		return 0
+	}
+
+	return uint16(n - 0xffff)
+}
+
+// compositeChroma sets the chroma of the bottom colour to that of the top
+// colour in the CIE LCH colour space. The colours are in linear light when
+// linear is set, and on the sRGB gamma curve otherwise.
+func compositeChroma(bottom, top color.NRGBA64, linear bool) color.NRGBA64 {
+	b := toLab(bottom, linear)
+
+	if c := math.Hypot(b.A, b.B); c != 0 {
+		t := toLab(top, linear)
+		r := math.Hypot(t.A, t.B) / c
+		b.A *= r
+		b.B *= r
+	}
+
+	return b.toNRGBA(linear)
+}
+
+// compositeLightness sets the lightness of the bottom colour to that of the
+// top colour in the CIE LCH colour space.
+func compositeLightness(bottom, top color.NRGBA64, linear bool) color.NRGBA64 {
+	b := toLab(bottom, linear)
+	b.L = toLab(top, linear).L
+
+	return b.toNRGBA(linear)
+}
+
+// compositeLuminance scales the bottom colour so that it has the luminance of
+// the top colour.
+func compositeLuminance(bottom, top color.NRGBA64, linear bool) color.NRGBA64 {
+	var ratio float64
+
+	if yt := luminance(top, linear); yt > 0 {
+		ratio = yt / luminance(bottom, linear)
+	}
+
+	scale := func(x uint16) uint16 {
+		if x == 0 {
+			return 0
+		}
+
+		return internal.FloatToUint16(float64(x) * ratio / 0xffff)
+	}
+
+	return color.NRGBA64{
+		R: scale(bottom.R),
+		G: scale(bottom.G),
+		B: scale(bottom.B),
+		A: 0xffff,
+	}
 }
 
+// compositeColorErase removes the top colour from the bottom colour, making
+// the bottom colour as transparent as possible while keeping its appearance
+// when composited onto the top colour.
+func compositeColorErase(bottom, top color.NRGBA64) color.NRGBA64 {
+	if bottom.A == 0 || top.A == 0 {
+		return bottom
+	}
+
+	col := [3]float64{float64(bottom.R) / 0xffff, float64(bottom.G) / 0xffff, float64(bottom.B) / 0xffff}
+	bg := [3]float64{float64(top.R) / 0xffff, float64(top.G) / 0xffff, float64(top.B) / 0xffff}
+
+	var alpha float64
+
+	for c := range col {
+		var a float64
+
+		if col[c] > bg[c] {
+			a = (col[c] - bg[c]) / (1 - bg[c])
+		} else if col[c] < bg[c] {
+			a = (bg[c] - col[c]) / bg[c]
+		}
+
+		alpha = math.Max(alpha, a)
+	}
+
+	var erased [3]float64
+
+	if alpha > 0 {
+		for c := range col {
+			erased[c] = (col[c]-bg[c])/alpha + bg[c]
+		}
+	}
+
+	ab := float64(bottom.A) / 0xffff
+	at := float64(top.A) / 0xffff
+	mix := func(b, e float64) float64 {
+		return b + (e-b)*at
+	}
+
+	return color.NRGBA64{
+		R: internal.FloatToUint16(mix(col[0], erased[0])),
+		G: internal.FloatToUint16(mix(col[1], erased[1])),
+		B: internal.FloatToUint16(mix(col[2], erased[2])),
+		A: internal.FloatToUint16(mix(ab, ab*alpha)),
+	}
+}
+
+// compositeErase removes the alpha of the top colour from the bottom colour.
+func compositeErase(bottom, top color.NRGBA64) color.NRGBA64 {
+	if bottom.A = uint16(uint32(bottom.A) * uint32(0xffff-top.A) / 0xffff); bottom.A == 0 {
+		return color.NRGBA64{}
+	}
+
+	return bottom
+}
+
+// compositeMerge composites the top colour onto the bottom colour, first
+// reducing the alpha of the bottom colour so that the combined alpha is not
+// more than is needed to cover both.
+func compositeMerge(bottom, top color.NRGBA64) color.NRGBA64 {
+	ab := uint32(internal.Min(bottom.A, 0xffff-top.A))
+	at := uint32(top.A)
+	a := ab + at
+
+	if a == 0 {
+		return color.NRGBA64{}
+	}
+
+	mix := func(b, t uint16) uint16 {
+		return uint16((uint32(b)*ab + uint32(t)*at) / a)
+	}
+
+	return color.NRGBA64{
+		R: mix(bottom.R, top.R),
+		G: mix(bottom.G, top.G),
+		B: mix(bottom.B, top.B),
+		A: uint16(a),
+	}
+}
+
+// compositeSplit subtracts the alpha of the top colour from the bottom colour.
+func compositeSplit(bottom, top color.NRGBA64) color.NRGBA64 {
+	if top.A >= bottom.A {
+		return color.NRGBA64{}
+	}
+
+	bottom.A -= top.A
+
+	return bottom
+}
+
+// compositePlus adds the premultiplied colours and alphas, clamping the
+// results.
 func compositePlus(bottom, top color.NRGBA64) color.NRGBA64 {
-	return compositeNormal(bottom, top)
+	a := clamp(uint32(bottom.A) + uint32(top.A))
+	if a == 0 {
+		return color.NRGBA64{}
+	}
+
+	add := func(b, t uint16) uint16 {
+		p := clamp(uint32(b)*uint32(bottom.A)/0xffff + uint32(t)*uint32(top.A)/0xffff)
+
+		return uint16(uint32(p) * 0xffff / uint32(a))
+	}
+
+	return color.NRGBA64{
+		R: add(bottom.R, top.R),
+		G: add(bottom.G, top.G),
+		B: add(bottom.B, top.B),
+		A: a,
+	}
 }
 
+// compositeDstIn keeps the bottom colour where the top colour is opaque.
 func compositeDstIn(bottom, top color.NRGBA64) color.NRGBA64 {
-	return compositeNormal(bottom, top)
+	if bottom.A = uint16(uint32(bottom.A) * uint32(top.A) / 0xffff); bottom.A == 0 {
+		return color.NRGBA64{}
+	}
+
+	return bottom
 }
 
+// compositeDstOut keeps the bottom colour where the top colour is transparent.
 func compositeDstOut(bottom, top color.NRGBA64) color.NRGBA64 {
-	return compositeNormal(bottom, top)
+	return compositeErase(bottom, top)
+}
+
+// compositeSrcAtop composites the top colour over the bottom colour, keeping
+// the alpha of the bottom colour.
+func compositeSrcAtop(bottom, top color.NRGBA64) color.NRGBA64 {
+	if bottom.A == 0 {
+		return color.NRGBA64{}
+	}
+
+	return color.NRGBA64{
+		R: lerp(bottom.R, top.R, top.A),
+		G: lerp(bottom.G, top.G, top.A),
+		B: lerp(bottom.B, top.B, top.A),
+		A: bottom.A,
+	}
+}
+
+// compositeDstAtop composites the bottom colour over the top colour, keeping
+// the alpha of the top colour.
+func compositeDstAtop(bottom, top color.NRGBA64) color.NRGBA64 {
+	return compositeSrcAtop(top, bottom)
 }
 
-func compositeAtop(bottom, top color.NRGBA64) color.NRGBA64 {
-	return compositeNormal(bottom, top)
+// lerp interpolates between x and y by the amount a.
+func lerp(x, y, a uint16) uint16 {
+	return uint16((uint32(x)*uint32(0xffff-a) + uint32(y)*uint32(a)) / 0xffff)
 }
 
 func clamp(n uint32) uint16 {
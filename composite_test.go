@@ -0,0 +1,244 @@
+package limage
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// The expected colours were calculated separately, in floating point, from the
+// blend, erase, merge and split formulas of GIMP 2.10, clipping to the backdrop
+// and blending and compositing either on the sRGB curve or, as GIMP 2.10 does
+// by default for its Normal, Multiply, Divide, Addition, Subtract and
+// Luminance modes, in linear light. They have not been compared with pixels
+// rendered by GIMP itself.
+func TestBlendModes(t *testing.T) {
+	bottom := color.NRGBA{R: 200, G: 100, B: 50, A: 255}
+
+	for n, test := range [...]struct {
+		Mode     Composite
+		Space    ColorSpace
+		Alpha    uint8
+		Expected color.NRGBA
+	}{
+		{CompositeVividLight, ColorSpacePerceptual, 255, color.NRGBA{80, 170, 255, 255}},
+		{CompositePinLight, ColorSpacePerceptual, 255, color.NRGBA{80, 105, 225, 255}},
+		{CompositeLinearLight, ColorSpacePerceptual, 255, color.NRGBA{25, 205, 255, 255}},
+		{CompositeHardMix, ColorSpacePerceptual, 255, color.NRGBA{0, 255, 255, 255}},
+		{CompositeExclusion, ColorSpacePerceptual, 255, color.NRGBA{177, 139, 196, 255}},
+		{CompositeLinearBurn, ColorSpacePerceptual, 255, color.NRGBA{0, 25, 35, 255}},
+		{CompositeChroma, ColorSpacePerceptual, 255, color.NRGBA{187, 108, 69, 255}},
+		{CompositeLightness, ColorSpacePerceptual, 255, color.NRGBA{243, 137, 84, 255}},
+		{CompositeLuminance, ColorSpacePerceptual, 255, color.NRGBA{255, 173, 87, 255}},
+		{CompositeErase, ColorSpacePerceptual, 128, color.NRGBA{200, 100, 50, 127}},
+		{CompositeSplit, ColorSpacePerceptual, 128, color.NRGBA{200, 100, 50, 127}},
+		{CompositeMerge, ColorSpacePerceptual, 128, color.NRGBA{120, 140, 145, 255}},
+		{CompositeColorErase, ColorSpacePerceptual, 128, color.NRGBA{221, 89, 25, 228}},
+		{CompositeNormal, ColorSpaceLinear, 128, color.NRGBA{148, 147, 179, 255}},
+		{CompositeMultiply, ColorSpaceLinear, 255, color.NRGBA{29, 68, 46, 255}},
+		{CompositeMultiply, ColorSpaceLinear, 128, color.NRGBA{147, 86, 48, 255}},
+		{CompositeDivide, ColorSpaceLinear, 255, color.NRGBA{255, 144, 54, 255}},
+		{CompositeAddition, ColorSpaceLinear, 255, color.NRGBA{203, 201, 244, 255}},
+		{CompositeSubtract, ColorSpaceLinear, 255, color.NRGBA{197, 0, 0, 255}},
+		{CompositeVividLight, ColorSpaceLinear, 255, color.NRGBA{0, 59, 99, 255}},
+		{CompositeVividLight, ColorSpaceLinear, 128, color.NRGBA{146, 83, 79, 255}},
+		{CompositeLinearBurn, ColorSpaceLinear, 255, color.NRGBA{0, 0, 0, 255}},
+		{CompositeChroma, ColorSpaceLinear, 255, color.NRGBA{187, 108, 69, 255}},
+		{CompositeLightness, ColorSpaceLinear, 255, color.NRGBA{243, 137, 84, 255}},
+		{CompositeLuminance, ColorSpaceLinear, 255, color.NRGBA{255, 129, 67, 255}},
+	} {
+		if test.Mode != CompositeNormal && test.Mode.String() == CompositeNormal.String() {
+			t.Errorf("test %d: mode %d has no name", n+1, test.Mode)
+		}
+
+		im := Image{
+			Layer{
+				Name:           "Top",
+				LayerBounds:    image.Rect(0, 0, 1, 1),
+				Mode:           test.Mode,
+				BlendSpace:     test.Space,
+				CompositeSpace: test.Space,
+				Image: singleColourImage{
+					Colour: color.NRGBA{R: 40, G: 180, B: 240, A: test.Alpha},
+					Width:  1,
+					Height: 1,
+				},
+			},
+			Layer{
+				Name:        "Bottom",
+				LayerBounds: image.Rect(0, 0, 1, 1),
+				Image: singleColourImage{
+					Colour: bottom,
+					Width:  1,
+					Height: 1,
+				},
+			},
+		}
+
+		got := color.NRGBAModel.Convert(im.At(0, 0)).(color.NRGBA)
+
+		for _, c := range [...][2]uint8{
+			{test.Expected.R, got.R},
+			{test.Expected.G, got.G},
+			{test.Expected.B, got.B},
+			{test.Expected.A, got.A},
+		} {
+			if d := int(c[0]) - int(c[1]); d > 1 || d < -1 {
+				t.Errorf("test %d: %s: expecting colour %v, got %v", n+1, test.Mode, test.Expected, got)
+
+				break
+			}
+		}
+	}
+}
+
+func TestVividLight(t *testing.T) {
+	for n, test := range [...]struct {
+		X, Y, Expected uint16
+	}{
+		{0x3333, 0, 0xffff},
+		{0, 0, 0xffff},
+		{0xffff, 0, 0xffff},
+		{0x9999, 0xffff, 0},
+		{0, 0xffff, 0},
+		{0xffff, 0xffff, 0},
+		{0x3333, 0x6666, 0},
+		{0x3333, 0xcccc, 0x8000},
+		{0xcccc, 0xcccc, 0xffff},
+	} {
+		got := compositeVividLight(test.X, test.Y)
+
+		if d := int(got) - int(test.Expected); d > 1 || d < -1 {
+			t.Errorf("test %d: vivid light of %d and %d: expecting %d, got %d", n+1, test.X, test.Y, test.Expected, got)
+		}
+	}
+}
+
+func TestCompositeSettings(t *testing.T) {
+	for n, test := range [...]struct {
+		Layer
+		CompositeMode              CompositeMode
+		BlendSpace, CompositeSpace ColorSpace
+	}{
+		{Layer{Mode: CompositeNormal}, CompositeModeUnion, ColorSpacePerceptual, ColorSpacePerceptual},
+		{Layer{Mode: CompositeNormal, NonLegacy: true}, CompositeModeUnion, ColorSpaceLinear, ColorSpaceLinear},
+		{Layer{Mode: CompositeMultiply}, CompositeModeClipToBackdrop, ColorSpacePerceptual, ColorSpacePerceptual},
+		{Layer{Mode: CompositeMultiply, NonLegacy: true}, CompositeModeClipToBackdrop, ColorSpaceLinear, ColorSpaceLinear},
+		{Layer{Mode: CompositeScreen, NonLegacy: true}, CompositeModeClipToBackdrop, ColorSpacePerceptual, ColorSpaceLinear},
+		{Layer{Mode: CompositeLuminance}, CompositeModeClipToBackdrop, ColorSpaceLinear, ColorSpaceLinear},
+		{Layer{Mode: CompositeVividLight}, CompositeModeClipToBackdrop, ColorSpacePerceptual, ColorSpaceLinear},
+		{Layer{Mode: CompositeMultiply, NonLegacy: true, CompositeMode: CompositeModeUnion, BlendSpace: ColorSpacePerceptual}, CompositeModeUnion, ColorSpacePerceptual, ColorSpaceLinear},
+	} {
+		if mode, blendSpace, compositeSpace := test.CompositeSettings(); mode != test.CompositeMode || blendSpace != test.BlendSpace || compositeSpace != test.CompositeSpace {
+			t.Errorf("test %d: %s: expecting settings %d, %d, %d, got %d, %d, %d", n+1, test.Mode, test.CompositeMode, test.BlendSpace, test.CompositeSpace, mode, blendSpace, compositeSpace)
+		}
+	}
+
+	for _, test := range [...]struct {
+		NonLegacy bool
+		Expected  color.NRGBA
+	}{
+		{false, color.NRGBA{G: 128, B: 127, A: 255}},
+		{true, color.NRGBA{G: 188, B: 187, A: 255}},
+	} {
+		im := Image{
+			Layer{
+				LayerBounds: image.Rect(0, 0, 1, 1),
+				NonLegacy:   test.NonLegacy,
+				Image: singleColourImage{
+					Colour: color.NRGBA{G: 255, A: 128},
+					Width:  1,
+					Height: 1,
+				},
+			},
+			Layer{
+				LayerBounds: image.Rect(0, 0, 1, 1),
+				Image: singleColourImage{
+					Colour: color.NRGBA{B: 255, A: 255},
+					Width:  1,
+					Height: 1,
+				},
+			},
+		}
+
+		if c := color.NRGBAModel.Convert(im.At(0, 0)); c != test.Expected {
+			t.Errorf("non-legacy %v: expecting colour %v, got %v", test.NonLegacy, test.Expected, c)
+		}
+	}
+}
+
+func TestPassThroughMask(t *testing.T) {
+	bottom := color.NRGBA{R: 200, G: 100, B: 50, A: 255}
+	mask := image.NewGray(image.Rect(0, 0, 10, 10))
+
+	for y := 0; y < 10; y++ {
+		for x := 5; x < 10; x++ {
+			mask.SetGray(x, y, color.Gray{Y: 255})
+		}
+	}
+
+	for n, test := range [...]struct {
+		Disabled    bool
+		Left, Right color.NRGBA
+	}{
+		{false, bottom, color.NRGBA{31, 71, 47, 255}},
+		{true, color.NRGBA{31, 71, 47, 255}, color.NRGBA{31, 71, 47, 255}},
+	} {
+		im := Image{
+			Layer{
+				Name:        "Group",
+				LayerBounds: image.Rect(0, 0, 10, 10),
+				Mode:        CompositePassThrough,
+				Image: MaskedImage{
+					Image: Image{
+						Layer{
+							Name:        "Multiply",
+							LayerBounds: image.Rect(0, 0, 10, 10),
+							Mode:        CompositeMultiply,
+							Image: singleColourImage{
+								Colour: color.NRGBA{R: 40, G: 180, B: 240, A: 255},
+								Width:  10,
+								Height: 10,
+							},
+						},
+					},
+					Mask:     mask,
+					Disabled: test.Disabled,
+				},
+			},
+			Layer{
+				Name:        "Bottom",
+				LayerBounds: image.Rect(0, 0, 10, 10),
+				Image: singleColourImage{
+					Colour: bottom,
+					Width:  10,
+					Height: 10,
+				},
+			},
+		}
+
+		flat := im.Flatten()
+
+		for _, p := range [...]struct {
+			image.Point
+			Expected color.NRGBA
+		}{
+			{image.Pt(2, 5), test.Left},
+			{image.Pt(7, 5), test.Right},
+		} {
+			got := color.NRGBAModel.Convert(im.At(p.X, p.Y)).(color.NRGBA)
+
+			for _, c := range [...][2]uint8{{p.Expected.R, got.R}, {p.Expected.G, got.G}, {p.Expected.B, got.B}, {p.Expected.A, got.A}} {
+				if d := int(c[0]) - int(c[1]); d > 1 || d < -1 {
+					t.Errorf("test %d: at %v: expecting colour %v, got %v", n+1, p.Point, p.Expected, got)
+
+					break
+				}
+			}
+
+			if rendered := color.NRGBAModel.Convert(flat.At(p.X, p.Y)); rendered != got {
+				t.Errorf("test %d: at %v: expecting rendered colour %v, got %v", n+1, p.Point, got, rendered)
+			}
+		}
+	}
+}
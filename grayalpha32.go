@@ -0,0 +1,102 @@
+package limage
+
+import (
+	"image"
+	"image/color"
+
+	"vimagination.zapto.org/limage/lcolor"
+)
+
+// GrayAlpha32 is an image of GrayAlpha32 pixels.
+type GrayAlpha32 struct {
+	Pix    []lcolor.GrayAlpha32
+	Stride int
+	Rect   image.Rectangle
+}
+
+// NewGrayAlpha32 create a new GrayAlpha32 image with the given bounds.
+func NewGrayAlpha32(r image.Rectangle) *GrayAlpha32 {
+	w, h := r.Dx(), r.Dy()
+
+	return &GrayAlpha32{
+		Pix:    make([]lcolor.GrayAlpha32, w*h),
+		Stride: w,
+		Rect:   r,
+	}
+}
+
+// At returns the color for the pixel at the specified coords.
+func (g *GrayAlpha32) At(x, y int) color.Color {
+	return g.GrayAlpha32At(x, y)
+}
+
+// Bounds returns the limits of the image.
+func (g *GrayAlpha32) Bounds() image.Rectangle {
+	return g.Rect
+}
+
+// ColorModel returns a color model to transform arbitrary colours into a
+// GrayAlpha32 color.
+func (g *GrayAlpha32) ColorModel() color.Model {
+	return lcolor.GrayAlpha32Model
+}
+
+// GrayAlpha32At returns a GrayAlpha32 color for the specified coords.
+func (g *GrayAlpha32) GrayAlpha32At(x, y int) lcolor.GrayAlpha32 {
+	if !(image.Point{x, y}.In(g.Rect)) {
+		return lcolor.GrayAlpha32{}
+	}
+
+	return g.Pix[g.PixOffset(x, y)]
+}
+
+// Opaque returns true if all pixels have full alpha.
+func (g *GrayAlpha32) Opaque() bool {
+	for _, c := range g.Pix {
+		if c.A != 0xffff {
+			return false
+		}
+	}
+
+	return true
+}
+
+// PixOffset returns the index of the element of Pix corresponding to the given
+// coords.
+func (g *GrayAlpha32) PixOffset(x, y int) int {
+	return (y-g.Rect.Min.Y)*g.Stride + x - g.Rect.Min.X
+}
+
+// Set converts the given colour to a GrayAlpha32 colour and sets it at the given
+// coords.
+func (g *GrayAlpha32) Set(x, y int, c color.Color) {
+	if !(image.Point{x, y}.In(g.Rect)) {
+		return
+	}
+
+	g.Pix[g.PixOffset(x, y)] = lcolor.GrayAlpha32Model.Convert(c).(lcolor.GrayAlpha32)
+}
+
+// SetGrayAlpha32 sets the colour at the given coords.
+func (g *GrayAlpha32) SetGrayAlpha32(x, y int, ga lcolor.GrayAlpha32) {
+	if !(image.Point{x, y}.In(g.Rect)) {
+		return
+	}
+
+	g.Pix[g.PixOffset(x, y)] = ga
+}
+
+// SubImage returns the Image viewable through the given bounds.
+func (g *GrayAlpha32) SubImage(r image.Rectangle) image.Image {
+	r = r.Intersect(g.Rect)
+
+	if r.Empty() {
+		return &GrayAlpha32{}
+	}
+
+	return &GrayAlpha32{
+		Pix:    g.Pix[g.PixOffset(r.Min.X, r.Min.Y):],
+		Stride: g.Stride,
+		Rect:   r,
+	}
+}
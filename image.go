@@ -33,8 +33,14 @@ func (g Image) Bounds() image.Rectangle {
 
 // At returns the colour at the specified coords.
 func (g Image) At(x, y int) color.Color {
-	c := color.Color(color.Alpha{})
+	return g.compositeOnto(color.NRGBA64{}, x, y)
+}
+
+// compositeOnto composites the layers of the group at the specified coords
+// onto the backdrop colour.
+func (g Image) compositeOnto(c color.NRGBA64, x, y int) color.NRGBA64 {
 	point := image.Point{x, y}
+	_, paletted := g.ColorModel().(color.Palette)
 
 	for i := len(g) - 1; i >= 0; i-- {
 		if g[i].Invisible {
@@ -42,16 +48,29 @@ func (g Image) At(x, y int) color.Color {
 		}
 
 		if !point.In(g[i].Bounds()) {
+			if !paletted && g[i].Mode.clipsBackdrop() {
+				c = color.NRGBA64{}
+			}
+
 			continue
 		}
 
-		if _, ok := g.ColorModel().(color.Palette); g[i].Mode != CompositeDissolve && ok {
+		if group, mask, ok := g[i].passThrough(); ok {
+			min := g[i].LayerBounds.Min
+			ao := 255 - g[i].Transparency
+
+			if mask != nil {
+				ao = maskOpacity(ao, mask.GrayAt(x-min.X, y-min.Y).Y)
+			}
+
+			c = fade(c, group.compositeOnto(c, x-min.X, y-min.Y), ao)
+		} else if paletted && g[i].Mode != CompositeDissolve {
 			if d := internal.ColourToNRGBA(g[i].At(x, y)); d.A > 0x7fff {
 				d.A = 0xffff
 				c = d
 			}
 		} else {
-			c = g[i].Mode.Composite(c, g[i].At(x, y))
+			c = g[i].composite(c, internal.ColourToNRGBA(g[i].At(x, y)))
 		}
 	}
 
@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"math"
+	"sync"
+)
+
+// LinearToSRGB converts a linear light value, in the range [0, 1], to the sRGB
+// gamma curve.
+func LinearToSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// SRGBToLinear converts a value on the sRGB gamma curve, in the range [0, 1],
+// to linear light.
+func SRGBToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// FloatToUint16 clamps a value to the range [0, 1] and scales it to the full
+// uint16 range.
+func FloatToUint16(v float64) uint16 {
+	if v <= 0 || v != v {
+		return 0
+	} else if v >= 1 {
+		return 0xffff
+	}
+
+	return uint16(v*0xffff + 0.5)
+}
+
+var (
+	transferOnce               sync.Once
+	linearToSRGB, sRGBToLinear [0x10000]uint16
+)
+
+func buildTransferTables() {
+	for n := range linearToSRGB {
+		v := float64(n) / 0xffff
+		linearToSRGB[n] = FloatToUint16(LinearToSRGB(v))
+		sRGBToLinear[n] = FloatToUint16(SRGBToLinear(v))
+	}
+}
+
+// LinearToSRGB16 converts a 16-bit linear light value to the sRGB gamma curve.
+func LinearToSRGB16(v uint16) uint16 {
+	transferOnce.Do(buildTransferTables)
+
+	return linearToSRGB[v]
+}
+
+// SRGBToLinear16 converts a 16-bit value on the sRGB gamma curve to linear
+// light.
+func SRGBToLinear16(v uint16) uint16 {
+	transferOnce.Do(buildTransferTables)
+
+	return sRGBToLinear[v]
+}
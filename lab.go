@@ -0,0 +1,101 @@
+package limage
+
+import (
+	"image/color"
+	"math"
+
+	"vimagination.zapto.org/limage/internal"
+)
+
+// lab represents a colour in the CIE L*a*b* colour space, relative to the D50
+// white point, as used for the LCH layer modes of GIMP.
+type lab struct {
+	L, A, B float64
+}
+
+const (
+	labEpsilon = 216. / 24389
+	labKappa   = 24389. / 27
+
+	whiteX = 0.9642
+	whiteZ = 0.8249
+)
+
+// linearRGB returns the components of the colour, in the range [0, 1], in
+// linear light.
+func linearRGB(c color.NRGBA64, linear bool) (float64, float64, float64) {
+	r := float64(c.R) / 0xffff
+	g := float64(c.G) / 0xffff
+	b := float64(c.B) / 0xffff
+
+	if linear {
+		return r, g, b
+	}
+
+	return internal.SRGBToLinear(r), internal.SRGBToLinear(g), internal.SRGBToLinear(b)
+}
+
+// luminance returns the relative luminance, Y, of the colour, which is in
+// linear light when linear is set, and on the sRGB gamma curve otherwise.
+func luminance(c color.NRGBA64, linear bool) float64 {
+	r, g, b := linearRGB(c, linear)
+
+	return 0.2225045*r + 0.7168786*g + 0.0606169*b
+}
+
+func toLab(c color.NRGBA64, linear bool) lab {
+	r, g, b := linearRGB(c, linear)
+
+	fx := labF((0.4360747*r + 0.3850649*g + 0.1430804*b) / whiteX)
+	fy := labF(0.2225045*r + 0.7168786*g + 0.0606169*b)
+	fz := labF((0.0139322*r + 0.0971045*g + 0.7141733*b) / whiteZ)
+
+	return lab{
+		L: 116*fy - 16,
+		A: 500 * (fx - fy),
+		B: 200 * (fy - fz),
+	}
+}
+
+func labF(t float64) float64 {
+	if t > labEpsilon {
+		return math.Cbrt(t)
+	}
+
+	return (labKappa*t + 16) / 116
+}
+
+func labFInv(f float64) float64 {
+	if t := f * f * f; t > labEpsilon {
+		return t
+	}
+
+	return (116*f - 16) / labKappa
+}
+
+// toNRGBA converts the colour to an opaque RGB colour, in linear light when
+// linear is set, and on the sRGB gamma curve otherwise, clamping the
+// components that are out of gamut.
+func (l lab) toNRGBA(linear bool) color.NRGBA64 {
+	fy := (l.L + 16) / 116
+	x := labFInv(fy+l.A/500) * whiteX
+	y := labFInv(fy)
+	z := labFInv(fy-l.B/200) * whiteZ
+
+	r := 3.1338561*x - 1.6168667*y - 0.4906146*z
+	g := -0.9787684*x + 1.9161415*y + 0.0334540*z
+	b := 0.0719453*x - 0.2289914*y + 1.4052427*z
+
+	if !linear {
+		r = internal.LinearToSRGB(math.Max(r, 0))
+		g = internal.LinearToSRGB(math.Max(g, 0))
+		b = internal.LinearToSRGB(math.Max(b, 0))
+	}
+
+	return color.NRGBA64{
+		R: internal.FloatToUint16(r),
+		G: internal.FloatToUint16(g),
+		B: internal.FloatToUint16(b),
+		A: 0xffff,
+	}
+}
@@ -12,9 +12,66 @@ type Layer struct {
 	Mode         Composite
 	Invisible    bool
 	Transparency uint8
+
+	// CompositeMode, BlendSpace and CompositeSpace determine how the layer is
+	// composited onto the layers below it.
+	CompositeMode  CompositeMode
+	BlendSpace     ColorSpace
+	CompositeSpace ColorSpace
+
+	// NonLegacy selects the non-legacy version of the modes that GIMP has in
+	// both a legacy and a non-legacy version, which have different automatic
+	// colour spaces. It is ignored for the other modes.
+	NonLegacy bool
+
+	// The following fields record the editing state of the layer, and do not
+	// affect how it is displayed.
+	Linked         bool
+	LockContent    bool
+	LockAlpha      bool
+	LockPosition   bool
+	LockVisibility bool
+	Expanded       bool // Only used for layer groups.
+	ColorTag       ColorTag
+	Tattoo         uint32 // A unique identifier for the layer within the image.
+
+	Parasites []Parasite
 	image.Image
 }
 
+// ColorTag is a colour used to label a layer.
+type ColorTag uint8
+
+// ColorTag constants.
+const (
+	ColorTagNone ColorTag = iota
+	ColorTagBlue
+	ColorTagGreen
+	ColorTagYellow
+	ColorTagOrange
+	ColorTagBrown
+	ColorTagRed
+	ColorTagViolet
+	ColorTagGray
+)
+
+// Parasite represents a named piece of arbitrary data attached to an image or
+// layer, such as a comment or plugin settings.
+type Parasite struct {
+	Name  string
+	Flags ParasiteFlags
+	Data  []byte
+}
+
+// ParasiteFlags determine how an application should treat a Parasite.
+type ParasiteFlags uint32
+
+// ParasiteFlags constants.
+const (
+	ParasitePersistent ParasiteFlags = 1 << iota
+	ParasiteUndoable
+)
+
 // Bounds returns the limits for the dimensions of the layer.
 func (l Layer) Bounds() image.Rectangle {
 	return l.LayerBounds
@@ -25,6 +82,50 @@ func (l Layer) At(x, y int) color.Color {
 	return transparency(l.Image.At(x-l.LayerBounds.Min.X, y-l.LayerBounds.Min.Y), 255-l.Transparency)
 }
 
+// composite composites the colour of the layer onto the given colour.
+func (l Layer) composite(b, t color.NRGBA64) color.NRGBA64 {
+	mode, blendSpace, compositeSpace := l.CompositeSettings()
+
+	return l.Mode.compositeWith(b, t, mode, blendSpace, compositeSpace)
+}
+
+// passThrough returns the group of a layer using CompositePassThrough, the
+// layers of which are composited directly onto the backdrop of the group
+// rather than onto each other in isolation, along with the mask of the group,
+// if it has one that is enabled.
+func (l Layer) passThrough() (Image, GrayImage, bool) {
+	if l.Mode != CompositePassThrough {
+		return nil, nil, false
+	}
+
+	var mask GrayImage
+
+	im := l.Image
+
+	if m, ok := im.(MaskedImage); ok {
+		im = m.Image
+
+		if !m.Disabled {
+			mask = m.Mask
+		}
+	}
+
+	switch g := im.(type) {
+	case Image:
+		return g, mask, true
+	case *Image:
+		return *g, mask, true
+	}
+
+	return nil, nil, false
+}
+
+// maskOpacity combines the opacity of a pass-through group with the value of
+// its mask.
+func maskOpacity(ao, m uint8) uint8 {
+	return uint8((uint32(ao)*uint32(m) + 127) / 255)
+}
+
 // SubImage returns an image representing the portion of the image p visible
 // through r. The returned value shares pixels with the original image.
 func (l Layer) SubImage(r image.Rectangle) image.Image {
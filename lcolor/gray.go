@@ -1,6 +1,10 @@
 package lcolor
 
-import "image/color"
+import (
+	"image/color"
+
+	"vimagination.zapto.org/limage/internal"
+)
 
 // GrayAlpha represents a Gray color with an Alpha channel.
 type GrayAlpha struct {
@@ -37,3 +41,34 @@ func grayAlphaColourModel(c color.Color) color.Color {
 		A: uint8(a >> 8),
 	}
 }
+
+// GrayAlpha32 represents a 16-bit Gray color with a 16-bit Alpha channel.
+type GrayAlpha32 struct {
+	Y, A uint16
+}
+
+// RGBA implements the color.Color interface.
+func (c GrayAlpha32) RGBA() (r, g, b, a uint32) {
+	a = uint32(c.A)
+	y := uint32(c.Y) * a / 0xffff
+
+	return y, y, y, a
+}
+
+// ToNRGBA converts the GrayAlpha32 color into the RGB colorspace.
+func (c GrayAlpha32) ToNRGBA() color.NRGBA64 {
+	return color.NRGBA64{c.Y, c.Y, c.Y, c.A}
+}
+
+func grayAlpha32ColourModel(c color.Color) color.Color {
+	if ga, ok := c.(GrayAlpha32); ok {
+		return ga
+	}
+
+	n := internal.ColourToNRGBA(c)
+
+	return GrayAlpha32{
+		Y: uint16((19595*uint32(n.R) + 38470*uint32(n.G) + 7471*uint32(n.B) + 1<<15) >> 16),
+		A: n.A,
+	}
+}
@@ -0,0 +1,416 @@
+package lcolor
+
+import (
+	"encoding/binary"
+	"errors"
+	"image/color"
+	"math"
+	"sync"
+
+	"vimagination.zapto.org/limage/internal"
+)
+
+// ICCProfile represents an embedded ICC colour profile.
+//
+// The raw profile data is always retained so that it can be written back out
+// unchanged. RGB matrix/TRC profiles can additionally be used to convert
+// colours to and from sRGB; for any other kind of profile, the conversion
+// methods return the colours unchanged.
+type ICCProfile struct {
+	Data []byte
+
+	convertible bool
+	toXYZ       [3][3]float64
+	fromXYZ     [3][3]float64
+	curves      [3]toneCurve
+
+	inverseOnce sync.Once
+	inverse     [3][]float64
+}
+
+const (
+	iccHeaderSize  = 128
+	iccTagSize     = 12
+	inverseEntries = 4096
+)
+
+// D50 relative XYZ to and from linear sRGB, using Bradford adaptation.
+var (
+	srgbToXYZ = [3][3]float64{
+		{0.4360747, 0.3850649, 0.1430804},
+		{0.2225045, 0.7168786, 0.0606169},
+		{0.0139322, 0.0970045, 0.7139182},
+	}
+	xyzToSRGB = [3][3]float64{
+		{3.1338561, -1.6168667, -0.4906146},
+		{-0.9787684, 1.9161415, 0.0334540},
+		{0.0719453, -0.2289914, 1.4052427},
+	}
+)
+
+// ParseICCProfile parses the given ICC profile data.
+//
+// An error is only returned when the data is not an ICC profile; profiles
+// that cannot be used for conversion are still returned.
+func ParseICCProfile(data []byte) (*ICCProfile, error) {
+	if len(data) < iccHeaderSize+4 || string(data[36:40]) != "acsp" {
+		return nil, ErrInvalidICCProfile
+	}
+
+	p := &ICCProfile{Data: data}
+
+	if string(data[16:20]) != "RGB " || string(data[20:24]) != "XYZ " {
+		return p, nil
+	}
+
+	tags := make(map[string][]byte)
+	count := binary.BigEndian.Uint32(data[iccHeaderSize:])
+
+	if uint64(count)*iccTagSize > uint64(len(data)-iccHeaderSize-4) {
+		return nil, ErrInvalidICCProfile
+	}
+
+	for n := uint32(0); n < count; n++ {
+		t := data[iccHeaderSize+4+n*iccTagSize:]
+		offset := uint64(binary.BigEndian.Uint32(t[4:]))
+		size := uint64(binary.BigEndian.Uint32(t[8:]))
+
+		if offset+size > uint64(len(data)) {
+			return nil, ErrInvalidICCProfile
+		}
+
+		tags[string(t[:4])] = data[offset : offset+size]
+	}
+
+	for n, c := range [3]string{"r", "g", "b"} {
+		x, ok := parseXYZ(tags[c+"XYZ"])
+		if !ok {
+			return p, nil
+		}
+
+		for m := range x {
+			p.toXYZ[m][n] = x[m]
+		}
+
+		if p.curves[n] = parseCurve(tags[c+"TRC"]); p.curves[n] == nil {
+			return p, nil
+		}
+	}
+
+	fromXYZ, ok := invertMatrix(p.toXYZ)
+	if !ok {
+		return p, nil
+	}
+
+	p.fromXYZ = fromXYZ
+	p.convertible = true
+
+	return p, nil
+}
+
+func parseXYZ(data []byte) ([3]float64, bool) {
+	var xyz [3]float64
+
+	if len(data) < 20 || string(data[:4]) != "XYZ " {
+		return xyz, false
+	}
+
+	for n := range xyz {
+		xyz[n] = s15Fixed16(data[8+n*4:])
+	}
+
+	return xyz, true
+}
+
+func s15Fixed16(data []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(data))) / 0x10000
+}
+
+// Convertible returns true if the profile can be used to convert colours to
+// and from sRGB.
+func (p *ICCProfile) Convertible() bool {
+	return p != nil && p.convertible
+}
+
+// ToSRGB converts a colour in the colour space of the profile to sRGB.
+func (p *ICCProfile) ToSRGB(c color.Color) color.NRGBA64 {
+	n := internal.ColourToNRGBA(c)
+
+	if !p.Convertible() {
+		return n
+	}
+
+	var linear [3]float64
+
+	for i, v := range [3]uint16{n.R, n.G, n.B} {
+		linear[i] = p.curves[i].apply(float64(v) / 0xffff)
+	}
+
+	rgb := multiply(xyzToSRGB, multiply(p.toXYZ, linear))
+
+	return color.NRGBA64{
+		R: internal.FloatToUint16(internal.LinearToSRGB(clamp(rgb[0]))),
+		G: internal.FloatToUint16(internal.LinearToSRGB(clamp(rgb[1]))),
+		B: internal.FloatToUint16(internal.LinearToSRGB(clamp(rgb[2]))),
+		A: n.A,
+	}
+}
+
+// FromSRGB converts an sRGB colour to the colour space of the profile.
+func (p *ICCProfile) FromSRGB(c color.Color) color.NRGBA64 {
+	n := internal.ColourToNRGBA(c)
+
+	if !p.Convertible() {
+		return n
+	}
+
+	p.inverseOnce.Do(p.buildInverse)
+
+	var linear [3]float64
+
+	for i, v := range [3]uint16{n.R, n.G, n.B} {
+		linear[i] = internal.SRGBToLinear(float64(v) / 0xffff)
+	}
+
+	rgb := multiply(p.fromXYZ, multiply(srgbToXYZ, linear))
+
+	return color.NRGBA64{
+		R: internal.FloatToUint16(lookup(p.inverse[0], clamp(rgb[0]))),
+		G: internal.FloatToUint16(lookup(p.inverse[1], clamp(rgb[1]))),
+		B: internal.FloatToUint16(lookup(p.inverse[2], clamp(rgb[2]))),
+		A: n.A,
+	}
+}
+
+// ToSRGBModel returns a colour model that converts colours in the colour space
+// of the profile to sRGB.
+func (p *ICCProfile) ToSRGBModel() color.Model {
+	return color.ModelFunc(func(c color.Color) color.Color {
+		return p.ToSRGB(c)
+	})
+}
+
+// FromSRGBModel returns a colour model that converts sRGB colours to the
+// colour space of the profile.
+func (p *ICCProfile) FromSRGBModel() color.Model {
+	return color.ModelFunc(func(c color.Color) color.Color {
+		return p.FromSRGB(c)
+	})
+}
+
+func (p *ICCProfile) buildInverse() {
+	for n, curve := range p.curves {
+		p.inverse[n] = make([]float64, inverseEntries+1)
+
+		for i := range p.inverse[n] {
+			p.inverse[n][i] = invertCurve(curve, float64(i)/inverseEntries)
+		}
+	}
+}
+
+func lookup(table []float64, v float64) float64 {
+	pos := v * inverseEntries
+	i := int(pos)
+
+	if i >= inverseEntries {
+		return table[inverseEntries]
+	}
+
+	f := pos - float64(i)
+
+	return table[i]*(1-f) + table[i+1]*f
+}
+
+// invertCurve finds the input that results in the given output, assuming that
+// the curve is non-decreasing.
+func invertCurve(c toneCurve, y float64) float64 {
+	lo, hi := 0.0, 1.0
+
+	for n := 0; n < 32; n++ {
+		mid := (lo + hi) / 2
+
+		if c.apply(mid) < y {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	return (lo + hi) / 2
+}
+
+func multiply(m [3][3]float64, v [3]float64) [3]float64 {
+	return [3]float64{
+		m[0][0]*v[0] + m[0][1]*v[1] + m[0][2]*v[2],
+		m[1][0]*v[0] + m[1][1]*v[1] + m[1][2]*v[2],
+		m[2][0]*v[0] + m[2][1]*v[1] + m[2][2]*v[2],
+	}
+}
+
+func invertMatrix(m [3][3]float64) ([3][3]float64, bool) {
+	var inv [3][3]float64
+
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+
+	if det == 0 {
+		return inv, false
+	}
+
+	inv[0][0] = (m[1][1]*m[2][2] - m[1][2]*m[2][1]) / det
+	inv[0][1] = (m[0][2]*m[2][1] - m[0][1]*m[2][2]) / det
+	inv[0][2] = (m[0][1]*m[1][2] - m[0][2]*m[1][1]) / det
+	inv[1][0] = (m[1][2]*m[2][0] - m[1][0]*m[2][2]) / det
+	inv[1][1] = (m[0][0]*m[2][2] - m[0][2]*m[2][0]) / det
+	inv[1][2] = (m[0][2]*m[1][0] - m[0][0]*m[1][2]) / det
+	inv[2][0] = (m[1][0]*m[2][1] - m[1][1]*m[2][0]) / det
+	inv[2][1] = (m[0][1]*m[2][0] - m[0][0]*m[2][1]) / det
+	inv[2][2] = (m[0][0]*m[1][1] - m[0][1]*m[1][0]) / det
+
+	return inv, true
+}
+
+func clamp(v float64) float64 {
+	if !(v > 0) {
+		return 0
+	} else if v > 1 {
+		return 1
+	}
+
+	return v
+}
+
+type toneCurve interface {
+	apply(float64) float64
+}
+
+type gammaCurve float64
+
+func (g gammaCurve) apply(v float64) float64 {
+	return math.Pow(v, float64(g))
+}
+
+type tableCurve []uint16
+
+func (t tableCurve) apply(v float64) float64 {
+	pos := v * float64(len(t)-1)
+	i := int(pos)
+
+	if i >= len(t)-1 {
+		return float64(t[len(t)-1]) / 0xffff
+	}
+
+	f := pos - float64(i)
+
+	return (float64(t[i])*(1-f) + float64(t[i+1])*f) / 0xffff
+}
+
+type parametricCurve struct {
+	typ                 uint16
+	g, a, b, c, d, e, f float64
+}
+
+func (p parametricCurve) apply(v float64) float64 {
+	switch p.typ {
+	case 0:
+		return math.Pow(v, p.g)
+	case 1:
+		if v >= -p.b/p.a {
+			return math.Pow(p.a*v+p.b, p.g)
+		}
+
+		return 0
+	case 2:
+		if v >= -p.b/p.a {
+			return math.Pow(p.a*v+p.b, p.g) + p.c
+		}
+
+		return p.c
+	case 3:
+		if v >= p.d {
+			return math.Pow(p.a*v+p.b, p.g)
+		}
+
+		return p.c * v
+	default:
+		if v >= p.d {
+			return math.Pow(p.a*v+p.b, p.g) + p.e
+		}
+
+		return p.c*v + p.f
+	}
+}
+
+var parametricParams = [...]int{1, 3, 4, 5, 7}
+
+func parseCurve(data []byte) toneCurve {
+	if len(data) < 12 {
+		return nil
+	}
+
+	switch string(data[:4]) {
+	case "curv":
+		count := binary.BigEndian.Uint32(data[8:])
+
+		switch count {
+		case 0:
+			return gammaCurve(1)
+		case 1:
+			if len(data) < 14 {
+				return nil
+			}
+
+			return gammaCurve(float64(binary.BigEndian.Uint16(data[12:])) / 0x100)
+		}
+
+		if uint64(len(data)-12) < uint64(count)*2 {
+			return nil
+		}
+
+		t := make(tableCurve, count)
+
+		for n := range t {
+			t[n] = binary.BigEndian.Uint16(data[12+n*2:])
+		}
+
+		return t
+	case "para":
+		typ := binary.BigEndian.Uint16(data[8:])
+		if int(typ) >= len(parametricParams) || len(data) < 12+parametricParams[typ]*4 {
+			return nil
+		}
+
+		var params [7]float64
+
+		for n := 0; n < parametricParams[typ]; n++ {
+			params[n] = s15Fixed16(data[12+n*4:])
+		}
+
+		p := parametricCurve{
+			typ: typ,
+			g:   params[0],
+			a:   params[1],
+			b:   params[2],
+			c:   params[3],
+			d:   params[4],
+			e:   params[5],
+			f:   params[6],
+		}
+
+		if typ == 1 || typ == 2 {
+			if p.a == 0 {
+				return nil
+			}
+		}
+
+		return p
+	}
+
+	return nil
+}
+
+// Errors.
+var (
+	ErrInvalidICCProfile = errors.New("invalid ICC profile")
+)
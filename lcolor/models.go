@@ -4,6 +4,8 @@ import "image/color"
 
 // Color Models.
 var (
-	GrayAlphaModel = color.ModelFunc(grayAlphaColourModel)
-	RGBModel       = color.ModelFunc(rgbColourModel)
+	GrayAlphaModel   = color.ModelFunc(grayAlphaColourModel)
+	GrayAlpha32Model = color.ModelFunc(grayAlpha32ColourModel)
+	RGBModel         = color.ModelFunc(rgbColourModel)
+	RGB48Model       = color.ModelFunc(rgb48ColourModel)
 )
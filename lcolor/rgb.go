@@ -41,3 +41,34 @@ func rgbColourModel(c color.Color) color.Color {
 		B: uint8(b >> 8),
 	}
 }
+
+// RGB48 is a 16-bit per channel colour type whose Alpha channel is always
+// full.
+type RGB48 struct {
+	R, G, B uint16
+}
+
+// RGBA implements the color.Color interface.
+func (rgb RGB48) RGBA() (r, g, b, a uint32) {
+	return uint32(rgb.R), uint32(rgb.G), uint32(rgb.B), 0xFFFF
+}
+
+// ToNRGBA returns itself as a non-alpha-premultiplied value
+// As the alpha is always full, this only returns the normal values.
+func (rgb RGB48) ToNRGBA() color.NRGBA64 {
+	return color.NRGBA64{rgb.R, rgb.G, rgb.B, 0xffff}
+}
+
+func rgb48ColourModel(c color.Color) color.Color {
+	if rgb, ok := c.(RGB48); ok {
+		return rgb
+	}
+
+	r, g, b, _ := c.RGBA()
+
+	return RGB48{
+		R: uint16(r),
+		G: uint16(g),
+		B: uint16(b),
+	}
+}
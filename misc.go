@@ -7,19 +7,60 @@ import (
 	"strings"
 
 	"vimagination.zapto.org/limage/internal"
+	"vimagination.zapto.org/limage/lcolor"
 )
 
+// GrayImage is an image of which the gray values can be read directly, such as
+// an *image.Gray, and is used for the masks of images.
+type GrayImage interface {
+	image.Image
+	GrayAt(x, y int) color.Gray
+}
+
 // MaskedImage represents an image that has a to-be-applied mask.
 type MaskedImage struct {
 	image.Image
-	Mask *image.Gray
+	Mask GrayImage
+
+	// Disabled is set when the mask is not to be applied to the image.
+	Disabled bool
+
+	// The following fields record how an editor displays the mask, and do not
+	// affect how the image is displayed.
+	ShowMask         bool // Display the mask in place of the image.
+	EditMask         bool // The mask, rather than the image, is selected for editing.
+	MaskName         string
+	MaskColour       lcolor.RGB
+	MaskTransparency uint8
 }
 
 // At returns the colour at the specified coords after masking.
 func (m MaskedImage) At(x, y int) color.Color {
+	if m.Disabled {
+		return m.Image.At(x, y)
+	}
+
 	return transparency(m.Image.At(x, y), m.Mask.GrayAt(x, y).Y)
 }
 
+// ProfiledImage represents an image whose colours are in the colour space of
+// an ICC profile, converting them to sRGB so that it can be composited with
+// sRGB images.
+type ProfiledImage struct {
+	image.Image
+	Profile *lcolor.ICCProfile
+}
+
+// ColorModel returns a colour model that converts to sRGB.
+func (p ProfiledImage) ColorModel() color.Model {
+	return color.NRGBA64Model
+}
+
+// At returns the sRGB colour at the specified coords.
+func (p ProfiledImage) At(x, y int) color.Color {
+	return p.Profile.ToSRGB(p.Image.At(x, y))
+}
+
 // Text represents a text layer.
 type Text struct {
 	image.Image
@@ -51,14 +92,36 @@ type TextDatum struct {
 func transparency(ac color.Color, ao uint8) color.Color {
 	if ao == 0xff {
 		return ac
+	}
+
+	return transparency64(internal.ColourToNRGBA(ac), ao)
+}
+
+// fade returns the top colour composited onto the bottom colour with the
+// given opacity, such that a fully opaque top colour replaces the bottom
+// colour.
+func fade(bottom, top color.NRGBA64, ao uint8) color.NRGBA64 {
+	if ao == 0xff {
+		return top
 	} else if ao == 0 {
+		return bottom
+	}
+
+	o := uint32(ao) * 0x101
+	a := (uint32(bottom.A)*(0xffff-o) + uint32(top.A)*o) / 0xffff
+
+	if a == 0 {
 		return color.NRGBA64{}
 	}
 
-	c := internal.ColourToNRGBA(ac)
-	o := uint32(ao)
-	o |= o << 8
-	c.A = uint16(o * uint32(c.A) / 0xffff)
+	mix := func(b, t uint16) uint16 {
+		return uint16((uint32(b)*uint32(bottom.A)/0xffff*(0xffff-o) + uint32(t)*uint32(top.A)/0xffff*o) / a)
+	}
 
-	return c
+	return color.NRGBA64{
+		R: mix(bottom.R, top.R),
+		G: mix(bottom.G, top.G),
+		B: mix(bottom.B, top.B),
+		A: uint16(a),
+	}
 }
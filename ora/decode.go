@@ -10,6 +10,7 @@ import (
 	"strconv"
 
 	"vimagination.zapto.org/limage"
+	"vimagination.zapto.org/limage/lcolor"
 )
 
 type decoder struct {
@@ -180,6 +181,27 @@ func Decode(zr *zip.Reader) (limage.Image, error) {
 	return d.readStack(image.Point{})
 }
 
+// DecodeWithProfile reads an ORA layered image, as Decode, along with the ICC
+// colour profile found by DecodeICCProfile, which is nil when there is none.
+//
+// The layers are not converted, but can be wrapped in a limage.ProfiledImage to
+// use them as sRGB images.
+//
+// It accepts a *zip.Reader and it is the callers responsibility to handle it.
+func DecodeWithProfile(zr *zip.Reader) (limage.Image, *lcolor.ICCProfile, error) {
+	im, err := Decode(zr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	profile, err := DecodeICCProfile(zr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return im, profile, nil
+}
+
 // Errors.
 var (
 	ErrMissingStack    = errors.New("missing stack file")
@@ -143,6 +143,7 @@ func TestDecoder(t *testing.T) {
 			Image: limage.Image{
 				limage.Layer{
 					Name: "Layer Group",
+					Mode: limage.CompositePassThrough, // the stack has no isolation attribute
 					Image: limage.Image{
 						limage.Layer{
 							Name: "Blue",
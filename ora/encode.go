@@ -4,17 +4,38 @@ import (
 	"archive/zip"
 	"encoding/xml"
 	"image"
-	"image/png"
 	"io"
 	"strconv"
 
 	"vimagination.zapto.org/limage"
+	"vimagination.zapto.org/limage/lcolor"
 )
 
 const mimetypeStr = "image/openraster"
 
+type encoder struct {
+	profile *lcolor.ICCProfile
+}
+
+// EncoderOption is a function that modifies how an image is encoded.
+type EncoderOption func(*encoder)
+
+// WithICCProfile sets the ICC colour profile to embed in each of the PNG files
+// of the ORA file.
+func WithICCProfile(p *lcolor.ICCProfile) EncoderOption {
+	return func(e *encoder) {
+		e.profile = p
+	}
+}
+
 // Encode encodes the given image as an ORA file to the given Writer.
-func Encode(w io.Writer, m image.Image) error {
+func Encode(w io.Writer, m image.Image, opts ...EncoderOption) error {
+	var enc encoder
+
+	for _, opt := range opts {
+		opt(&enc)
+	}
+
 	lim := toLayer(m)
 	b := m.Bounds()
 	lim.LayerBounds.Max.X = b.Dx()
@@ -31,7 +52,7 @@ func Encode(w io.Writer, m image.Image) error {
 		return err
 	} else if _, err = fw.Write([]byte(mimetypeStr)); err != nil {
 		return err
-	} else if _, err = writeLayers(zw, lim, 0); err != nil {
+	} else if _, err = writeLayers(zw, lim, 0, enc.profile); err != nil {
 		return err
 	} else if fw, err = zw.Create("stack.xml"); err != nil {
 		return err
@@ -65,7 +86,7 @@ func Encode(w io.Writer, m image.Image) error {
 		return err
 	}
 
-	return writeImage(e, zw, m, lim)
+	return writeImage(e, zw, m, lim, enc.profile)
 }
 
 func toLayer(m image.Image) limage.Layer {
@@ -85,7 +106,7 @@ func toLayer(m image.Image) limage.Layer {
 	}
 }
 
-func writeImage(e *xml.Encoder, zw *zip.Writer, m image.Image, lim limage.Layer) error {
+func writeImage(e *xml.Encoder, zw *zip.Writer, m image.Image, lim limage.Layer, profile *lcolor.ICCProfile) error {
 	var fw io.Writer
 
 	if _, err := writeStack(e, lim, 0); err != nil {
@@ -98,9 +119,9 @@ func writeImage(e *xml.Encoder, zw *zip.Writer, m image.Image, lim limage.Layer)
 		return err
 	} else if err = e.Flush(); err != nil {
 		return err
-	} else if fw, err = zw.Create("mergedimage.png"); err != nil {
+	} else if fw, err = zw.Create(mergedImage); err != nil {
 		return err
-	} else if err = png.Encode(fw, m); err != nil {
+	} else if err = encodePNG(fw, m, profile); err != nil {
 		return err
 	} else if fw, err = zw.Create("Thumbnails/thumbnail.png"); err != nil {
 		return err
@@ -116,10 +137,10 @@ func writeImage(e *xml.Encoder, zw *zip.Writer, m image.Image, lim limage.Layer)
 		m = thumbnail{Image: m, scale: scale}
 	}
 
-	return png.Encode(fw, m)
+	return encodePNG(fw, m, profile)
 }
 
-func writeLayers(zw *zip.Writer, lim limage.Layer, layerNum int) (int, error) {
+func writeLayers(zw *zip.Writer, lim limage.Layer, layerNum int, profile *lcolor.ICCProfile) (int, error) {
 	var (
 		err error
 		f   io.Writer
@@ -127,9 +148,9 @@ func writeLayers(zw *zip.Writer, lim limage.Layer, layerNum int) (int, error) {
 
 	switch im := lim.Image.(type) {
 	case limage.Image:
-		layerNum, err = writeGroup(zw, im, layerNum)
+		layerNum, err = writeGroup(zw, im, layerNum, profile)
 	case *limage.Image:
-		layerNum, err = writeGroup(zw, *im, layerNum)
+		layerNum, err = writeGroup(zw, *im, layerNum, profile)
 	// case limage.Text, *limage.Text: // text is not yet in the spec
 	default:
 		layerNum++
@@ -139,7 +160,7 @@ func writeLayers(zw *zip.Writer, lim limage.Layer, layerNum int) (int, error) {
 			return 0, err
 		}
 
-		err = png.Encode(f, lim.Image)
+		err = encodePNG(f, lim.Image, profile)
 		if err != nil {
 			return 0, err
 		}
@@ -148,11 +169,11 @@ func writeLayers(zw *zip.Writer, lim limage.Layer, layerNum int) (int, error) {
 	return layerNum, err
 }
 
-func writeGroup(zw *zip.Writer, lim limage.Image, layerNum int) (int, error) {
+func writeGroup(zw *zip.Writer, lim limage.Image, layerNum int, profile *lcolor.ICCProfile) (int, error) {
 	var err error
 
 	for _, l := range lim {
-		layerNum, err = writeLayers(zw, l, layerNum)
+		layerNum, err = writeLayers(zw, l, layerNum, profile)
 		if err != nil {
 			return 0, err
 		}
@@ -195,7 +216,7 @@ func writeStack(e *xml.Encoder, lim limage.Layer, layerNum int) (int, error) {
 
 	if lim.Transparency != 0 {
 		attrs = append(attrs, xml.Attr{
-			Name:  xml.Name{Local: "visibility"},
+			Name:  xml.Name{Local: "opacity"},
 			Value: strconv.FormatFloat(float64(255-lim.Transparency)/255, 'f', -1, 64),
 		})
 	}
@@ -254,11 +275,15 @@ func writeStack(e *xml.Encoder, lim limage.Layer, layerNum int) (int, error) {
 
 	var err error
 
+	// An auto isolated stack with an opacity is isolated when read, so a
+	// pass-through group with an opacity is written as an isolated group.
+	passThrough := lim.Mode == limage.CompositePassThrough && lim.Transparency == 0
+
 	switch im := lim.Image.(type) {
 	case limage.Image:
-		layerNum, err = writeGroupStack(e, im, attrs, layerNum)
+		layerNum, err = writeGroupStack(e, im, attrs, passThrough, layerNum)
 	case *limage.Image:
-		layerNum, err = writeGroupStack(e, *im, attrs, layerNum)
+		layerNum, err = writeGroupStack(e, *im, attrs, passThrough, layerNum)
 	// case limage.Text, *limage.Text: // text is not yet in the spec
 	default:
 		layerNum++
@@ -280,10 +305,19 @@ func writeStack(e *xml.Encoder, lim limage.Layer, layerNum int) (int, error) {
 	return layerNum, err
 }
 
-func writeGroupStack(e *xml.Encoder, lim limage.Image, attrs []xml.Attr, layerNum int) (int, error) {
+func writeGroupStack(e *xml.Encoder, lim limage.Image, attrs []xml.Attr, passThrough bool, layerNum int) (int, error) {
+	isolation := "isolate"
+
+	if passThrough {
+		isolation = "auto"
+	}
+
 	err := e.EncodeToken(xml.StartElement{
 		Name: xml.Name{Local: "stack"},
-		Attr: attrs,
+		Attr: append(attrs, xml.Attr{
+			Name:  xml.Name{Local: "isolation"},
+			Value: isolation,
+		}),
 	})
 	if err != nil {
 		return 0, err
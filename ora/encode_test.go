@@ -2,11 +2,17 @@ package ora
 
 import (
 	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
 	"image"
 	"image/color"
+	"io"
 	"testing"
 
 	"vimagination.zapto.org/limage"
+	"vimagination.zapto.org/limage/lcolor"
 	"vimagination.zapto.org/memio"
 )
 
@@ -145,3 +151,439 @@ func TestEncode(t *testing.T) {
 		}
 	}
 }
+
+func TestEncodeProfile(t *testing.T) {
+	data := make([]byte, 132)
+
+	copy(data[16:], "GRAYXYZ ")
+	copy(data[36:], "acsp")
+
+	profile, err := lcolor.ParseICCProfile(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	im := limage.Image{
+		limage.Layer{
+			Name: "Background",
+			Image: singleColourImage{
+				Colour: color.RGBA64{R: 65535, A: 65535},
+				Width:  50,
+				Height: 50,
+			},
+			LayerBounds: image.Rect(0, 0, 50, 50),
+		},
+	}
+
+	for n, test := range [...]*lcolor.ICCProfile{nil, profile} {
+		var buf []byte
+
+		if err := Encode(memio.Create(&buf), im, WithICCProfile(test)); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		f, err := zip.NewReader(memio.Open(buf), int64(len(buf)))
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		l, p, err := DecodeWithProfile(f)
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		} else if err := compareLayers(l, im); err != nil {
+			t.Errorf("test %d: %s", n+1, err)
+		}
+
+		if test == nil {
+			if p != nil {
+				t.Errorf("test %d: expecting no profile", n+1)
+			}
+		} else if p == nil {
+			t.Errorf("test %d: expecting profile", n+1)
+		} else if !bytes.Equal(p.Data, test.Data) {
+			t.Errorf("test %d: profile data does not match", n+1)
+		}
+	}
+}
+
+func TestDecodeLayerProfile(t *testing.T) {
+	data := make([]byte, 132)
+
+	copy(data[16:], "GRAYXYZ ")
+	copy(data[36:], "acsp")
+
+	var buf []byte
+
+	zw := zip.NewWriter(memio.Create(&buf))
+
+	for _, file := range [...]struct {
+		Name, Data string
+	}{
+		{"mimetype", mimetypeStr},
+		{"stack.xml", `<image w="10" h="10"><stack><layer name="Layer" src="data/layer.png" /></stack></image>`},
+	} {
+		fw, err := zw.Create(file.Name)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		fw.Write([]byte(file.Data))
+	}
+
+	fw, err := zw.Create("data/layer.png")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if err = encodePNG(fw, image.NewNRGBA(image.Rect(0, 0, 10, 10)), &lcolor.ICCProfile{Data: data}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if err = zw.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	f, err := zip.NewReader(memio.Open(buf), int64(len(buf)))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	_, p, err := DecodeWithProfile(f)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if p == nil {
+		t.Fatalf("expecting profile from layer image")
+	} else if !bytes.Equal(p.Data, data) {
+		t.Errorf("profile data does not match")
+	}
+}
+
+func TestReadICCPLimits(t *testing.T) {
+	chunk := func(length uint32, data []byte) []byte {
+		c := binary.BigEndian.AppendUint32(nil, length)
+		c = append(c, "iCCP"...)
+
+		return append(c, data...)
+	}
+
+	var compressed bytes.Buffer
+
+	zw := zlib.NewWriter(&compressed)
+
+	zw.Write(make([]byte, maxProfileSize+1))
+	zw.Close()
+
+	for n, test := range [...][]byte{
+		chunk(maxProfileSize+1, nil),
+		chunk(0xffffffff, nil),
+		chunk(uint32(compressed.Len())+3, append([]byte("p\x00\x00"), compressed.Bytes()...)),
+	} {
+		if _, err := readICCP(bytes.NewReader(append([]byte(pngHeader), test...))); !errors.Is(err, ErrProfileTooLarge) {
+			t.Errorf("test %d: expecting error %v, got %v", n+1, ErrProfileTooLarge, err)
+		}
+	}
+}
+
+func TestCompositeOps(t *testing.T) {
+	bottom := color.NRGBA{R: 200, G: 100, B: 50, A: 192}
+
+	for n, test := range [...]struct {
+		Mode            limage.Composite
+		Inside, Outside color.NRGBA
+	}{
+		{limage.CompositePlus, color.NRGBA{171, 166, 158, 255}, bottom},
+		{limage.CompositeDestinationIn, color.NRGBA{200, 100, 50, 96}, color.NRGBA{}},
+		{limage.CompositeDestinationOut, color.NRGBA{200, 100, 50, 96}, bottom},
+		{limage.CompositeSourceAtop, color.NRGBA{120, 140, 145, 192}, bottom},
+		{limage.CompositeDestinationAtop, color.NRGBA{160, 120, 97, 128}, color.NRGBA{}},
+	} {
+		im := limage.Image{
+			limage.Layer{
+				Name:        "Top",
+				LayerBounds: image.Rect(5, 5, 15, 15),
+				Mode:        test.Mode,
+				Image: singleColourImage{
+					Colour: color.NRGBA{R: 40, G: 180, B: 240, A: 128},
+					Width:  10,
+					Height: 10,
+				},
+			},
+			limage.Layer{
+				Name:        "Bottom",
+				LayerBounds: image.Rect(0, 0, 20, 20),
+				Image: singleColourImage{
+					Colour: bottom,
+					Width:  20,
+					Height: 20,
+				},
+			},
+		}
+
+		var buf []byte
+
+		if err := Encode(memio.Create(&buf), im); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		f, err := zip.NewReader(memio.Open(buf), int64(len(buf)))
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		d, err := Decode(f)
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		if d[0].Mode != test.Mode {
+			t.Errorf("test %d: expecting mode %s, got %s", n+1, test.Mode, d[0].Mode)
+		}
+
+		flat := d.Flatten()
+
+		for _, p := range [...]struct {
+			image.Point
+			Expected color.NRGBA
+		}{
+			{image.Pt(10, 10), test.Inside},
+			{image.Pt(2, 2), test.Outside},
+		} {
+			got := color.NRGBAModel.Convert(d.At(p.X, p.Y)).(color.NRGBA)
+
+			if !similarColours(got, p.Expected) {
+				t.Errorf("test %d: %s at %v: expecting colour %v, got %v", n+1, test.Mode, p.Point, p.Expected, got)
+			}
+
+			if rendered := color.NRGBAModel.Convert(flat.At(p.X, p.Y)); rendered != got {
+				t.Errorf("test %d: %s at %v: expecting rendered colour %v, got %v", n+1, test.Mode, p.Point, got, rendered)
+			}
+		}
+	}
+}
+
+func similarColours(a, b color.NRGBA) bool {
+	for _, c := range [...][2]uint8{{a.R, b.R}, {a.G, b.G}, {a.B, b.B}, {a.A, b.A}} {
+		if c[0]-c[1] > 1 && c[1]-c[0] > 1 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestPassThrough(t *testing.T) {
+	bottom := color.NRGBA{R: 200, G: 100, B: 50, A: 255}
+
+	for n, test := range [...]struct {
+		Mode          limage.Composite
+		Transparency  uint8
+		Inside        color.NRGBA
+		Decoded       limage.Composite
+		DecodedInside color.NRGBA
+		Isolation     string
+	}{
+		{limage.CompositeNormal, 0, bottom, limage.CompositeNormal, bottom, `isolation="isolate"`},
+		{limage.CompositePassThrough, 0, color.NRGBA{31, 71, 47, 255}, limage.CompositePassThrough, color.NRGBA{31, 71, 47, 255}, `isolation="auto"`},
+		{limage.CompositePassThrough, 127, color.NRGBA{115, 85, 48, 255}, limage.CompositeNormal, bottom, `isolation="isolate"`},
+	} {
+		im := limage.Image{
+			limage.Layer{
+				Name:         "Group",
+				LayerBounds:  image.Rect(0, 0, 15, 15),
+				Mode:         test.Mode,
+				Transparency: test.Transparency,
+				Image: limage.Image{
+					limage.Layer{
+						Name:        "Multiply",
+						LayerBounds: image.Rect(5, 5, 15, 15),
+						Mode:        limage.CompositeMultiply,
+						Image: singleColourImage{
+							Colour: color.NRGBA{R: 40, G: 180, B: 240, A: 255},
+							Width:  10,
+							Height: 10,
+						},
+					},
+				},
+			},
+			limage.Layer{
+				Name:        "Bottom",
+				LayerBounds: image.Rect(0, 0, 20, 20),
+				Image: singleColourImage{
+					Colour: bottom,
+					Width:  20,
+					Height: 20,
+				},
+			},
+		}
+
+		checkColours := func(im limage.Image, inside color.NRGBA) {
+			flat := im.Flatten()
+
+			for _, p := range [...]struct {
+				image.Point
+				Expected color.NRGBA
+			}{
+				{image.Pt(10, 10), inside},
+				{image.Pt(2, 2), bottom},
+			} {
+				got := color.NRGBAModel.Convert(im.At(p.X, p.Y)).(color.NRGBA)
+
+				if !similarColours(got, p.Expected) {
+					t.Errorf("test %d: at %v: expecting colour %v, got %v", n+1, p.Point, p.Expected, got)
+				}
+
+				if rendered := color.NRGBAModel.Convert(flat.At(p.X, p.Y)); rendered != got {
+					t.Errorf("test %d: at %v: expecting rendered colour %v, got %v", n+1, p.Point, got, rendered)
+				}
+			}
+		}
+
+		checkColours(im, test.Inside)
+
+		var buf []byte
+
+		if err := Encode(memio.Create(&buf), im); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		f, err := zip.NewReader(memio.Open(buf), int64(len(buf)))
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		if stack, err := readZipFile(f, "stack.xml"); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if _, group, _ := bytes.Cut(stack, []byte(`name="Group"`)); !bytes.Contains(group[:bytes.IndexByte(group, '>')+1], []byte(test.Isolation)) {
+			t.Errorf("test %d: expecting group with %s, got %s", n+1, test.Isolation, stack)
+		}
+
+		if im, err = Decode(f); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		if im[0].Mode != test.Decoded {
+			t.Errorf("test %d: expecting mode %s, got %s", n+1, test.Decoded, im[0].Mode)
+		} else if im[0].Transparency != test.Transparency {
+			t.Errorf("test %d: expecting transparency %d, got %d", n+1, test.Transparency, im[0].Transparency)
+		}
+
+		checkColours(im, test.DecodedInside)
+	}
+}
+
+func readZipFile(z *zip.Reader, name string) ([]byte, error) {
+	f, err := z.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return io.ReadAll(f)
+}
+
+func TestEncodeOpacity(t *testing.T) {
+	for n, transparency := range [...]uint8{0, 1, 64, 127, 128, 200, 254, 255} {
+		im := limage.Image{
+			limage.Layer{
+				Name:         "Layer",
+				LayerBounds:  image.Rect(0, 0, 10, 10),
+				Transparency: transparency,
+				Image: singleColourImage{
+					Colour: color.NRGBA{R: 40, G: 180, B: 240, A: 255},
+					Width:  10,
+					Height: 10,
+				},
+			},
+		}
+
+		var buf []byte
+
+		if err := Encode(memio.Create(&buf), im); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		f, err := zip.NewReader(memio.Open(buf), int64(len(buf)))
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		d, err := Decode(f)
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if d[0].Transparency != transparency {
+			t.Errorf("test %d: expecting transparency %d, got %d", n+1, transparency, d[0].Transparency)
+		} else if d[0].Invisible {
+			t.Errorf("test %d: expecting visible layer", n+1)
+		}
+	}
+}
+
+func TestDecodeIsolation(t *testing.T) {
+	for n, test := range [...]struct {
+		Attrs string
+		Mode  limage.Composite
+	}{
+		{``, limage.CompositePassThrough},
+		{` isolation="auto"`, limage.CompositePassThrough},
+		{` isolation="isolate"`, limage.CompositeNormal},
+		{` opacity="0.5"`, limage.CompositeNormal},
+		{` composite-op="svg:multiply"`, limage.CompositeMultiply},
+	} {
+		var buf []byte
+
+		zw := zip.NewWriter(memio.Create(&buf))
+
+		for _, file := range [...]struct {
+			Name, Data string
+		}{
+			{"mimetype", mimetypeStr},
+			{"stack.xml", `<image w="10" h="10"><stack><stack name="Group"` + test.Attrs + `><layer name="Layer" src="data/layer.png" /></stack></stack></image>`},
+		} {
+			fw, err := zw.Create(file.Name)
+			if err != nil {
+				t.Fatalf("test %d: unexpected error: %s", n+1, err)
+			}
+
+			fw.Write([]byte(file.Data))
+		}
+
+		fw, err := zw.Create("data/layer.png")
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		} else if err = encodePNG(fw, image.NewNRGBA(image.Rect(0, 0, 10, 10)), nil); err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		} else if err = zw.Close(); err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+
+		f, err := zip.NewReader(memio.Open(buf), int64(len(buf)))
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+
+		if im, err := Decode(f); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if im[0].Mode != test.Mode {
+			t.Errorf("test %d: expecting mode %s, got %s", n+1, test.Mode, im[0].Mode)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package ora
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"strings"
+
+	"vimagination.zapto.org/limage/lcolor"
+)
+
+const (
+	pngHeader      = "\x89PNG\r\n\x1a\n"
+	ihdrLength     = 4 + 4 + 13 + 4 // length, type, data, crc
+	iccProfileName = "ICC profile"
+	mergedImage    = "mergedimage.png"
+)
+
+// maxProfileSize is the largest ICC profile, compressed or not, that will be
+// read from a PNG file.
+const maxProfileSize = 1 << 24
+
+// DecodeICCProfile reads the ICC colour profile embedded in the merged image of
+// the ORA file or, when it has none, the first layer image that has one,
+// returning nil when there is none.
+//
+// It accepts a *zip.Reader and it is the callers responsibility to handle it.
+func DecodeICCProfile(zr *zip.Reader) (*lcolor.ICCProfile, error) {
+	data, err := readProfile(zr, mergedImage)
+	if err != nil || data != nil {
+		return parseProfile(data, err)
+	}
+
+	for _, f := range zr.File {
+		if f.Name == mergedImage || !strings.HasSuffix(strings.ToLower(f.Name), ".png") || strings.HasPrefix(f.Name, "Thumbnails/") {
+			continue
+		}
+
+		if data, err = readProfile(zr, f.Name); err != nil || data != nil {
+			break
+		}
+	}
+
+	return parseProfile(data, err)
+}
+
+func parseProfile(data []byte, err error) (*lcolor.ICCProfile, error) {
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	return lcolor.ParseICCProfile(data)
+}
+
+// readProfile returns the decompressed ICC profile of the named PNG file in the
+// ORA file, or nil when it has none.
+func readProfile(zr *zip.Reader, name string) ([]byte, error) {
+	for _, f := range zr.File {
+		if f.Name != name {
+			continue
+		}
+
+		fr, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+
+		defer fr.Close()
+
+		return readICCP(fr)
+	}
+
+	return nil, nil
+}
+
+// readICCP reads the chunks of a PNG file, returning the decompressed contents
+// of the iCCP chunk, if one appears before the image data.
+func readICCP(r io.Reader) ([]byte, error) {
+	var header [len(pngHeader)]byte
+
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	} else if string(header[:]) != pngHeader {
+		return nil, ErrInvalidPNG
+	}
+
+	for {
+		var chunk [8]byte
+
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			return nil, err
+		}
+
+		length := binary.BigEndian.Uint32(chunk[:4])
+
+		switch string(chunk[4:]) {
+		case "IDAT", "IEND":
+			return nil, nil
+		case "iCCP":
+			if length > maxProfileSize {
+				return nil, ErrProfileTooLarge
+			}
+
+			data := make([]byte, length)
+
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, err
+			}
+
+			name := bytes.IndexByte(data, 0)
+			if name < 0 || name+2 > len(data) || data[name+1] != 0 {
+				return nil, ErrInvalidPNG
+			}
+
+			zr, err := zlib.NewReader(bytes.NewReader(data[name+2:]))
+			if err != nil {
+				return nil, err
+			}
+
+			profile, err := io.ReadAll(io.LimitReader(zr, maxProfileSize+1))
+			if err != nil {
+				return nil, err
+			} else if len(profile) > maxProfileSize {
+				return nil, ErrProfileTooLarge
+			}
+
+			return profile, nil
+		}
+
+		if _, err := io.CopyN(io.Discard, r, int64(length)+4); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// encodePNG encodes the image as a PNG, embedding the ICC profile when one is
+// given.
+func encodePNG(w io.Writer, m image.Image, profile *lcolor.ICCProfile) error {
+	if profile == nil || len(profile.Data) == 0 {
+		return png.Encode(w, m)
+	}
+
+	var buf bytes.Buffer
+
+	if err := png.Encode(&buf, m); err != nil {
+		return err
+	}
+
+	data := buf.Bytes()
+
+	if _, err := w.Write(data[:len(pngHeader)+ihdrLength]); err != nil {
+		return err
+	} else if err := writeICCP(w, profile.Data); err != nil {
+		return err
+	}
+
+	_, err := w.Write(data[len(pngHeader)+ihdrLength:])
+
+	return err
+}
+
+func writeICCP(w io.Writer, profile []byte) error {
+	var chunk bytes.Buffer
+
+	chunk.Write([]byte{0, 0, 0, 0})
+	chunk.WriteString("iCCP")
+	chunk.WriteString(iccProfileName)
+	chunk.Write([]byte{0, 0}) // name terminator, compression method
+
+	zw := zlib.NewWriter(&chunk)
+
+	if _, err := zw.Write(profile); err != nil {
+		return err
+	} else if err := zw.Close(); err != nil {
+		return err
+	}
+
+	data := chunk.Bytes()
+
+	binary.BigEndian.PutUint32(data, uint32(len(data)-8))
+
+	var crc [4]byte
+
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(data[4:]))
+
+	_, err := w.Write(append(data, crc[:]...))
+
+	return err
+}
+
+// Errors.
+var (
+	ErrInvalidPNG      = errors.New("invalid PNG")
+	ErrProfileTooLarge = errors.New("ICC profile too large")
+)
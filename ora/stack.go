@@ -4,6 +4,7 @@ import (
 	"encoding/xml"
 	"errors"
 	"image"
+	"math"
 	"strconv"
 
 	"vimagination.zapto.org/limage"
@@ -99,7 +100,10 @@ func (d decoder) readLayer(s xml.StartElement, offset image.Point) (limage.Layer
 }
 
 func processLayerAttrs(l *limage.Layer, s xml.StartElement) (string, error) {
-	var source string
+	var (
+		source      string
+		passThrough = true
+	)
 
 	for _, a := range s.Attr {
 		switch a.Name.Local {
@@ -125,7 +129,13 @@ func processLayerAttrs(l *limage.Layer, s xml.StartElement) (string, error) {
 				return "", err
 			}
 
-			l.Transparency = uint8(255 * (1 - o))
+			if !(o >= 0) {
+				o = 0
+			} else if o > 1 {
+				o = 1
+			}
+
+			l.Transparency = uint8(math.Round(255 * (1 - o)))
 		case "visibility":
 			l.Invisible = a.Value == "hidden"
 		case "composite-op":
@@ -173,9 +183,17 @@ func processLayerAttrs(l *limage.Layer, s xml.StartElement) (string, error) {
 			}
 		case "src":
 			source = a.Value
+		case "isolation":
+			passThrough = a.Value != "isolate"
 		}
 	}
 
+	// An auto isolated stack, which is the default, is only isolated when it
+	// has an opacity or composite-op that requires it.
+	if passThrough && s.Name.Local == "stack" && l.Mode == limage.CompositeNormal && l.Transparency == 0 {
+		l.Mode = limage.CompositePassThrough
+	}
+
 	return source, nil
 }
 
@@ -0,0 +1,449 @@
+package limage
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"runtime"
+	"sync"
+
+	"vimagination.zapto.org/limage/internal"
+)
+
+// Flatten composites the layers of the image into a new image with the bounds
+// of the image.
+func (g Image) Flatten() *image.NRGBA64 {
+	dst := image.NewNRGBA64(g.Bounds())
+
+	g.Render(dst)
+
+	return dst
+}
+
+// Render composites the layers of the image into dst, replacing each of its
+// pixels with the colour given by At for the same coords.
+//
+// Whole rows of each layer are composited at a time, with fast paths for
+// drawing into an *image.NRGBA64 or *image.NRGBA, and for reading layers that
+// are an *image.NRGBA, *image.NRGBA64, *RGB, *GrayAlpha or *PalettedAlpha, or
+// a group, mask or text layer containing them.
+//
+// The result is identical to setting each pixel to the colour from At, except
+// for layers using CompositeDissolve, which is random.
+func (g Image) Render(dst draw.Image) {
+	var r renderer
+
+	b := dst.Bounds()
+
+	r.render(g, dst, b, make([]color.NRGBA64, b.Dx()))
+}
+
+const renderTileSize = 64
+
+// RenderContext composites the layers of the image into dst, as Render, but
+// splits dst into tiles that are composited by a pool of the given number of
+// workers, or of one worker per CPU when workers is not positive.
+//
+// When the context is cancelled, the remaining tiles are not composited, and
+// the error of the context is returned.
+//
+// As tiles are composited concurrently, the images of the layers must be safe
+// for concurrent reading, and the Set method of dst, when it is not an
+// *image.NRGBA64 or *image.NRGBA, safe for concurrent use on different pixels.
+func (g Image) RenderContext(ctx context.Context, dst draw.Image, workers int) error {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	var (
+		wg    sync.WaitGroup
+		tiles = make(chan image.Rectangle)
+		b     = dst.Bounds()
+	)
+
+	wg.Add(workers)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+
+			var r renderer
+
+			row := make([]color.NRGBA64, renderTileSize)
+
+			for t := range tiles {
+				r.render(g, dst, t, row)
+			}
+		}()
+	}
+
+	err := sendTiles(ctx, tiles, b)
+
+	close(tiles)
+	wg.Wait()
+
+	return err
+}
+
+// sendTiles sends the tiles covering the bounds to the channel, stopping when
+// the context is cancelled.
+func sendTiles(ctx context.Context, tiles chan<- image.Rectangle, b image.Rectangle) error {
+	for y := b.Min.Y; y < b.Max.Y; y += renderTileSize {
+		for x := b.Min.X; x < b.Max.X; x += renderTileSize {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case tiles <- image.Rect(x, y, x+renderTileSize, y+renderTileSize).Intersect(b):
+			}
+		}
+	}
+
+	return nil
+}
+
+// renderer composites the layers of an image a row at a time, keeping the
+// buffers used to read the rows of layers for reuse.
+type renderer struct {
+	buffers  [][]color.NRGBA64
+	palettes map[*PalettedAlpha][]color.NRGBA
+}
+
+// render composites the rectangle of the image into dst, using row, which must
+// be at least as long as the width of the rectangle, as a buffer.
+func (r *renderer) render(g Image, dst draw.Image, rect image.Rectangle, row []color.NRGBA64) {
+	row = row[:rect.Dx()]
+
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		clearRow(row)
+		r.compositeRow(g, row, rect.Min.X, y)
+		writeRow(dst, row, rect.Min.X, y)
+	}
+}
+
+func (r *renderer) buffer(n int) []color.NRGBA64 {
+	if l := len(r.buffers); l > 0 {
+		buf := r.buffers[l-1]
+		r.buffers = r.buffers[:l-1]
+
+		if cap(buf) >= n {
+			return buf[:n]
+		}
+	}
+
+	return make([]color.NRGBA64, n)
+}
+
+func (r *renderer) release(buf []color.NRGBA64) {
+	r.buffers = append(r.buffers, buf)
+}
+
+// compositeRow composites the layers of the group onto row, which holds the
+// colours of the pixels starting at x on line y, in the same way as At.
+func (r *renderer) compositeRow(g Image, row []color.NRGBA64, x, y int) {
+	_, paletted := g.ColorModel().(color.Palette)
+
+	for i := len(g) - 1; i >= 0; i-- {
+		l := g[i]
+		lb := l.LayerBounds
+
+		if l.Invisible {
+			continue
+		}
+
+		minX, maxX := x, x+len(row)
+
+		if minX < lb.Min.X {
+			minX = lb.Min.X
+		}
+
+		if maxX > lb.Max.X {
+			maxX = lb.Max.X
+		}
+
+		if y < lb.Min.Y || y >= lb.Max.Y || minX >= maxX {
+			minX, maxX = x, x
+		}
+
+		if !paletted && l.Mode.clipsBackdrop() {
+			clearRow(row[:minX-x])
+			clearRow(row[maxX-x:])
+		}
+
+		if minX == maxX {
+			continue
+		}
+
+		dst := row[minX-x : maxX-x]
+
+		if group, mask, ok := l.passThrough(); ok {
+			r.compositePassThrough(group, mask, dst, minX-lb.Min.X, y-lb.Min.Y, 255-l.Transparency)
+
+			continue
+		}
+
+		src := r.buffer(len(dst))
+
+		r.readRow(l.Image, src, minX-lb.Min.X, y-lb.Min.Y)
+		transparencyRow(src, 255-l.Transparency)
+
+		if paletted && l.Mode != CompositeDissolve {
+			for n, c := range src {
+				if c.A > 0x7fff {
+					c.A = 0xffff
+					dst[n] = c
+				}
+			}
+		} else {
+			for n, c := range src {
+				dst[n] = l.composite(dst[n], c)
+			}
+		}
+
+		r.release(src)
+	}
+}
+
+// compositePassThrough composites the layers of the pass-through group directly
+// onto row, fading the result with the opacity and mask of the group.
+func (r *renderer) compositePassThrough(g Image, mask GrayImage, row []color.NRGBA64, x, y int, ao uint8) {
+	if ao == 0xff && mask == nil {
+		r.compositeRow(g, row, x, y)
+
+		return
+	}
+
+	backdrop := r.buffer(len(row))
+
+	copy(backdrop, row)
+	r.compositeRow(g, row, x, y)
+
+	for n, c := range row {
+		o := ao
+
+		if mask != nil {
+			o = maskOpacity(ao, mask.GrayAt(x+n, y).Y)
+		}
+
+		row[n] = fade(backdrop[n], c, o)
+	}
+
+	r.release(backdrop)
+}
+
+// readRow reads the colours of the pixels of the image starting at x on line
+// y into dst.
+func (r *renderer) readRow(im image.Image, dst []color.NRGBA64, x, y int) {
+	switch im := im.(type) {
+	case Image:
+		r.readGroupRow(im, dst, x, y)
+	case *Image:
+		r.readGroupRow(*im, dst, x, y)
+	case MaskedImage:
+		r.readRow(im.Image, dst, x, y)
+
+		if !im.Disabled {
+			for n, c := range dst {
+				dst[n] = transparency64(c, im.Mask.GrayAt(x+n, y).Y)
+			}
+		}
+	case Text:
+		r.readRow(im.Image, dst, x, y)
+	case *image.NRGBA:
+		lo, hi := readOutside(im, im.Rect, dst, x, y)
+
+		for n, p := lo, im.PixOffset(x+lo, y); n < hi; n, p = n+1, p+4 {
+			dst[n] = expand(color.NRGBA{R: im.Pix[p], G: im.Pix[p+1], B: im.Pix[p+2], A: im.Pix[p+3]})
+		}
+	case *image.NRGBA64:
+		lo, hi := readOutside(im, im.Rect, dst, x, y)
+
+		for n := lo; n < hi; n++ {
+			dst[n] = im.NRGBA64At(x+n, y)
+		}
+	case *RGB:
+		lo, hi := readOutside(im, im.Rect, dst, x, y)
+
+		for n, p := lo, im.PixOffset(x+lo, y); n < hi; n, p = n+1, p+1 {
+			dst[n] = im.Pix[p].ToNRGBA()
+		}
+	case *GrayAlpha:
+		lo, hi := readOutside(im, im.Rect, dst, x, y)
+
+		for n, p := lo, im.PixOffset(x+lo, y); n < hi; n, p = n+1, p+1 {
+			dst[n] = im.Pix[p].ToNRGBA()
+		}
+	case *PalettedAlpha:
+		if im.Palette == nil {
+			readPixels(im, dst, x, y)
+
+			break
+		}
+
+		palette := r.palette(im)
+		lo, hi := readOutside(im, im.Rect, dst, x, y)
+
+		for n, p := lo, im.PixOffset(x+lo, y); n < hi; n, p = n+1, p+1 {
+			ia := im.Pix[p]
+			c := palette[ia.I]
+			c.A = ia.A
+			dst[n] = expand(c)
+		}
+	default:
+		readPixels(im, dst, x, y)
+	}
+}
+
+func (r *renderer) readGroupRow(g Image, dst []color.NRGBA64, x, y int) {
+	clearRow(dst)
+	r.compositeRow(g, dst, x, y)
+}
+
+func clearRow(row []color.NRGBA64) {
+	for n := range row {
+		row[n] = color.NRGBA64{}
+	}
+}
+
+// palette returns the colours of the palette of the image, as returned by its
+// At method.
+func (r *renderer) palette(p *PalettedAlpha) []color.NRGBA {
+	if palette, ok := r.palettes[p]; ok {
+		return palette
+	}
+
+	palette := make([]color.NRGBA, len(p.Palette))
+
+	for n, c := range p.Palette {
+		cr, cg, cb, _ := c.RGBA()
+		palette[n] = color.NRGBA{R: uint8(cr >> 8), G: uint8(cg >> 8), B: uint8(cb >> 8)}
+	}
+
+	if r.palettes == nil {
+		r.palettes = make(map[*PalettedAlpha][]color.NRGBA)
+	}
+
+	r.palettes[p] = palette
+
+	return palette
+}
+
+// readOutside reads the pixels in dst, which start at x on line y, that are
+// outside of rect with At, returning the range of dst that is within rect.
+func readOutside(im image.Image, rect image.Rectangle, dst []color.NRGBA64, x, y int) (int, int) {
+	var lo, hi int
+
+	if y >= rect.Min.Y && y < rect.Max.Y {
+		lo = clampIndex(rect.Min.X-x, 0, len(dst))
+		hi = clampIndex(rect.Max.X-x, lo, len(dst))
+	}
+
+	readPixels(im, dst[:lo], x, y)
+	readPixels(im, dst[hi:], x+hi, y)
+
+	return lo, hi
+}
+
+func readPixels(im image.Image, dst []color.NRGBA64, x, y int) {
+	for n := range dst {
+		dst[n] = internal.ColourToNRGBA(im.At(x+n, y))
+	}
+}
+
+func clampIndex(n, min, max int) int {
+	if n < min {
+		return min
+	} else if n > max {
+		return max
+	}
+
+	return n
+}
+
+func expand(c color.NRGBA) color.NRGBA64 {
+	return color.NRGBA64{
+		R: uint16(c.R) * 0x101,
+		G: uint16(c.G) * 0x101,
+		B: uint16(c.B) * 0x101,
+		A: uint16(c.A) * 0x101,
+	}
+}
+
+// transparencyRow applies the opacity to each of the colours, as transparency.
+func transparencyRow(row []color.NRGBA64, ao uint8) {
+	if ao == 0xff {
+		return
+	}
+
+	for n, c := range row {
+		row[n] = transparency64(c, ao)
+	}
+}
+
+func transparency64(c color.NRGBA64, ao uint8) color.NRGBA64 {
+	if ao == 0xff {
+		return c
+	} else if ao == 0 {
+		return color.NRGBA64{}
+	}
+
+	o := uint32(ao)
+	o |= o << 8
+	c.A = uint16(o * uint32(c.A) / 0xffff)
+
+	return c
+}
+
+// writeRow writes the colours of row to the pixels of dst starting at x on line
+// y, converting them as the Set method of dst would.
+func writeRow(dst draw.Image, row []color.NRGBA64, x, y int) {
+	switch dst := dst.(type) {
+	case *image.NRGBA64:
+		for n, p := 0, dst.PixOffset(x, y); n < len(row); n, p = n+1, p+8 {
+			c := row[n]
+			s := dst.Pix[p : p+8 : p+8]
+			s[0] = uint8(c.R >> 8)
+			s[1] = uint8(c.R)
+			s[2] = uint8(c.G >> 8)
+			s[3] = uint8(c.G)
+			s[4] = uint8(c.B >> 8)
+			s[5] = uint8(c.B)
+			s[6] = uint8(c.A >> 8)
+			s[7] = uint8(c.A)
+		}
+	case *image.NRGBA:
+		for n, p := 0, dst.PixOffset(x, y); n < len(row); n, p = n+1, p+4 {
+			c := toNRGBA(row[n])
+			s := dst.Pix[p : p+4 : p+4]
+			s[0] = c.R
+			s[1] = c.G
+			s[2] = c.B
+			s[3] = c.A
+		}
+	default:
+		for n, c := range row {
+			dst.Set(x+n, y, c)
+		}
+	}
+}
+
+// toNRGBA converts the colour in the same way as color.NRGBAModel.
+func toNRGBA(c color.NRGBA64) color.NRGBA {
+	r, g, b, a := c.RGBA()
+
+	if a == 0xffff {
+		return color.NRGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 0xff}
+	} else if a == 0 {
+		return color.NRGBA{}
+	}
+
+	r = (r * 0xffff) / a
+	g = (g * 0xffff) / a
+	b = (b * 0xffff) / a
+
+	return color.NRGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)}
+}
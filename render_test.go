@@ -0,0 +1,251 @@
+package limage
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"vimagination.zapto.org/limage/lcolor"
+)
+
+type singleColourImage struct {
+	Colour        color.Color
+	Width, Height int
+}
+
+func (s singleColourImage) ColorModel() color.Model {
+	return s
+}
+
+func (s singleColourImage) Convert(color.Color) color.Color {
+	return s.Colour
+}
+
+func (s singleColourImage) Bounds() image.Rectangle {
+	return image.Rect(0, 0, s.Width, s.Height)
+}
+
+func (s singleColourImage) At(int, int) color.Color {
+	return s.Colour
+}
+
+func imageRandom(r image.Rectangle) *image.NRGBA {
+	i := image.NewNRGBA(r)
+
+	for n := range i.Pix {
+		i.Pix[n] = uint8(rand.Intn(256))
+	}
+
+	return i
+}
+
+func TestRender(t *testing.T) {
+	rgb := NewRGB(image.Rect(0, 0, 40, 30))
+	grayAlpha := NewGrayAlpha(image.Rect(0, 0, 30, 40))
+	palettedAlpha := NewPalettedAlpha(image.Rect(0, 0, 50, 20), lcolor.AlphaPalette{
+		color.NRGBA{R: 255, A: 255},
+		color.NRGBA{G: 255, A: 128},
+		color.NRGBA{B: 255, A: 255},
+	})
+	mask := image.NewGray(image.Rect(0, 0, 25, 25))
+	nrgba64 := image.NewNRGBA64(image.Rect(0, 0, 20, 20))
+
+	for n := range rgb.Pix {
+		rgb.Pix[n] = lcolor.RGB{R: uint8(rand.Intn(256)), G: uint8(rand.Intn(256)), B: uint8(rand.Intn(256))}
+	}
+
+	for n := range grayAlpha.Pix {
+		grayAlpha.Pix[n] = lcolor.GrayAlpha{Y: uint8(rand.Intn(256)), A: uint8(rand.Intn(256))}
+	}
+
+	for n := range palettedAlpha.Pix {
+		palettedAlpha.Pix[n] = lcolor.IndexedAlpha{I: uint8(rand.Intn(3)), A: uint8(rand.Intn(256))}
+	}
+
+	for n := range mask.Pix {
+		mask.Pix[n] = uint8(rand.Intn(256))
+	}
+
+	for n := range nrgba64.Pix {
+		nrgba64.Pix[n] = uint8(rand.Intn(256))
+	}
+
+	im := Image{
+		Layer{
+			Name:         "NRGBA",
+			LayerBounds:  image.Rect(5, 3, 35, 33),
+			Mode:         CompositeMultiply,
+			Transparency: 100,
+			Image:        imageRandom(image.Rect(0, 0, 30, 30)),
+		},
+		Layer{
+			Name:          "RGB",
+			LayerBounds:   image.Rect(-10, 10, 30, 40),
+			Mode:          CompositeHue,
+			CompositeMode: CompositeModeClipToLayer,
+			BlendSpace:    ColorSpaceLinear,
+			Image:         rgb,
+		},
+		Layer{
+			Name:        "Group",
+			LayerBounds: image.Rect(10, 0, 60, 40),
+			Mode:        CompositeScreen,
+			Image: Image{
+				Layer{
+					Name:        "Masked",
+					LayerBounds: image.Rect(0, 0, 25, 25),
+					Image: MaskedImage{
+						Image: imageRandom(image.Rect(0, 0, 25, 25)),
+						Mask:  mask,
+					},
+				},
+				Layer{
+					Name:        "Text",
+					LayerBounds: image.Rect(5, 5, 35, 45),
+					Image: Text{
+						Image: grayAlpha,
+					},
+				},
+			},
+		},
+		Layer{
+			Name:         "Masked Pass Through",
+			LayerBounds:  image.Rect(0, 10, 25, 35),
+			Mode:         CompositePassThrough,
+			Transparency: 30,
+			Image: MaskedImage{
+				Image: Image{
+					Layer{
+						Name:        "Inner",
+						LayerBounds: image.Rect(0, 0, 25, 25),
+						Mode:        CompositeMultiply,
+						Image:       imageRandom(image.Rect(0, 0, 25, 25)),
+					},
+				},
+				Mask: mask,
+			},
+		},
+		Layer{
+			Name:        "Invisible",
+			LayerBounds: image.Rect(0, 0, 50, 50),
+			Invisible:   true,
+			Image:       imageRandom(image.Rect(0, 0, 50, 50)),
+		},
+		Layer{
+			Name:        "NRGBA64",
+			LayerBounds: image.Rect(15, 15, 35, 35),
+			Mode:        CompositeLinearLight,
+			Image:       nrgba64,
+		},
+		Layer{
+			Name:        "Generic",
+			LayerBounds: image.Rect(20, 5, 40, 15),
+			Mode:        CompositeDifference,
+			Image: singleColourImage{
+				Colour: color.Gray{Y: 100},
+				Width:  20,
+				Height: 10,
+			},
+		},
+		Layer{
+			Name:        "PalettedAlpha",
+			LayerBounds: image.Rect(0, 20, 50, 40),
+			Mode:        CompositeOverlay,
+			Image:       palettedAlpha,
+		},
+		Layer{
+			Name:        "Background",
+			LayerBounds: image.Rect(0, 0, 50, 50),
+			Image:       imageRandom(image.Rect(0, 0, 50, 50)),
+		},
+	}
+
+	offset := append(Image{
+		Layer{
+			Name:        "Offset", // image bounds differ from the layer bounds
+			LayerBounds: image.Rect(0, 0, 40, 40),
+			Mode:        CompositeDifference,
+			Image:       rgb.SubImage(image.Rect(10, 5, 30, 25)),
+		},
+	}, im...)
+
+	for n, test := range [...]Image{im, offset} {
+		r := test.Bounds().Inset(-5)
+		nrgba64 := image.NewNRGBA64(r)
+		nrgba := image.NewNRGBA(r)
+
+		test.Render(nrgba64)
+		test.Render(nrgba)
+
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				c := test.At(x, y)
+
+				if expected, got := color.NRGBA64Model.Convert(c), nrgba64.At(x, y); expected != got {
+					t.Errorf("test %d: at (%d, %d): expecting NRGBA64 colour %v, got %v", n+1, x, y, expected, got)
+				}
+
+				if expected, got := color.NRGBAModel.Convert(c), nrgba.At(x, y); expected != got {
+					t.Errorf("test %d: at (%d, %d): expecting NRGBA colour %v, got %v", n+1, x, y, expected, got)
+				}
+			}
+		}
+
+		if flat := test.Flatten(); flat.Rect != test.Bounds() {
+			t.Errorf("test %d: expecting flattened bounds %v, got %v", n+1, test.Bounds(), flat.Rect)
+		}
+	}
+}
+
+func TestRenderContext(t *testing.T) {
+	im := Image{
+		Layer{
+			Name:         "Large",
+			LayerBounds:  image.Rect(-20, -30, 180, 170),
+			Mode:         CompositeGrainMerge,
+			Transparency: 50,
+			Image:        imageRandom(image.Rect(0, 0, 200, 200)),
+		},
+		Layer{
+			Name:        "Group",
+			LayerBounds: image.Rect(10, 10, 110, 110),
+			Mode:        CompositeMultiply,
+			Image: Image{
+				Layer{
+					Name:        "Inner",
+					LayerBounds: image.Rect(0, 0, 100, 100),
+					Image:       imageRandom(image.Rect(0, 0, 100, 100)),
+				},
+			},
+		},
+		Layer{
+			Name:        "Background",
+			LayerBounds: image.Rect(0, 0, 150, 150),
+			Image:       imageRandom(image.Rect(0, 0, 150, 150)),
+		},
+	}
+
+	expected := im.Flatten()
+
+	for n, workers := range [...]int{0, 1, 3, 16} {
+		got := image.NewNRGBA64(im.Bounds())
+
+		if err := im.RenderContext(context.Background(), got, workers); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if !reflect.DeepEqual(expected, got) {
+			t.Errorf("test %d: output does not match Render", n+1)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cancel()
+
+	if err := im.RenderContext(ctx, image.NewNRGBA64(im.Bounds()), 2); !errors.Is(err, context.Canceled) {
+		t.Errorf("expecting error %v, got %v", context.Canceled, err)
+	}
+}
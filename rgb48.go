@@ -0,0 +1,101 @@
+package limage
+
+import (
+	"image"
+	"image/color"
+
+	"vimagination.zapto.org/limage/lcolor"
+)
+
+// RGB48 is an image of RGB48 colours.
+type RGB48 struct {
+	Pix    []lcolor.RGB48
+	Stride int
+	Rect   image.Rectangle
+}
+
+// NewRGB48 create a new RGB48 image with the given bounds.
+func NewRGB48(r image.Rectangle) *RGB48 {
+	w, h := r.Dx(), r.Dy()
+
+	return &RGB48{
+		Pix:    make([]lcolor.RGB48, w*h),
+		Stride: w,
+		Rect:   r,
+	}
+}
+
+// At returns the colour at the given coords.
+func (r *RGB48) At(x, y int) color.Color {
+	return r.RGB48At(x, y)
+}
+
+// Bounds returns the limits of the image.
+func (r *RGB48) Bounds() image.Rectangle {
+	return r.Rect
+}
+
+// ColorModel returns a colour model that converts arbitrary colours to the
+// RGB48 space.
+func (r *RGB48) ColorModel() color.Model {
+	return lcolor.RGB48Model
+}
+
+// RGB48At returns the exact RGB48 colour at the given coords.
+func (r *RGB48) RGB48At(x, y int) lcolor.RGB48 {
+	if !(image.Point{x, y}.In(r.Rect)) {
+		return lcolor.RGB48{}
+	}
+
+	return r.Pix[r.PixOffset(x, y)]
+}
+
+// Opaque just returns true as the alpha channel is fixed.
+func (r *RGB48) Opaque() bool {
+	return true
+}
+
+// PixOffset returns the index of the Pix array corresponding to the given
+// coords.
+func (r *RGB48) PixOffset(x, y int) int {
+	return (y-r.Rect.Min.Y)*r.Stride + x - r.Rect.Min.X
+}
+
+// Set converts the given colour to the RGB48 space and sets it at the given
+// coords.
+func (r *RGB48) Set(x, y int, c color.Color) {
+	if !(image.Point{x, y}.In(r.Rect)) {
+		return
+	}
+
+	rr, g, b, _ := c.RGBA()
+	r.Pix[r.PixOffset(x, y)] = lcolor.RGB48{
+		R: uint16(rr),
+		G: uint16(g),
+		B: uint16(b),
+	}
+}
+
+// SetRGB48 directly set an RGB48 colour to the given coords.
+func (r *RGB48) SetRGB48(x, y int, rgb lcolor.RGB48) {
+	if !(image.Point{x, y}.In(r.Rect)) {
+		return
+	}
+
+	r.Pix[r.PixOffset(x, y)] = rgb
+}
+
+// SubImage returns the Image viewable through the given bounds.
+func (r *RGB48) SubImage(rt image.Rectangle) image.Image {
+	rt = rt.Intersect(r.Rect)
+
+	if rt.Empty() {
+		return &RGB48{}
+	}
+
+	return &RGB48{
+		Pix:    r.Pix[r.PixOffset(rt.Min.X, rt.Min.Y):],
+		Stride: r.Stride,
+		Rect:   rt,
+	}
+}
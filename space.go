@@ -0,0 +1,292 @@
+package limage
+
+import (
+	"image/color"
+
+	"vimagination.zapto.org/limage/internal"
+)
+
+// CompositeMode determines which parts of a layer and its backdrop remain after
+// they are composited.
+type CompositeMode uint8
+
+// CompositeMode constants.
+const (
+	// CompositeModeAuto uses the default for the layer mode, which is
+	// CompositeModeUnion for CompositeNormal and CompositeModeClipToBackdrop
+	// otherwise.
+	CompositeModeAuto CompositeMode = iota
+	CompositeModeUnion
+	CompositeModeClipToBackdrop
+	CompositeModeClipToLayer
+	CompositeModeIntersection
+)
+
+// ColorSpace determines the colour space in which layers are blended or
+// composited.
+type ColorSpace uint8
+
+// ColorSpace constants.
+const (
+	// ColorSpaceAuto uses the default colour space for the layer mode, which
+	// is ColorSpacePerceptual for the legacy layer modes and for
+	// CompositeWith, and as returned by Layer.CompositeSettings otherwise.
+	ColorSpaceAuto ColorSpace = iota
+	ColorSpaceLinear
+	ColorSpacePerceptual
+)
+
+// CompositeWith performs the composition of two layers, calculating the blend
+// mode in the blend colour space and combining the result with the bottom
+// colour in the composite colour space according to the composite mode.
+//
+// The automatic settings are resolved as documented on CompositeModeAuto and
+// ColorSpaceAuto, so that they give the same result as the settings they
+// resolve to. The compositions that are not calculated by blending ignore the
+// settings.
+func (c Composite) CompositeWith(b, t color.Color, mode CompositeMode, blendSpace, compositeSpace ColorSpace) color.Color {
+	return c.compositeWith(internal.ColourToNRGBA(b), internal.ColourToNRGBA(t), mode, blendSpace, compositeSpace)
+}
+
+func (c Composite) compositeWith(bottom, top color.NRGBA64, mode CompositeMode, blendSpace, compositeSpace ColorSpace) color.NRGBA64 {
+	blended, ok := c.blend(toSpace(bottom, blendSpace), toSpace(top, blendSpace), blendSpace == ColorSpaceLinear)
+	if !ok {
+		return c.composite(bottom, top)
+	}
+
+	blended = fromSpace(blended, blendSpace)
+
+	if mode == CompositeModeAuto {
+		mode = c.autoCompositeMode()
+	}
+
+	return fromSpace(compositeColours(toSpace(bottom, compositeSpace), toSpace(top, compositeSpace), toSpace(blended, compositeSpace), mode), compositeSpace)
+}
+
+// CompositeSettings returns the composite mode and colour spaces with which the
+// layer is composited, resolving the automatic settings.
+//
+// As in GIMP 2.10, the legacy layer modes use ColorSpacePerceptual, while the
+// others are composited in ColorSpaceLinear, and blended in it for all but the
+// Screen, Overlay, Difference, Hue, Saturation, Color, Value, Dodge, Burn, Hard
+// Light, Soft Light, Grain Extract, Grain Merge, Vivid Light, Pin Light, Linear
+// Light, Hard Mix, Exclusion and Linear Burn modes, which are blended in
+// ColorSpacePerceptual.
+func (l Layer) CompositeSettings() (CompositeMode, ColorSpace, ColorSpace) {
+	mode, blendSpace, compositeSpace := l.CompositeMode, l.BlendSpace, l.CompositeSpace
+
+	if mode == CompositeModeAuto {
+		mode = l.Mode.autoCompositeMode()
+	}
+
+	autoBlend, autoComposite := l.Mode.autoSpaces(l.NonLegacy)
+
+	if blendSpace == ColorSpaceAuto {
+		blendSpace = autoBlend
+	}
+
+	if compositeSpace == ColorSpaceAuto {
+		compositeSpace = autoComposite
+	}
+
+	return mode, blendSpace, compositeSpace
+}
+
+func (c Composite) autoCompositeMode() CompositeMode {
+	if c == CompositeNormal {
+		return CompositeModeUnion
+	}
+
+	return CompositeModeClipToBackdrop
+}
+
+// autoSpaces returns the blend and composite colour spaces that the automatic
+// settings resolve to for the layer mode.
+func (c Composite) autoSpaces(nonLegacy bool) (ColorSpace, ColorSpace) {
+	if !nonLegacy && c.hasLegacy() {
+		return ColorSpacePerceptual, ColorSpacePerceptual
+	}
+
+	switch c {
+	case CompositeDissolve, CompositeLuminosity:
+		return ColorSpacePerceptual, ColorSpacePerceptual
+	case CompositeScreen, CompositeOverlay, CompositeDifference, CompositeHue,
+		CompositeSaturation, CompositeColor, CompositeValue, CompositeDodge,
+		CompositeBurn, CompositeHardLight, CompositeSoftLight,
+		CompositeGrainExtract, CompositeGrainMerge, CompositeVividLight,
+		CompositePinLight, CompositeLinearLight, CompositeHardMix,
+		CompositeExclusion, CompositeLinearBurn:
+		return ColorSpacePerceptual, ColorSpaceLinear
+	}
+
+	return ColorSpaceLinear, ColorSpaceLinear
+}
+
+// hasLegacy returns true for the layer modes that GIMP has in both a legacy and
+// a non-legacy version.
+func (c Composite) hasLegacy() bool {
+	switch c {
+	case CompositeNormal, CompositeBehind, CompositeMultiply, CompositeScreen,
+		CompositeOverlay, CompositeDifference, CompositeAddition,
+		CompositeSubtract, CompositeDarkenOnly, CompositeLightenOnly,
+		CompositeHue, CompositeSaturation, CompositeColor, CompositeValue,
+		CompositeDivide, CompositeDodge, CompositeBurn, CompositeHardLight,
+		CompositeSoftLight, CompositeGrainExtract, CompositeGrainMerge,
+		CompositeColorErase:
+		return true
+	}
+
+	return false
+}
+
+// blend returns the result of the blend mode applied to the opaque colours,
+// which are in linear light when linear is set.
+//
+// It returns false for modes that are not calculated by blending.
+func (c Composite) blend(bottom, top color.NRGBA64, linear bool) (color.NRGBA64, bool) {
+	bottom.A = 0xffff
+	top.A = 0xffff
+
+	var f func(uint16, uint16) uint16
+
+	switch c {
+	case CompositeNormal:
+		return top, true
+	case CompositeMultiply:
+		f = compositeMultiply
+	case CompositeScreen:
+		f = compositeScreen
+	case CompositeOverlay:
+		f = compositeOverlay
+	case CompositeDifference:
+		f = compositeDifference
+	case CompositeAddition:
+		f = compositeAddition
+	case CompositeSubtract:
+		f = compositeSubtract
+	case CompositeDarkenOnly:
+		f = compositeDarkenOnly
+	case CompositeLightenOnly:
+		f = compositeLightenOnly
+	case CompositeDivide:
+		f = compositeDivide
+	case CompositeDodge:
+		f = compositeDodge
+	case CompositeBurn:
+		f = compositeBurn
+	case CompositeHardLight:
+		f = compositeHardLight
+	case CompositeSoftLight:
+		f = compositeSoftLight
+	case CompositeGrainExtract:
+		f = compositeGrainExtract
+	case CompositeGrainMerge:
+		f = compositeGrainMerge
+	case CompositeVividLight:
+		f = compositeVividLight
+	case CompositePinLight:
+		f = compositePinLight
+	case CompositeLinearLight:
+		f = compositeLinearLight
+	case CompositeHardMix:
+		f = compositeHardMix
+	case CompositeExclusion:
+		f = compositeExclusion
+	case CompositeLinearBurn:
+		f = compositeLinearBurn
+	case CompositeChroma:
+		return compositeChroma(bottom, top, linear), true
+	case CompositeLightness:
+		return compositeLightness(bottom, top, linear), true
+	case CompositeLuminance:
+		return compositeLuminance(bottom, top, linear), true
+	case CompositeHue:
+		return compositeHue(bottom, top), true
+	case CompositeSaturation:
+		return compositeSaturation(bottom, top), true
+	case CompositeColor:
+		return compositeColor(bottom, top), true
+	case CompositeValue:
+		return compositeValue(bottom, top), true
+	case CompositeLuminosity:
+		return compositeColor(top, bottom), true
+	default:
+		return color.NRGBA64{}, false
+	}
+
+	return color.NRGBA64{
+		R: f(bottom.R, top.R),
+		G: f(bottom.G, top.G),
+		B: f(bottom.B, top.B),
+		A: 0xffff,
+	}, true
+}
+
+// compositeColours combines the bottom, top and blended colours according to
+// the composite mode.
+func compositeColours(bottom, top, blended color.NRGBA64, mode CompositeMode) color.NRGBA64 {
+	ab := float64(bottom.A) / 0xffff
+	at := float64(top.A) / 0xffff
+
+	var a, wb, wt, wx float64 // alpha, and the weights of the bottom, top and blended colours
+
+	switch mode {
+	case CompositeModeClipToBackdrop:
+		a = ab
+		wb = ab * (1 - at)
+		wx = ab * at
+	case CompositeModeClipToLayer:
+		a = at
+		wt = at * (1 - ab)
+		wx = ab * at
+	case CompositeModeIntersection:
+		a = ab * at
+		wx = ab * at
+	default: // Union
+		a = at + ab*(1-at)
+		wb = ab * (1 - at)
+		wt = at * (1 - ab)
+		wx = ab * at
+	}
+
+	if a == 0 {
+		return color.NRGBA64{}
+	}
+
+	mix := func(b, t, x uint16) uint16 {
+		return internal.FloatToUint16((wb*float64(b) + wt*float64(t) + wx*float64(x)) / a / 0xffff)
+	}
+
+	return color.NRGBA64{
+		R: mix(bottom.R, top.R, blended.R),
+		G: mix(bottom.G, top.G, blended.G),
+		B: mix(bottom.B, top.B, blended.B),
+		A: internal.FloatToUint16(a),
+	}
+}
+
+func toSpace(c color.NRGBA64, space ColorSpace) color.NRGBA64 {
+	if space != ColorSpaceLinear {
+		return c
+	}
+
+	return color.NRGBA64{
+		R: internal.SRGBToLinear16(c.R),
+		G: internal.SRGBToLinear16(c.G),
+		B: internal.SRGBToLinear16(c.B),
+		A: c.A,
+	}
+}
+
+func fromSpace(c color.NRGBA64, space ColorSpace) color.NRGBA64 {
+	if space != ColorSpaceLinear {
+		return c
+	}
+
+	return color.NRGBA64{
+		R: internal.LinearToSRGB16(c.R),
+		G: internal.LinearToSRGB16(c.G),
+		B: internal.LinearToSRGB16(c.B),
+		A: c.A,
+	}
+}
@@ -1,17 +1,51 @@
 package xcf
 
-import "image"
+import (
+	"errors"
+	"image"
+	"math"
+
+	"vimagination.zapto.org/limage/lcolor"
+)
+
+// Channel represents a saved channel of an XCF image.
+//
+// The Colour and Transparency fields describe how GIMP displays the channel
+// over the image.
+type Channel struct {
+	Name         string
+	Colour       lcolor.RGB
+	Transparency uint8
+	Invisible    bool
+
+	// Image holds the values of the channel, as an *image.Gray, or, when the
+	// image has a high bit-depth precision, as an *image.Gray16.
+	image.Image
+}
+
+type channel struct {
+	Channel
+	selection, active bool
+}
+
+// ReadChannel reads a channel, keeping high bit-depth values when deep is set
+// and the channel is not the selection mask.
+func (d *decoder) ReadChannel(deep bool) channel {
+	var c channel
 
-func (d *decoder) ReadChannel() *image.Gray {
 	width := d.ReadUint32()
 	height := d.ReadUint32()
 
-	d.SkipString() // name
-	d.skipProperties()
+	if !d.CheckDimensions(width, height) || !d.AllocatePixels(width, height) {
+		return c
+	}
+
+	c.Name = d.ReadString()
+	c.readProperties(d)
 
 	var hptr uint64
 
-	if d.mode < 2 {
+	if d.version < 11 {
 		hptr = uint64(d.ReadUint32())
 	} else {
 		hptr = d.ReadUint64()
@@ -19,17 +53,38 @@ func (d *decoder) ReadChannel() *image.Gray {
 
 	d.Goto(hptr)
 
-	if im := d.ReadImage(width, height, 2); im != nil {
-		return im.(*image.Gray) // gray
+	bpp, tiles := d.readHierarchy(width, height, 2)
+	if tiles == nil {
+		return c
 	}
 
-	return nil
+	r := image.Rect(0, 0, int(width), int(height))
+	cf := newComponentFormat(d.precision, d.version)
+
+	if !deep && !c.selection && d.tiles == tilesLazy {
+		c.Image = &CompressedChannel{d.newLazyTiles(bpp, width, height, tiles), r, cf}
+	} else if !deep && !c.selection && d.tiles == tilesCompressed && d.compression != CompressionNone {
+		ci, _ := d.readCompressedTiles(bpp, width, height, tiles)
+		c.Image = &CompressedChannel{ci, r, cf}
+	} else if deep && d.precision.deep() && !c.selection {
+		g := image.NewGray16(r)
+		c.Image = g
+
+		d.readAndDecompressImage(channel16ImageReader{g, cf}, bpp, width, height, tiles)
+	} else {
+		g := image.NewGray(r)
+		c.Image = g
+
+		d.readAndDecompressImage(channelImageReader{g, cf}, bpp, width, height, tiles)
+	}
+
+	return c
 }
 
-func (d *decoder) skipProperties() {
+func (c *channel) readProperties(d *decoder) {
 	for {
-		typ := d.ReadUint32()
-		plength := d.ReadUint32()
+		typ, plength := d.ReadProperty()
+		end := d.Pos() + int64(plength)
 
 		switch typ {
 		// general properties
@@ -40,26 +95,191 @@ func (d *decoder) skipProperties() {
 
 			return
 		case propOpacity:
-			if d.ReadUint32() > 255 {
+			o := d.ReadUint32()
+			if o > 255 {
+				d.SetError(ErrInvalidOpacity)
+			} else {
+				c.Transparency = 255 - uint8(o)
+			}
+		case propFloatOpacity:
+			o := d.ReadFloat32()
+			if !(o >= 0 && o <= 1) {
 				d.SetError(ErrInvalidOpacity)
+			} else {
+				c.Transparency = 255 - uint8(math.Round(float64(o)*255))
+			}
+		case propVisible:
+			c.Invisible = !d.ReadBoolProperty()
+
+		// channel properties
+		case propActiveChannel:
+			c.active = true
+		case propSelection:
+			c.selection = true
+		case propColor:
+			c.Colour = lcolor.RGB{
+				R: d.ReadUint8(),
+				G: d.ReadUint8(),
+				B: d.ReadUint8(),
+			}
+		case propFloatColour:
+			c.Colour = lcolor.RGB{
+				R: floatToUint8(d.ReadFloat32()),
+				G: floatToUint8(d.ReadFloat32()),
+				B: floatToUint8(d.ReadFloat32()),
 			}
 		default:
 			d.Skip(plength)
 		}
 
+		d.RecoverProperty(end)
 	}
 }
 
-func (e *encoder) WriteChannel(c *image.Gray) {
+func floatToUint8(f float32) uint8 {
+	if !(f > 0) {
+		return 0
+	} else if f >= 1 {
+		return 255
+	}
+
+	return uint8(math.Round(float64(f) * 255))
+}
+
+// readChannels reads the channels and the selection mask, which must match the
+// bounds of the image, also returning the indexes of the selected channels and
+// the pointers of the channels.
+func readChannels(dr *reader, chanptrs []uint64, d decoder, bounds image.Rectangle) ([]Channel, *image.Gray, []int, []uint64) {
+	var (
+		channels  []Channel
+		selection *image.Gray
+		selected  []int
+		ptrs      []uint64
+	)
+
+	for _, cptr := range chanptrs {
+		d.Goto(cptr)
+
+		c := d.ReadChannel(true)
+		if d.Err == nil && (c.Image == nil || c.Bounds().Dx() != bounds.Dx() || c.Bounds().Dy() != bounds.Dy()) {
+			d.Goto(cptr)
+			d.SetError(ErrInconsistantData)
+		}
+
+		if d.Recover() { // the channel is left out
+			continue
+		} else if d.Err != nil {
+			break
+		} else if c.selection {
+			selection = c.Image.(*image.Gray)
+		} else {
+			if c.active {
+				selected = append(selected, len(channels))
+			}
+
+			channels = append(channels, c.Channel)
+			ptrs = append(ptrs, cptr)
+		}
+	}
+
+	dr.problems = append(dr.problems, d.problems...)
+	dr.SetError(d.DecodeErr())
+
+	return channels, selection, selected, ptrs
+}
+
+func (e *encoder) WriteChannel(c Channel) {
+	e.writeChannel(c, false, false)
+}
+
+// WriteSelection writes the selection mask, which is stored as a channel
+// marked with the selection property.
+func (e *encoder) WriteSelection(selection *image.Gray) {
+	e.writeChannel(Channel{
+		Name:  selectionName,
+		Image: selection,
+	}, true, false)
+}
+
+func (e *encoder) writeChannel(c Channel, selection, active bool) {
 	b := c.Bounds()
 
 	e.WriteUint32(uint32(b.Dx()))
 	e.WriteUint32(uint32(b.Dy()))
-	e.WriteString("")
+	e.WriteString(c.Name)
+
+	if selection {
+		e.WriteUint32(propSelection)
+		e.WriteUint32(0)
+	}
+
+	e.WriteUint32(propOpacity)
+	e.WriteUint32(4)
+	e.WriteUint32(255 - uint32(c.Transparency))
+
+	if e.version >= 10 {
+		e.WriteUint32(propFloatOpacity)
+		e.WriteUint32(4)
+		e.WriteFloat32(float32(255-c.Transparency) / 255)
+	}
+
+	if active {
+		e.WriteUint32(propActiveChannel)
+		e.WriteUint32(0)
+	}
+
+	e.WriteUint32(propVisible)
+	e.WriteUint32(4)
+
+	if c.Invisible {
+		e.WriteUint32(0)
+	} else {
+		e.WriteUint32(1)
+	}
 
-	e.WriteUint32(0) // No properties
+	e.WriteUint32(propColor)
+	e.WriteUint32(3)
+	e.WriteUint8(c.Colour.R)
+	e.WriteUint8(c.Colour.G)
+	e.WriteUint8(c.Colour.B)
+
+	e.WriteUint32(0) // end of properties
 	e.WriteUint32(0)
 
-	e.WriteUint32(uint32(e.pos) + 4) // hptr
-	e.WriteImage(c, (*encoder).grayToBuf, 1)
+	e.WritePointer(e.pos + e.pointerSize()) // hptr
+	e.WriteImage(c.Image, (*encoder).grayToBuf, uint8(e.precision.bytes()))
+}
+
+func (e *encoder) WriteChannels(channels []Channel, selection *image.Gray, selected []int, pw *pointerWriter) {
+	for n, c := range channels {
+		pw.WritePointer(e.pos)
+
+		if e.floating != nil && e.floating.Layer == nil && e.floating.Channel == n {
+			e.floatingTarget.WritePointer(e.pos)
+		}
+
+		e.writeChannel(c, false, containsIndex(selected, n))
+	}
+
+	if selection != nil {
+		pw.WritePointer(e.pos)
+		e.WriteSelection(selection)
+	}
+}
+
+func containsIndex(indexes []int, n int) bool {
+	for _, i := range indexes {
+		if i == n {
+			return true
+		}
+	}
+
+	return false
 }
+
+const selectionName = "Selection Mask"
+
+// Errors.
+var (
+	ErrInvalidChannel = errors.New("channel dimensions do not match image")
+)
@@ -1,10 +1,8 @@
 package xcf
 
 import (
-	"errors"
 	"image"
 	"image/color"
-	"io"
 
 	"vimagination.zapto.org/byteio"
 	"vimagination.zapto.org/limage/lcolor"
@@ -12,26 +10,46 @@ import (
 )
 
 type compressedImage struct {
-	tiles        [][][]byte
-	width        int
-	tile         int
-	decompressed [64 * 64 * 4]byte
+	tiles                [][]byte
+	lazy                 *lazyTiles // set instead of tiles when reading from the file
+	width, height        int
+	bpp                  int
+	compression          Compression
+	tile                 int
+	decompressed, planes []byte
 }
 
 func (c *compressedImage) decompressTile(x, y int) int {
 	if tile := (y/64)*((c.width+63)/64) + (x / 64); tile != c.tile {
-		var (
-			n    int
-			data memio.Buffer
-		)
+		w := c.width - x&^63
+		if w > 64 {
+			w = 64
+		}
+
+		h := c.height - y&^63
+		if h > 64 {
+			h = 64
+		}
 
-		r := rle{Reader: &byteio.StickyBigEndianReader{Reader: &data}}
+		n := w * h * c.bpp
 
-		for n, data = range c.tiles[tile] {
-			r.Read(c.decompressed[64*64*n : 64*64*(n+1)])
+		if c.planes == nil {
+			c.planes = make([]byte, 64*64*c.bpp)
+		}
 
-			if errors.Is(r.Reader.Err, io.EOF) {
-				r.Reader.Err = nil
+		if c.lazy != nil {
+			c.decompressed = c.lazy.Tile(tile, c.compression, c.planes[:n], c.bpp)
+		} else {
+			if c.decompressed == nil {
+				c.decompressed = make([]byte, 64*64*c.bpp)
+			}
+
+			data := memio.Buffer(c.tiles[tile])
+
+			if readTile(&byteio.StickyBigEndianReader{Reader: &data}, c.compression, c.decompressed[:n], c.planes[:n], c.bpp) != nil {
+				for i := range c.decompressed[:n] {
+					c.decompressed[i] = 0
+				}
 			}
 		}
 
@@ -39,10 +57,10 @@ func (c *compressedImage) decompressTile(x, y int) int {
 	}
 
 	if x < c.width & ^63 {
-		return 64*(y%64) + (x % 64)
+		return (64*(y%64) + (x % 64)) * c.bpp
 	}
 
-	return (c.width&63)*(y%64) + (x % 64)
+	return ((c.width&63)*(y%64) + (x % 64)) * c.bpp
 }
 
 // CompressedRGB is an image.Image for which the data remains in a compressed
@@ -71,8 +89,8 @@ func (c *CompressedRGB) RGBAt(x, y int) lcolor.RGB {
 
 	return lcolor.RGB{
 		R: c.decompressed[p],
-		G: c.decompressed[p+64*64],
-		B: c.decompressed[p+64*64*2],
+		G: c.decompressed[p+1],
+		B: c.decompressed[p+2],
 	}
 }
 
@@ -102,9 +120,9 @@ func (c *CompressedNRGBA) NRGBAAt(x, y int) color.NRGBA {
 
 	return color.NRGBA{
 		c.decompressed[p],
-		c.decompressed[p+64*64],
-		c.decompressed[p+64*64*2],
-		c.decompressed[p+64*64*3],
+		c.decompressed[p+1],
+		c.decompressed[p+2],
+		c.decompressed[p+3],
 	}
 }
 
@@ -137,6 +155,37 @@ func (c *CompressedGray) GrayAt(x, y int) color.Gray {
 	}
 }
 
+// CompressedChannel is an image.Image, holding the values of a layer mask, for
+// which the data remains in a compressed form until read.
+//
+// Unlike CompressedGray, the values are used as stored, whatever the precision
+// of the image.
+type CompressedChannel struct {
+	compressedImage
+	Rect image.Rectangle
+	componentFormat
+}
+
+// ColorModel returns the Gray Color Model.
+func (CompressedChannel) ColorModel() color.Model { return color.GrayModel }
+
+// Bounds returns a Rect containing the boundary data for the image.
+func (c *CompressedChannel) Bounds() image.Rectangle { return c.Rect }
+
+// At returns colour at the specified coords.
+func (c *CompressedChannel) At(x, y int) color.Color { return c.GrayAt(x, y) }
+
+// GrayAt returns Gray colour at the specified coords.
+func (c *CompressedChannel) GrayAt(x, y int) color.Gray {
+	if !(image.Point{x, y}).In(c.Rect) {
+		return color.Gray{}
+	}
+
+	return color.Gray{
+		uint8(c.read(c.decompressed[c.decompressTile(x, y):], false) >> 8),
+	}
+}
+
 // CompressedGrayAlpha is an image.Image for which the data remains in a
 // compressed form until read.
 type CompressedGrayAlpha struct {
@@ -163,7 +212,7 @@ func (c *CompressedGrayAlpha) GrayAlphaAt(x, y int) lcolor.GrayAlpha {
 
 	return lcolor.GrayAlpha{
 		Y: c.decompressed[p],
-		A: c.decompressed[p+64*64],
+		A: c.decompressed[p+1],
 	}
 }
 
@@ -234,6 +283,112 @@ func (c *CompressedPalettedAlpha) At(x, y int) color.Color {
 		R: uint8(r >> 8),
 		G: uint8(g >> 8),
 		B: uint8(b >> 8),
-		A: c.decompressed[64*64+p],
+		A: c.decompressed[p+1],
+	}
+}
+
+// CompressedRGB48 is an image.Image for which the data remains in a
+// compressed form until read.
+type CompressedRGB48 struct {
+	compressedImage
+	Rect image.Rectangle
+	componentFormat
+}
+
+// ColorModel returns the RGB48 Color Model.
+func (CompressedRGB48) ColorModel() color.Model { return lcolor.RGB48Model }
+
+// Bounds returns a Rect containing the boundary data for the image.
+func (c *CompressedRGB48) Bounds() image.Rectangle { return c.Rect }
+
+// At returns colour at the specified coords.
+func (c *CompressedRGB48) At(x, y int) color.Color { return c.RGB48At(x, y) }
+
+// RGB48At returns RGB48 colour at the specified coords.
+func (c *CompressedRGB48) RGB48At(x, y int) lcolor.RGB48 {
+	if !(image.Point{x, y}).In(c.Rect) {
+		return lcolor.RGB48{}
 	}
+
+	return c.rgb48(c.decompressed[c.decompressTile(x, y):])
+}
+
+// CompressedNRGBA64 is an image.Image for which the data remains in a
+// compressed form until read.
+type CompressedNRGBA64 struct {
+	compressedImage
+	Rect image.Rectangle
+	componentFormat
+}
+
+// ColorModel returns the NRGBA64 Color Model.
+func (CompressedNRGBA64) ColorModel() color.Model { return color.NRGBA64Model }
+
+// Bounds returns a Rect containing the boundary data for the image.
+func (c *CompressedNRGBA64) Bounds() image.Rectangle { return c.Rect }
+
+// At returns colour at the specified coords.
+func (c *CompressedNRGBA64) At(x, y int) color.Color { return c.NRGBA64At(x, y) }
+
+// NRGBA64At returns NRGBA64 colour at the specified coords.
+func (c *CompressedNRGBA64) NRGBA64At(x, y int) color.NRGBA64 {
+	if !(image.Point{x, y}).In(c.Rect) {
+		return color.NRGBA64{}
+	}
+
+	return c.nrgba64(c.decompressed[c.decompressTile(x, y):])
+}
+
+// CompressedGray16 is an image.Image for which the data remains in a
+// compressed form until read.
+type CompressedGray16 struct {
+	compressedImage
+	Rect image.Rectangle
+	componentFormat
+}
+
+// ColorModel returns the Gray16 Color Model.
+func (CompressedGray16) ColorModel() color.Model { return color.Gray16Model }
+
+// Bounds returns a Rect containing the boundary data for the image.
+func (c *CompressedGray16) Bounds() image.Rectangle { return c.Rect }
+
+// At returns colour at the specified coords.
+func (c *CompressedGray16) At(x, y int) color.Color { return c.Gray16At(x, y) }
+
+// Gray16At returns Gray16 colour at the specified coords.
+func (c *CompressedGray16) Gray16At(x, y int) color.Gray16 {
+	if !(image.Point{x, y}).In(c.Rect) {
+		return color.Gray16{}
+	}
+
+	return color.Gray16{
+		c.read(c.decompressed[c.decompressTile(x, y):], true),
+	}
+}
+
+// CompressedGrayAlpha32 is an image.Image for which the data remains in a
+// compressed form until read.
+type CompressedGrayAlpha32 struct {
+	compressedImage
+	Rect image.Rectangle
+	componentFormat
+}
+
+// ColorModel returns the Gray Alpha 32 Color Model.
+func (CompressedGrayAlpha32) ColorModel() color.Model { return lcolor.GrayAlpha32Model }
+
+// Bounds returns a Rect containing the boundary data for the image.
+func (c *CompressedGrayAlpha32) Bounds() image.Rectangle { return c.Rect }
+
+// At returns colour at the specified coords.
+func (c *CompressedGrayAlpha32) At(x, y int) color.Color { return c.GrayAlpha32At(x, y) }
+
+// GrayAlpha32At returns Gray+Alpha colour at the specified coords.
+func (c *CompressedGrayAlpha32) GrayAlpha32At(x, y int) lcolor.GrayAlpha32 {
+	if !(image.Point{x, y}).In(c.Rect) {
+		return lcolor.GrayAlpha32{}
+	}
+
+	return c.grayAlpha32(c.decompressed[c.decompressTile(x, y):])
 }
@@ -6,6 +6,7 @@ import (
 	"image/color"
 	"image/draw"
 	"image/png"
+	"io"
 	"math/rand"
 	"os"
 	"reflect"
@@ -91,3 +92,150 @@ func TestCompressedImages(t *testing.T) {
 		}
 	}
 }
+
+func TestCompression(t *testing.T) {
+	test := limage.Image{
+		limage.Layer{
+			Name:        "Layer 1",
+			LayerBounds: image.Rect(0, 0, 100, 100),
+			Image:       imageRandom(image.Rect(0, 0, 100, 100)),
+		},
+	}
+
+	g := image.NewNRGBA(test.Bounds())
+	draw.Draw(g, g.Rect, test, image.Point{}, draw.Over)
+
+	for n, compression := range [...]Compression{CompressionNone, CompressionRLE, CompressionZlib} {
+		var buf []byte
+
+		if err := Encode(memio.Create(&buf), test, WithCompression(compression)); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		for m, decode := range [...]func(io.ReaderAt, ...DecoderOption) (limage.Image, error){Decode, DecodeCompressed, DecodeLazy} {
+			tl, err := decode(memio.Open(buf))
+			if err != nil {
+				t.Errorf("test %d.%d: unexpected error: %s", n+1, m+1, err)
+
+				continue
+			}
+
+			gt := image.NewNRGBA(tl.Bounds())
+			draw.Draw(gt, g.Rect, tl, image.Point{}, draw.Over)
+
+			if !reflect.DeepEqual(g, gt) {
+				t.Errorf("test %d.%d: output does not match test", n+1, m+1)
+			}
+		}
+	}
+}
+
+func TestDecodeLazy(t *testing.T) {
+	test := limage.Image{
+		limage.Layer{
+			Name:        "Layer 1",
+			LayerBounds: image.Rect(0, 0, 200, 150),
+			Image:       imageRandom(image.Rect(0, 0, 200, 150)),
+		},
+		limage.Layer{
+			Name:        "Layer 2",
+			LayerBounds: image.Rect(30, 20, 130, 120),
+			Image:       imageRandom(image.Rect(0, 0, 100, 100)),
+		},
+	}
+
+	var buf []byte
+
+	if err := Encode(memio.Create(&buf), test); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	g := image.NewNRGBA(test.Bounds())
+	draw.Draw(g, g.Rect, test, image.Point{}, draw.Over)
+
+	for n, size := range [...]int{0, 1, 4, defaultTileCacheSize} {
+		tl, err := DecodeLazy(memio.Open(buf), WithTileCacheSize(size))
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		gt := image.NewNRGBA(tl.Bounds())
+		draw.Draw(gt, g.Rect, tl, image.Point{}, draw.Over)
+
+		if !reflect.DeepEqual(g, gt) {
+			t.Errorf("test %d: output does not match test", n+1)
+		}
+
+		ci, ok := tl[0].Image.(*CompressedNRGBA)
+		if !ok {
+			t.Errorf("test %d: expecting lazy image, got %T", n+1, tl[0].Image)
+
+			continue
+		}
+
+		if ci.lazy == nil {
+			t.Errorf("test %d: expecting tiles to be read lazily", n+1)
+		} else if l := ci.lazy.cache.Len(); l > size || l > 16 { // 12 tiles in the first layer and 4 in the second
+			t.Errorf("test %d: expecting no more than %d cached tiles, got %d", n+1, size, l)
+		}
+	}
+}
+
+func TestDecodeLazyMask(t *testing.T) {
+	mask := image.NewGray(image.Rect(0, 0, 100, 70))
+
+	for n := range mask.Pix {
+		mask.Pix[n] = uint8(n * 7)
+	}
+
+	test := limage.Image{
+		limage.Layer{
+			Name:        "Masked",
+			LayerBounds: mask.Rect,
+			Image: limage.MaskedImage{
+				Image: imageRandom(mask.Rect),
+				Mask:  mask,
+			},
+		},
+	}
+
+	for n, precision := range [...]Precision{PrecisionU8NonLinear, PrecisionU16Linear, PrecisionFloatNonLinear} {
+		var buf []byte
+
+		if err := Encode(memio.Create(&buf), test, WithPrecision(precision)); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		for m, decode := range [...]func(io.ReaderAt, ...DecoderOption) (limage.Image, error){Decode, DecodeCompressed, DecodeLazy} {
+			l, err := decode(memio.Open(buf))
+			if err != nil {
+				t.Errorf("test %d.%d: unexpected error: %s", n+1, m+1, err)
+
+				continue
+			}
+
+			mi, ok := l[0].Image.(limage.MaskedImage)
+			if !ok {
+				t.Errorf("test %d.%d: expecting masked image, got %T", n+1, m+1, l[0].Image)
+
+				continue
+			}
+
+			if cc, ok := mi.Mask.(*CompressedChannel); (m > 0) != ok {
+				t.Errorf("test %d.%d: unexpected mask type %T", n+1, m+1, mi.Mask)
+			} else if ok && (m == 2) != (cc.lazy != nil) {
+				t.Errorf("test %d.%d: expecting lazy mask to be %v", n+1, m+1, m == 2)
+			}
+
+			if err := compareImages(mi.Mask, mask); err != nil {
+				t.Errorf("test %d.%d: %s", n+1, m+1, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package xcf
+
+import (
+	"bufio"
+	"compress/zlib"
+	"io"
+
+	"vimagination.zapto.org/memio"
+)
+
+// Compression represents the method used to compress the tile data of an
+// XCF file.
+type Compression uint8
+
+// Compression constants.
+const (
+	CompressionNone Compression = iota
+	CompressionRLE
+	CompressionZlib
+)
+
+// zlibRecorder reads a single zlib stream, keeping a copy of the compressed
+// bytes consumed.
+type zlibRecorder struct {
+	*bufio.Reader
+	buf *memio.Buffer
+}
+
+func (z *zlibRecorder) Read(p []byte) (int, error) {
+	n, err := z.Reader.Read(p)
+
+	z.buf.Write(p[:n])
+
+	return n, err
+}
+
+func (z *zlibRecorder) ReadByte() (byte, error) {
+	c, err := z.Reader.ReadByte()
+	if err == nil {
+		z.buf.Write([]byte{c})
+	}
+
+	return c, err
+}
+
+func (d *decoder) readZlib(buf *memio.Buffer) error {
+	zr, err := zlib.NewReader(&zlibRecorder{
+		Reader: bufio.NewReader(d.rs),
+		buf:    buf,
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(io.Discard, zr); err != nil {
+		return err
+	}
+
+	return zr.Close()
+}
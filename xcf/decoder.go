@@ -38,21 +38,16 @@ func init() {
 }
 
 const (
-	fileTypeID    = "gimp xcf "
-	fileVersion0  = "file"
-	fileVersion1  = "v001"
-	fileVersion2  = "v002"
-	fileVersion3  = "v003"
-	fileVersion4  = "v004"
-	fileVersion5  = "v005"
-	fileVersion6  = "v006"
-	fileVersion7  = "v007"
-	fileVersion8  = "v008"
-	fileVersion9  = "v009"
-	fileVersion10 = "v010"
-	fileVersion11 = "v011"
-	fileVersion12 = "v012"
-	fileVersion13 = "v013"
+	fileTypeID   = "gimp xcf "
+	fileVersion0 = "file"
+
+	maxDecodeVersion = 22
+
+	// pathItemsVersion is the first version in which paths are stored as
+	// items, listed after the channels, rather than in an image property.
+	pathItemsVersion = 18
+
+	maxColorMapSize = 256
 )
 
 const (
@@ -63,21 +58,35 @@ const (
 
 type decoder struct {
 	reader
-	compression uint8
-	decompress  bool
+	compression Compression
+	tiles       tileMode
 	baseType    uint32
 	palette     lcolor.AlphaPalette
-	precision   uint32
-	mode        uint32
+	precision   Precision
+	version     uint32
+	selector    LayerSelector
+
+	tileCacheSize int
+	tileCache     *tileCache
 }
 
+// tileMode determines when the tiles of pixel data of the layers are read and
+// decompressed.
+type tileMode uint8
+
+const (
+	tilesDecompressed tileMode = iota // read and decompressed while decoding
+	tilesCompressed                   // read while decoding, decompressed on demand
+	tilesLazy                         // read and decompressed on demand
+)
+
 // DecodeConfig retrieves the color model and dimensions of the XCF image.
 func DecodeConfig(r io.ReaderAt) (image.Config, error) {
 	var c image.Config
 
 	dr := newReader(r)
 
-	mode, err := readHeader(dr)
+	version, err := readHeader(dr)
 	if err != nil {
 		return image.Config{}, err
 	}
@@ -85,18 +94,29 @@ func DecodeConfig(r io.ReaderAt) (image.Config, error) {
 	c.Width = int(dr.ReadUint32())
 	c.Height = int(dr.ReadUint32())
 	baseType := dr.ReadUint32()
+	precision := PrecisionU8NonLinear
 
-	if mode == 2 {
-		dr.ReadUint32()
+	if version >= 4 {
+		if precision, err = readPrecision(version, dr.ReadUint32()); err != nil {
+			return image.Config{}, dr.WrapError(err)
+		}
 	}
 
 	switch baseType {
 	case 0:
-		c.ColorModel = color.NRGBAModel
+		if precision.deep() {
+			c.ColorModel = color.NRGBA64Model
+		} else {
+			c.ColorModel = color.NRGBAModel
+		}
 	case 1:
-		c.ColorModel = lcolor.GrayAlphaModel
+		if precision.deep() {
+			c.ColorModel = lcolor.GrayAlpha32Model
+		} else {
+			c.ColorModel = lcolor.GrayAlphaModel
+		}
 	case 2:
-		palette, _, err := readImageProperties(dr, 2)
+		palette, _, err := readImageProperties(&dr, 2, new(Image))
 		if err != nil {
 			return c, err
 		}
@@ -104,18 +124,78 @@ func DecodeConfig(r io.ReaderAt) (image.Config, error) {
 		c.ColorModel = palette
 	}
 
-	return c, dr.Err
+	return c, dr.DecodeErr()
+}
+
+// DecoderOption is a function that modifies how an image is decoded.
+type DecoderOption func(*decoder)
+
+// WithRecovery makes the decoder continue past the parts of a damaged file
+// that cannot be read, returning the partial image along with the problems
+// encountered: a *DecodeError when there was one, or a DecodeErrors listing
+// each of them.
+//
+// Unreadable properties are skipped, unreadable tiles are left transparent,
+// and layers, masks and channels that cannot be read at all are left out. A
+// layer without an alpha channel that has unreadable tiles is returned as a
+// decompressed image of the equivalent type with one, such as an *image.NRGBA
+// in place of a *limage.RGB.
+func WithRecovery() DecoderOption {
+	return func(d *decoder) {
+		d.recovering = true
+	}
 }
 
 // Decode reads an XCF layered image from the given ReaderAt.
-func Decode(r io.ReaderAt) (limage.Image, error) {
-	return decodeImage(r, true)
+func Decode(r io.ReaderAt, opts ...DecoderOption) (limage.Image, error) {
+	im, err := decodeImage(r, tilesDecompressed, opts)
+	if im == nil {
+		return nil, err
+	}
+
+	return im.Image, err
 }
 
 // DecodeCompressed reads an XCF layered image, as Decode, but defers decoding
 // and decompressing, doing so upon an At method.
-func DecodeCompressed(r io.ReaderAt) (limage.Image, error) {
-	return decodeImage(r, false)
+func DecodeCompressed(r io.ReaderAt, opts ...DecoderOption) (limage.Image, error) {
+	im, err := decodeImage(r, tilesCompressed, opts)
+	if im == nil {
+		return nil, err
+	}
+
+	return im.Image, err
+}
+
+// DecodeLazy reads an XCF layered image, as Decode, but leaves the pixel data
+// of the layers in the file, reading and decompressing tiles as they are
+// needed by an At method.
+//
+// The decompressed tiles are kept in a cache shared by all of the layers,
+// the size of which can be set with WithTileCacheSize, so that the memory
+// used does not depend on the size of the image. Layer masks are read in the
+// same way.
+//
+// As the type of each image is set before its tiles are read, a tile that
+// cannot be read is returned with all of its values set to zero, which is
+// transparent only for layers with an alpha channel, and black for the others.
+//
+// The ReaderAt must remain readable for as long as the image is used, and,
+// as with DecodeCompressed, the layers are not safe for concurrent use.
+func DecodeLazy(r io.ReaderAt, opts ...DecoderOption) (limage.Image, error) {
+	im, err := decodeImage(r, tilesLazy, opts)
+	if im == nil {
+		return nil, err
+	}
+
+	return im.Image, err
+}
+
+// DecodeImage reads an XCF image from the given ReaderAt, as Decode, also
+// returning the image-level data, such as channels, paths and the selection
+// mask.
+func DecodeImage(r io.ReaderAt, opts ...DecoderOption) (*Image, error) {
+	return decodeImage(r, tilesDecompressed, opts)
 }
 
 type groupOffset struct {
@@ -123,12 +203,29 @@ type groupOffset struct {
 	OffsetX, OffsetY int
 	Parent           *limage.Image
 	Offset           int
+	path             []rune // position of the group in the image
 }
 
-func decodeImage(r io.ReaderAt, decompress bool) (limage.Image, error) {
+func decodeImage(r io.ReaderAt, tiles tileMode, opts []DecoderOption) (*Image, error) {
+	d := decoder{
+		tiles:         tiles,
+		tileCacheSize: defaultTileCacheSize,
+	}
+
+	for _, opt := range opts {
+		opt(&d)
+	}
+
+	if tiles == tilesLazy {
+		d.tileCache = newTileCache(d.tileCacheSize)
+	}
+
+	r = io.NewSectionReader(r, 0, readerSize(r))
 	dr := newReader(r)
+	d.pixels = new(int64)
+	dr.decodeOptions = d.decodeOptions
 
-	mode, err := readHeader(dr)
+	version, err := readHeader(dr)
 	if err != nil {
 		return nil, err
 	}
@@ -137,38 +234,125 @@ func decodeImage(r io.ReaderAt, decompress bool) (limage.Image, error) {
 	height := int(dr.ReadUint32())
 	bounds := image.Rect(0, 0, width, height)
 	baseType := dr.ReadUint32()
+	precision := PrecisionU8NonLinear
 
-	var precision uint32
+	if version >= 4 {
+		if precision, err = readPrecision(version, dr.ReadUint32()); err != nil {
+			return nil, dr.WrapError(err)
+		}
+	}
 
-	if mode > 0 {
-		precision = dr.ReadUint32()
+	if baseType == baseIndexed && precision != PrecisionU8NonLinear {
+		return nil, dr.WrapError(ErrInvalidPrecision)
 	}
 
-	palette, compression, err := readImageProperties(dr, baseType)
+	var im Image
+
+	palette, compression, err := readImageProperties(&dr, baseType, &im)
 	if err != nil {
 		return nil, err
 	}
 
-	layerptrs := readLayerPointers(dr, mode)
+	if !dr.CheckDimensions(uint32(width), uint32(height)) {
+		return nil, dr.DecodeErr()
+	}
+
+	layerptrs := readPointerList(dr, version, dr.CheckLayers)
+	chanptrs := readPointerList(dr, version, dr.CheckChannels)
+
+	var pathptrs []uint64
+
+	if version >= pathItemsVersion {
+		pathptrs = readPointerList(dr, version, func(count int64) bool {
+			return dr.CheckPaths(int64(len(im.Paths)) + count)
+		})
+	}
+
+	if err := dr.DecodeErr(); err != nil {
+		return nil, err
+	}
+
+	d.baseType = baseType
+	d.palette = palette
+	d.compression = compression
+	d.precision = precision
+	d.version = version
+
+	layers := readLayers(&dr, r, layerptrs, d)
+
+	d.reader = newReader(r)
+	d.decodeOptions = dr.decodeOptions
+	channels, selection, selectedChannels, chanptrs := readChannels(&dr, chanptrs, d, bounds)
 
 	if dr.Err != nil {
 		return nil, dr.Err
 	}
 
-	layers := readLayers(dr, r, layerptrs, baseType, palette, compression, precision, mode, decompress)
+	paths, selectedPaths := readPathItems(&dr, pathptrs, len(im.Paths))
 
 	if dr.Err != nil {
-		return nil, dr.Err
+		return nil, dr.DecodeErr()
 	}
 
-	groups, err := makeGroups(layers, bounds)
+	im.Paths = append(im.Paths, paths...)
+	im.SelectedPaths = append(im.SelectedPaths, selectedPaths...)
+
+	var floating *layer
+
+	for n := range layers {
+		if layers[n].floating != 0 {
+			floating = &layers[n]
+			layers = append(layers[:n:n], layers[n+1:]...)
+
+			break
+		}
+	}
+
+	var problems *[]*DecodeError
+
+	if dr.recovering {
+		problems = &dr.problems
+	}
+
+	groups, err := makeGroups(layers, bounds, problems)
 	if err != nil {
 		return nil, err
 	}
 
-	im := makeImage(groups)
+	im.Image = makeImage(groups)
+
+	if d.selector != nil {
+		readSelectedLayers(&dr, r, im.Image, layers, d)
 
-	return im, nil
+		if dr.Err != nil {
+			return nil, dr.Err
+		}
+	}
+
+	im.Channels = channels
+	im.SelectedChannels = selectedChannels
+	im.Selection = selection
+
+	for _, l := range layers {
+		if l.active && !l.failed {
+			im.SelectedLayers = append(im.SelectedLayers, layerPath(l.itemPath))
+		}
+	}
+
+	if floating != nil && !floating.failed {
+		if target, ok := floatingTarget(floating.floating, layers, chanptrs); ok {
+			im.FloatingSelection = &FloatingSelection{
+				Layer:  floating.Layer,
+				Target: target,
+			}
+		} else if err := floating.decodeError(ErrInvalidFloatingSelection); dr.recovering {
+			dr.problems = append(dr.problems, err)
+		} else {
+			return nil, err
+		}
+	}
+
+	return &im, joinErrors(dr.problems)
 }
 
 func readHeader(dr reader) (uint32, error) {
@@ -176,48 +360,56 @@ func readHeader(dr reader) (uint32, error) {
 
 	dr.Read(header[:])
 
-	if dr.Err != nil {
-		return 0, dr.Err // wrap?
+	if err := dr.DecodeErr(); err != nil {
+		return 0, err
 	}
 
 	if string(header[:9]) != fileTypeID {
-		return 0, ErrInvalidFileTypeID
+		return 0, dr.WrapError(ErrInvalidFileTypeID)
 	}
 
-	var mode uint32
+	var version uint32
 
-	switch string(header[9:13]) {
-	case fileVersion0, fileVersion1, fileVersion2, fileVersion3:
-	case fileVersion4, fileVersion5, fileVersion6, fileVersion7, fileVersion8, fileVersion9, fileVersion10:
-		mode = 1
-	case fileVersion11, fileVersion12, fileVersion13:
-		mode = 2
-	default:
-		return 0, ErrUnsupportedVersion
+	if string(header[9:13]) != fileVersion0 {
+		if header[9] != 'v' {
+			return 0, dr.WrapError(ErrUnsupportedVersion)
+		}
+
+		for _, c := range header[10:13] {
+			if c < '0' || c > '9' {
+				return 0, dr.WrapError(ErrUnsupportedVersion)
+			}
+
+			version = version*10 + uint32(c-'0')
+		}
+
+		if version == 0 || version > maxDecodeVersion {
+			return 0, dr.WrapError(ErrUnsupportedVersion)
+		}
 	}
 
 	if header[13] != 0 {
-		return 0, ErrInvalidHeader
+		return 0, dr.WrapError(ErrInvalidHeader)
 	}
 
-	return mode, nil
+	return version, nil
 }
 
-func readImageProperties(dr reader, baseType uint32) (lcolor.AlphaPalette, uint8, error) {
+func readImageProperties(dr *reader, baseType uint32, im *Image) (lcolor.AlphaPalette, Compression, error) {
 	var (
 		palette     lcolor.AlphaPalette
-		compression uint8
+		compression Compression
 	)
 
 PropertyLoop:
 	for {
-		typ := dr.ReadUint32()
-		plength := dr.ReadUint32()
+		typ, plength := dr.ReadProperty()
+		end := dr.Pos() + int64(plength)
 
 		switch typ {
 		case propEnd:
 			if plength != 0 {
-				return nil, 0, ErrInvalidProperties
+				return nil, 0, dr.WrapError(ErrInvalidProperties)
 			}
 
 			break PropertyLoop
@@ -229,10 +421,27 @@ PropertyLoop:
 			dr.ReadBoolProperty()
 		case propOpacity:
 			if o := dr.ReadUint32(); o > 255 {
-				return nil, 0, ErrInvalidOpacity
+				dr.SetError(ErrInvalidOpacity)
 			}
 		case propParasites:
-			dr.ReadParasites(plength)
+			ps := dr.ReadParasites(plength)
+			if p := ps.Get(gridParasiteName); p != nil {
+				if g, err := parseGrid(p); err == nil {
+					im.Grid = g
+					ps = ps.Remove(gridParasiteName)
+				}
+			}
+
+			if p := ps.Get(iccProfileParasiteName); p != nil {
+				profile, err := lcolor.ParseICCProfile(p.data)
+				if err != nil {
+					profile = &lcolor.ICCProfile{Data: p.data}
+				}
+
+				im.Profile = profile
+			}
+
+			im.Parasites = append(im.Parasites, ps.Export()...)
 		case propTattoo:
 			dr.ReadUint32()
 		case propVisible:
@@ -241,10 +450,19 @@ PropertyLoop:
 		// image properties
 		case propColorMap:
 			if baseType != baseIndexed {
-				dr.Skip(plength) // skip
+				dr.Skip(plength)
+
+				break
 			}
 
-			palette = make(lcolor.AlphaPalette, dr.ReadUint32())
+			n := dr.ReadUint32()
+			if n > maxColorMapSize {
+				dr.SetError(ErrInvalidColorMap)
+
+				break
+			}
+
+			palette = make(lcolor.AlphaPalette, n)
 
 			for n := range palette {
 				palette[n] = lcolor.RGB{
@@ -254,118 +472,183 @@ PropertyLoop:
 				}
 			}
 		case propCompression:
-			if compression = dr.ReadUint8(); compression > 1 {
-				return nil, 0, ErrUnknownCompression
+			if compression = Compression(dr.ReadUint8()); compression > CompressionZlib {
+				dr.SetError(ErrUnknownCompression)
 			}
 		case propGuides:
-			ng := plength / 5
-
-			if ng*5 != plength {
-				return nil, 0, ErrInvalidGuideLength
-			}
-
-			for n := uint32(0); n < ng; n++ {
-				dr.SkipUint32()
-				dr.SkipBoolProperty()
-			}
+			dr.ReadGuides(plength, &im.Metadata)
 		case propPaths:
-			dr.SkipPaths()
+			im.addPaths(dr.ReadPaths(len(im.Paths)))
 		case propResolution:
-			dr.SkipFloat32() // x
-			dr.SkipFloat32() // y
+			im.XResolution = float64(dr.ReadFloat32())
+			im.YResolution = float64(dr.ReadFloat32())
 		case propSamplePoints:
-			if plength&1 == 1 {
-				return nil, 0, ErrInvalidSampleLength
-			}
-
-			for i := uint32(0); i < plength>>1; i++ {
-				dr.SkipUint32()
-				dr.SkipUint32()
-			}
+			dr.ReadSamplePoints(plength, &im.Metadata)
+		case propOldSamplePoints:
+			dr.ReadOldSamplePoints(plength, &im.Metadata)
 		case propUnit:
-			if dr.ReadUint32() > 4 {
-				return nil, 0, ErrInvalidUnit
+			if im.Unit = Unit(dr.ReadUint32()); im.Unit > UnitPica {
+				dr.SetError(ErrInvalidUnit)
 			}
 		case propUserUnit:
-			dr.SkipFloat32() // factor
-			dr.SkipUint32()  // number of decimal digits
-			dr.SkipString()  // id
-			dr.SkipString()  // symbol
-			dr.SkipString()  // abbr.
-			dr.SkipString()  // singular name
-			dr.SkipString()  // plural name
+			im.UserUnit = dr.ReadUserUnit(plength)
 		case propVectors:
-			dr.SkipVectors()
+			im.addPaths(dr.ReadVectors(len(im.Paths)))
 		default:
 			dr.Skip(plength)
 		}
+
+		dr.RecoverProperty(end)
 	}
 
-	return palette, compression, nil
+	return palette, compression, dr.DecodeErr()
 }
 
-func readLayerPointers(dr reader, mode uint32) []uint64 {
-	layerptrs := make([]uint64, 0, 32)
+// readPointerList reads a zero terminated list of pointers, stopping when the
+// check of the number of pointers, which sets the error of the limit, fails.
+func readPointerList(dr reader, version uint32, check func(count int64) bool) []uint64 {
+	ptrs := make([]uint64, 0, 32)
 
 	for {
-		var lptr uint64
+		if !check(int64(len(ptrs))) {
+			return nil
+		}
+
+		var ptr uint64
 
-		if mode < 2 {
-			lptr = uint64(dr.ReadUint32())
+		if version < 11 {
+			ptr = uint64(dr.ReadUint32())
 		} else {
-			lptr = dr.ReadUint64()
+			ptr = dr.ReadUint64()
 		}
 
-		if lptr == 0 {
-			return layerptrs
+		if ptr == 0 {
+			return ptrs
 		}
 
-		layerptrs = append(layerptrs, lptr)
+		ptrs = append(ptrs, ptr)
 	}
 }
 
-func readLayers(dr reader, r io.ReaderAt, layerptrs []uint64, baseType uint32, palette lcolor.AlphaPalette, compression uint8, precision, mode uint32, decompress bool) []layer {
+// readLayers reads the layers concurrently.
+func readLayers(dr *reader, r io.ReaderAt, layerptrs []uint64, base decoder) []layer {
 	layers := make([]layer, len(layerptrs))
 
+	for n, lptr := range layerptrs {
+		layers[n].index = n
+		layers[n].ptr = lptr
+	}
+
+	forEachLayer(dr, r, layers, base, func(d *decoder, l *layer) {
+		index, ptr := l.index, l.ptr
+
+		d.Goto(ptr)
+
+		*l = d.ReadLayer()
+		l.index, l.ptr = index, ptr
+	})
+
+	return layers
+}
+
+// forEachLayer concurrently calls fn for each of the layers, giving each call
+// its own decoder.
+//
+// In recovery mode, layers that cannot be read are marked as failed, and the
+// problems encountered are added to those of dr. Exceeding a limit is always
+// an error.
+func forEachLayer(dr *reader, r io.ReaderAt, layers []layer, base decoder, fn func(*decoder, *layer)) {
 	var (
-		errLock sync.Mutex
-		wg      sync.WaitGroup
+		problems = make([][]*DecodeError, len(layers))
+		errs     = make([]*DecodeError, len(layers))
+		wg       sync.WaitGroup
 	)
 
-	wg.Add(len(layerptrs))
-
-	for n, lptr := range layerptrs {
-		go func(n int, lptr uint64) {
-			d := decoder{
-				reader:      newReader(r),
-				baseType:    baseType,
-				palette:     palette,
-				compression: compression,
-				decompress:  decompress,
-				precision:   precision,
-				mode:        mode,
-			}
+	wg.Add(len(layers))
 
-			d.Goto(lptr)
+	for n := range layers {
+		go func(n int) {
+			d := base
+			d.reader = newReader(r)
+			d.decodeOptions = base.decodeOptions
+			l := &layers[n]
 
-			layers[n] = d.ReadLayer()
+			fn(&d, l)
 
 			if d.Err != nil {
-				errLock.Lock()
-				dr.SetError(d.Err)
-				errLock.Unlock()
+				if err := d.WrapError(d.Err); d.recovering && !isLimitError(err) {
+					l.failed = true
+					d.problems = append(d.problems, err)
+				} else {
+					errs[n] = err
+				}
+			}
+
+			for _, p := range append(d.problems, errs[n]) {
+				if p != nil {
+					p.Layer = l.index
+					p.LayerName = l.Name
+				}
 			}
 
+			problems[n] = d.problems
+
 			wg.Done()
-		}(n, lptr)
+		}(n)
 	}
 
 	wg.Wait()
 
-	return layers
+	var fatal []*DecodeError
+
+	for n, err := range errs {
+		dr.problems = append(dr.problems, problems[n]...)
+
+		if err != nil {
+			fatal = append(fatal, err)
+		}
+	}
+
+	dr.SetError(joinErrors(fatal))
+}
+
+func layerPath(itemPath []rune) LayerPath {
+	path := make(LayerPath, len(itemPath))
+
+	for n, i := range itemPath {
+		path[n] = int(i)
+	}
+
+	return path
 }
 
-func makeGroups(layers []layer, bounds image.Rectangle) (map[string]*groupOffset, error) {
+// floatingTarget finds the drawable stored at the given pointer.
+func floatingTarget(ptr uint64, layers []layer, chanptrs []uint64) (FloatingTarget, bool) {
+	for _, l := range layers {
+		if l.failed {
+			continue
+		} else if l.ptr == ptr {
+			return FloatingTarget{Layer: layerPath(l.itemPath)}, true
+		} else if l.maskPtr == ptr {
+			return FloatingTarget{Layer: layerPath(l.itemPath), Mask: true}, true
+		}
+	}
+
+	for n, cptr := range chanptrs {
+		if cptr == ptr {
+			return FloatingTarget{Channel: n}, true
+		}
+	}
+
+	return FloatingTarget{}, false
+}
+
+// makeGroups places the layers into their groups, replacing the item path of
+// each layer with its position in the resulting image.
+//
+// When problems is not nil, layers that cannot be placed are marked as failed,
+// with the errors added to problems, instead of returning an error.
+func makeGroups(layers []layer, bounds image.Rectangle, problems *[]*DecodeError) (map[string]*groupOffset, error) {
 	var (
 		groups = make(map[string]*groupOffset)
 		n      rune
@@ -374,23 +657,48 @@ func makeGroups(layers []layer, bounds image.Rectangle) (map[string]*groupOffset
 
 	groups[""] = &groupOffset{Group: make(limage.Image, 0, 32)}
 
-	for _, l := range layers {
-		if !alpha {
-			return nil, ErrMissingAlpha
+	fail := func(i int, err error) error {
+		if problems == nil {
+			return layers[i].decodeError(err)
 		}
 
-		alpha = l.alpha
+		*problems = append(*problems, layers[i].decodeError(err))
 
+		return nil
+	}
+
+	for i, l := range layers {
 		if len(l.itemPath) == 0 {
 			l.itemPath = []rune{n}
 			n++
 		}
 
+		if l.failed {
+			continue
+		}
+
+		if !alpha {
+			if err := fail(i-1, ErrMissingAlpha); err != nil {
+				return nil, err
+			}
+		}
+
+		alpha = l.alpha
+
 		g := groups[string(l.itemPath[:len(l.itemPath)-1])]
 		if g == nil {
-			return nil, ErrInvalidGroup
+			if err := fail(i, ErrInvalidGroup); err != nil {
+				return nil, err
+			}
+
+			layers[i].failed = true
+
+			continue
 		}
 
+		path := append(g.path[:len(g.path):len(g.path)], rune(len(g.Group)))
+		layers[i].itemPath = path
+
 		if l.group {
 			groups[string(l.itemPath)] = &groupOffset{
 				Group:   make(limage.Image, 0, 32),
@@ -398,6 +706,7 @@ func makeGroups(layers []layer, bounds image.Rectangle) (map[string]*groupOffset
 				OffsetY: l.LayerBounds.Min.Y,
 				Parent:  &g.Group,
 				Offset:  len(g.Group),
+				path:    path,
 			}
 		}
 
@@ -438,16 +747,18 @@ func makeImage(groups map[string]*groupOffset) limage.Image {
 
 // Errors.
 var (
-	ErrInvalidFileTypeID   = errors.New("invalid file type identification")
-	ErrUnsupportedVersion  = errors.New("unsupported file version")
-	ErrInvalidHeader       = errors.New("invalid header")
-	ErrInvalidProperties   = errors.New("invalid property list")
-	ErrInvalidOpacity      = errors.New("opacity not in valid range")
-	ErrInvalidGuideLength  = errors.New("invalid guide length")
-	ErrInvalidUnit         = errors.New("invalid unit")
-	ErrInvalidSampleLength = errors.New("invalid sample points length")
-	ErrInvalidGroup        = errors.New("invalid or unknown group specified for layer")
-	ErrUnknownCompression  = errors.New("unknown compression method")
-	ErrMissingAlpha        = errors.New("non-bottom layer missing alpha channel")
-	ErrNeedReaderAt        = errors.New("need a io.ReaderAt")
+	ErrInvalidFileTypeID        = errors.New("invalid file type identification")
+	ErrUnsupportedVersion       = errors.New("unsupported file version")
+	ErrInvalidHeader            = errors.New("invalid header")
+	ErrInvalidProperties        = errors.New("invalid property list")
+	ErrInvalidOpacity           = errors.New("opacity not in valid range")
+	ErrInvalidColorMap          = errors.New("invalid colour map")
+	ErrInvalidGuideLength       = errors.New("invalid guide length")
+	ErrInvalidUnit              = errors.New("invalid unit")
+	ErrInvalidSampleLength      = errors.New("invalid sample points length")
+	ErrInvalidGroup             = errors.New("invalid or unknown group specified for layer")
+	ErrUnknownCompression       = errors.New("unknown compression method")
+	ErrMissingAlpha             = errors.New("non-bottom layer missing alpha channel")
+	ErrNeedReaderAt             = errors.New("need a io.ReaderAt")
+	ErrInvalidFloatingSelection = errors.New("floating selection attached to unknown drawable")
 )
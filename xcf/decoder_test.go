@@ -3,6 +3,7 @@ package xcf
 import (
 	"bytes"
 	"compress/gzip"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"image"
@@ -14,22 +15,19 @@ import (
 
 	"vimagination.zapto.org/limage"
 	"vimagination.zapto.org/limage/lcolor"
+	"vimagination.zapto.org/memio"
 )
 
-var buf [2098]byte
-
 func openFile(str string) (io.ReaderAt, error) {
 	gz, err := gzip.NewReader(strings.NewReader(str))
 	if err != nil {
 		return nil, err
 	}
-	n, err := gz.Read(buf[:])
+	buf, err := io.ReadAll(gz)
 	if err != nil {
-		if !errors.Is(err, io.EOF) {
-			return nil, err
-		}
+		return nil, err
 	}
-	return bytes.NewReader(buf[:n]), nil
+	return bytes.NewReader(buf), nil
 }
 
 func TestConfigDecoder(t *testing.T) {
@@ -152,6 +150,7 @@ func TestDecoder(t *testing.T) {
 								Height: 30,
 							},
 							LayerBounds: image.Rect(0, 0, 30, 30),
+							Tattoo:      18,
 						},
 						limage.Layer{
 							Name: "Red",
@@ -161,9 +160,12 @@ func TestDecoder(t *testing.T) {
 								Height: 30,
 							},
 							LayerBounds: image.Rect(20, 20, 50, 50),
+							Tattoo:      12,
 						},
 					},
 					LayerBounds: image.Rect(0, 0, 50, 50),
+					Expanded:    true,
+					Tattoo:      17,
 				},
 				limage.Layer{
 					Name: "Background",
@@ -173,6 +175,7 @@ func TestDecoder(t *testing.T) {
 						Height: 50,
 					},
 					LayerBounds: image.Rect(0, 0, 50, 50),
+					Tattoo:      2,
 				},
 			},
 		},
@@ -187,6 +190,7 @@ func TestDecoder(t *testing.T) {
 						Height: 30,
 					},
 					LayerBounds: image.Rect(10, 10, 40, 40),
+					Tattoo:      12,
 				},
 				limage.Layer{
 					Name: "Background",
@@ -196,6 +200,7 @@ func TestDecoder(t *testing.T) {
 						Height: 50,
 					},
 					LayerBounds: image.Rect(0, 0, 50, 50),
+					Tattoo:      2,
 				},
 			},
 		},
@@ -210,6 +215,7 @@ func TestDecoder(t *testing.T) {
 						Height: 50,
 					},
 					LayerBounds: image.Rect(0, 0, 50, 50),
+					Tattoo:      2,
 				},
 			},
 		},
@@ -224,6 +230,7 @@ func TestDecoder(t *testing.T) {
 						Height: 50,
 					},
 					LayerBounds: image.Rect(0, 0, 50, 50),
+					Tattoo:      2,
 				},
 			},
 		},
@@ -238,6 +245,7 @@ func TestDecoder(t *testing.T) {
 						Height: 50,
 					},
 					LayerBounds: image.Rect(0, 0, 50, 50),
+					Tattoo:      2,
 				},
 			},
 		},
@@ -280,6 +288,11 @@ func compareLayers(a, b limage.Image) error {
 				}
 				ia = mia.Image
 				ib = mib.Image
+				mia.Image, mia.Mask = nil, nil
+				mib.Image, mib.Mask = nil, nil
+				if !reflect.DeepEqual(mia, mib) {
+					return fmt.Errorf("mask properties mismatched, expecting %#v, got %#v", mib, mia)
+				}
 			} else {
 				return fmt.Errorf("expecting MaskedImage, got %T", ia)
 			}
@@ -326,3 +339,886 @@ func compareImages(ia, ib image.Image) error {
 	}
 	return nil
 }
+
+func TestDecodeLarge(t *testing.T) {
+	const size = 2100
+
+	im := image.NewNRGBA(image.Rect(0, 0, size, size))
+	c := color.NRGBA{R: 1, G: 2, B: 3, A: 255}
+
+	im.SetNRGBA(size-1, size-1, c)
+
+	var buf []byte
+
+	if err := Encode(memio.Create(&buf), im, WithCompression(CompressionNone)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if len(buf) <= maxString {
+		t.Fatalf("expecting file larger than %d bytes, got %d", maxString, len(buf))
+	}
+
+	l, err := Decode(memio.Open(buf))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if got := color.NRGBAModel.Convert(l.At(size-1, size-1)); got != c {
+		t.Errorf("expecting colour %v, got %v", c, got)
+	}
+}
+
+func TestDecodeVersion(t *testing.T) {
+	im := limage.Image{
+		limage.Layer{
+			Name: "Layer",
+			Image: singleColourImage{
+				Colour: color.NRGBA{R: 255, A: 255},
+				Width:  20,
+				Height: 20,
+			},
+			LayerBounds: image.Rect(0, 0, 20, 20),
+		},
+	}
+
+	var buf []byte
+
+	if err := Encode(memio.Create(&buf), im, WithVersion(13)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for n, test := range [...]struct {
+		Version string
+		Err     error
+	}{
+		{"v013", nil},
+		{"v014", nil},
+		{"v023", ErrUnsupportedVersion},
+		{"v999", ErrUnsupportedVersion},
+		{"v000", ErrUnsupportedVersion},
+		{"v01a", ErrUnsupportedVersion},
+		{"x013", ErrUnsupportedVersion},
+	} {
+		copy(buf[9:13], test.Version)
+
+		l, err := Decode(memio.Open(buf))
+		if !errors.Is(err, test.Err) {
+			t.Errorf("test %d: expecting error %v, got %v", n+1, test.Err, err)
+		} else if err == nil {
+			if err := compareLayers(l, im); err != nil {
+				t.Errorf("test %d: %s", n+1, err)
+			}
+		}
+	}
+}
+
+func TestDecodeGIMP3(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	green := color.NRGBA{G: 255, A: 128}
+	blue := color.NRGBA{B: 255, A: 255}
+	outline := []Stroke{
+		{
+			Closed: true,
+			Points: []PathPoint{
+				{Control: true, X: 1, Y: 2, Pressure: 1, XTilt: 0.5, YTilt: 0.5, Wheel: 0.5},
+				{X: 1, Y: 2, Pressure: 1, XTilt: 0.5, YTilt: 0.5, Wheel: 0.5},
+				{Control: true, X: 3, Y: 2, Pressure: 1, XTilt: 0.5, YTilt: 0.5, Wheel: 0.5},
+				{Control: true, X: 10, Y: 2, Pressure: 1, XTilt: 0.5, YTilt: 0.5, Wheel: 0.5},
+				{X: 12, Y: 2, Pressure: 1, XTilt: 0.5, YTilt: 0.5, Wheel: 0.5},
+				{Control: true, X: 12, Y: 4, Pressure: 1, XTilt: 0.5, YTilt: 0.5, Wheel: 0.5},
+				{Control: true, X: 12, Y: 12, Pressure: 1, XTilt: 0.5, YTilt: 0.5, Wheel: 0.5},
+				{X: 12, Y: 14, Pressure: 1, XTilt: 0.5, YTilt: 0.5, Wheel: 0.5},
+				{Control: true, X: 10, Y: 14, Pressure: 1, XTilt: 0.5, YTilt: 0.5, Wheel: 0.5},
+			},
+		},
+	}
+	pressure := []Stroke{
+		{
+			Points: []PathPoint{
+				{Control: true, Pressure: 0.5, XTilt: 0.25, YTilt: 0.75, Wheel: 0.125},
+				{Pressure: 0.5, XTilt: 0.25, YTilt: 0.75, Wheel: 0.125},
+				{Control: true, Pressure: 0.5, XTilt: 0.25, YTilt: 0.75, Wheel: 0.125},
+				{Control: true, X: 15, Y: 15, Pressure: 1, XTilt: 0.5, YTilt: 0.5, Wheel: 0.5},
+				{X: 15, Y: 15, Pressure: 1, XTilt: 0.5, YTilt: 0.5, Wheel: 0.5},
+				{Control: true, X: 15, Y: 15, Pressure: 1, XTilt: 0.5, YTilt: 0.5, Wheel: 0.5},
+			},
+		},
+	}
+
+	for n, test := range [...]struct {
+		File  string
+		Paths []Path
+	}{
+		{
+			File: v014File,
+		},
+		{
+			File: v022File,
+			Paths: []Path{
+				{Name: "Outline", Tattoo: 8, Visible: true, Parasites: []limage.Parasite{{Name: "test-parasite", Flags: 1, Data: []byte("path data")}}, Strokes: outline},
+				{Name: "Pressure", Tattoo: 9, Strokes: pressure},
+			},
+		},
+	} {
+		f, err := openFile(test.File)
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+
+		im, err := DecodeImage(f)
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		if len(im.Image) != 3 {
+			t.Errorf("test %d: expecting 3 layers, got %d", n+1, len(im.Image))
+
+			continue
+		}
+
+		group, ok := im.Image[1].Image.(limage.Image)
+		if !ok || len(group) != 1 {
+			t.Errorf("test %d: expecting group with 1 layer, got %T", n+1, im.Image[1].Image)
+
+			continue
+		} else if im.Image[1].Mode != limage.CompositePassThrough || !im.Image[1].Expanded {
+			t.Errorf("test %d: expecting expanded pass-through group, got mode %s", n+1, im.Image[1].Mode)
+		}
+
+		for _, l := range [...]struct {
+			limage.Layer
+			Name   string
+			Bounds image.Rectangle
+			Colour color.NRGBA
+			Tattoo uint32
+		}{
+			{im.Image[0], "Top", image.Rect(4, 4, 12, 12), red, 2},
+			{im.Image[1], "Group", image.Rect(0, 0, 16, 16), color.NRGBA{}, 3},
+			{group[0], "Child", image.Rect(0, 0, 16, 16), green, 4},
+			{im.Image[2], "Background", image.Rect(0, 0, 16, 16), blue, 5},
+		} {
+			if l.Layer.Name != l.Name || l.LayerBounds != l.Bounds || l.Layer.Tattoo != l.Tattoo {
+				t.Errorf("test %d: expecting layer %q at %v with tattoo %d, got %q at %v with tattoo %d", n+1, l.Name, l.Bounds, l.Tattoo, l.Layer.Name, l.LayerBounds, l.Layer.Tattoo)
+			} else if _, isGroup := l.Image.(limage.Image); !isGroup {
+				if c := color.NRGBAModel.Convert(l.Image.At(l.Image.Bounds().Min.X, l.Image.Bounds().Min.Y)); c != l.Colour {
+					t.Errorf("test %d: layer %q: expecting colour %v, got %v", n+1, l.Name, l.Colour, c)
+				}
+			}
+		}
+
+		if top := im.Image[0]; top.CompositeMode != limage.CompositeModeAuto || top.BlendSpace != limage.ColorSpaceAuto || top.CompositeSpace != limage.ColorSpaceAuto {
+			t.Errorf("test %d: expecting automatic composite settings, got %d, %d, %d", n+1, top.CompositeMode, top.BlendSpace, top.CompositeSpace)
+		} else if !top.NonLegacy {
+			t.Errorf("test %d: expecting non-legacy layer mode", n+1)
+		} else {
+			var buf []byte
+
+			if err := Encode(memio.Create(&buf), limage.Image{top}); err != nil {
+				t.Errorf("test %d: unexpected error: %s", n+1, err)
+			} else if d, err := Decode(memio.Open(buf)); err != nil {
+				t.Errorf("test %d: unexpected error: %s", n+1, err)
+			} else if l := d[0]; l.CompositeMode != limage.CompositeModeAuto || l.BlendSpace != limage.ColorSpaceAuto || l.CompositeSpace != limage.ColorSpaceAuto || !l.NonLegacy {
+				t.Errorf("test %d: expecting automatic composite settings of a non-legacy mode after encoding, got %d, %d, %d, %v", n+1, l.CompositeMode, l.BlendSpace, l.CompositeSpace, l.NonLegacy)
+			}
+		}
+
+		if expected := []LayerPath{{0}, {1, 0}}; !reflect.DeepEqual(im.SelectedLayers, expected) {
+			t.Errorf("test %d: expecting selected layers %v, got %v", n+1, expected, im.SelectedLayers)
+		}
+
+		if len(im.Channels) != 2 {
+			t.Errorf("test %d: expecting 2 channels, got %d", n+1, len(im.Channels))
+		} else if c := im.Channels[0]; c.Name != "Mask" || c.Transparency != 127 || !c.Invisible || c.Colour != (lcolor.RGB{R: 10, G: 20, B: 30}) || c.At(3, 0).(color.Gray).Y != 48 {
+			t.Errorf("test %d: unexpected channel %q: transparency %d, invisible %v, colour %v, value %d", n+1, c.Name, c.Transparency, c.Invisible, c.Colour, c.At(3, 0).(color.Gray).Y)
+		}
+
+		if expected := []int{0, 1}; !reflect.DeepEqual(im.SelectedChannels, expected) {
+			t.Errorf("test %d: expecting selected channels %v, got %v", n+1, expected, im.SelectedChannels)
+		}
+
+		if !reflect.DeepEqual(im.Paths, test.Paths) {
+			t.Errorf("test %d: expecting paths %v, got %v", n+1, test.Paths, im.Paths)
+		}
+
+		if test.Paths != nil && !reflect.DeepEqual(im.SelectedPaths, []int{0}) {
+			t.Errorf("test %d: expecting selected path 0, got %v", n+1, im.SelectedPaths)
+		}
+
+		if im.XResolution != 300 || im.YResolution != 300 || im.Unit != UnitInch {
+			t.Errorf("test %d: expecting 300x300 dpi, got %vx%v %v", n+1, im.XResolution, im.YResolution, im.Unit)
+		}
+
+		// the half transparent green layer uses the non-legacy normal mode,
+		// and so is composited onto the blue background in linear light
+		if c := color.NRGBAModel.Convert(im.At(0, 0)); c != (color.NRGBA{G: 188, B: 187, A: 255}) {
+			t.Errorf("test %d: expecting composited colour %v, got %v", n+1, color.NRGBA{G: 188, B: 187, A: 255}, c)
+		}
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	layer := func(name string) limage.Layer {
+		return limage.Layer{
+			Name:        name,
+			LayerBounds: image.Rect(0, 0, 10, 10),
+			Image: singleColourImage{
+				Colour: color.NRGBA{R: 255, A: 255},
+				Width:  10,
+				Height: 10,
+			},
+		}
+	}
+
+	var buf []byte
+
+	if err := Encode(memio.Create(&buf), limage.Image{layer("Top"), layer("Background")}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	opacity := []byte{0, 0, 0, propOpacity, 0, 0, 0, 4, 0, 0, 0, 255}
+
+	var offsets []int64
+
+	for pos := 0; ; {
+		n := bytes.Index(buf[pos:], opacity)
+		if n < 0 {
+			break
+		}
+
+		pos += n + len(opacity)
+		buf[pos-2] = 1 // opacity of 256
+		offsets = append(offsets, int64(pos))
+	}
+
+	if len(offsets) != 2 {
+		t.Fatalf("expecting 2 opacity properties, found %d", len(offsets))
+	}
+
+	_, err := Decode(memio.Open(buf))
+	if !errors.Is(err, ErrInvalidOpacity) {
+		t.Fatalf("expecting error %v, got %v", ErrInvalidOpacity, err)
+	}
+
+	var (
+		des DecodeErrors
+		de  *DecodeError
+	)
+
+	if !errors.As(err, &des) {
+		t.Fatalf("expecting DecodeErrors, got %T", err)
+	} else if len(des) != 2 {
+		t.Fatalf("expecting 2 errors, got %d", len(des))
+	} else if !errors.As(err, &de) || de != des[0] {
+		t.Errorf("expecting first DecodeError, got %v", de)
+	}
+
+	for n, e := range des {
+		expected := &DecodeError{
+			Err:       ErrInvalidOpacity,
+			Offset:    offsets[n],
+			Layer:     n,
+			LayerName: []string{"Top", "Background"}[n],
+			Property:  propOpacity,
+		}
+
+		if !reflect.DeepEqual(e, expected) {
+			t.Errorf("error %d: expecting %#v, got %#v", n+1, expected, e)
+		}
+	}
+}
+
+func TestDecodeRecovery(t *testing.T) {
+	layer := func(name string, c color.NRGBA) limage.Layer {
+		return limage.Layer{
+			Name:        name,
+			LayerBounds: image.Rect(0, 0, 128, 64),
+			Image: singleColourImage{
+				Colour: c,
+				Width:  128,
+				Height: 64,
+			},
+		}
+	}
+
+	red := color.NRGBA{R: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+
+	var buf []byte
+
+	if err := Encode(memio.Create(&buf), limage.Image{layer("Top", red), layer("Background", blue)}, WithCompression(CompressionNone)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	opacity := []byte{0, 0, 0, propOpacity, 0, 0, 0, 4, 0, 0, 0, 255}
+
+	if n := bytes.Index(buf, opacity); n < 0 {
+		t.Fatal("opacity property not found")
+	} else {
+		buf[n+len(opacity)-2] = 1 // opacity of 256
+	}
+
+	buf = buf[:len(buf)-100] // truncate the last tile of the background
+
+	if _, err := Decode(memio.Open(buf)); !errors.Is(err, ErrInvalidOpacity) {
+		t.Errorf("expecting error %v, got %v", ErrInvalidOpacity, err)
+	}
+
+	im, err := Decode(memio.Open(buf), WithRecovery())
+
+	var des DecodeErrors
+
+	if !errors.As(err, &des) {
+		t.Fatalf("expecting DecodeErrors, got %v", err)
+	} else if !errors.Is(err, ErrInvalidOpacity) {
+		t.Errorf("expecting error %v, got %v", ErrInvalidOpacity, err)
+	} else if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expecting error %v, got %v", io.ErrUnexpectedEOF, err)
+	} else if len(des) != 2 {
+		t.Errorf("expecting 2 problems, got %d", len(des))
+	} else if des[0].Layer != 0 || des[1].Layer != 1 {
+		t.Errorf("expecting problems in layers 0 and 1, got %d and %d", des[0].Layer, des[1].Layer)
+	}
+
+	if len(im) != 2 {
+		t.Fatalf("expecting 2 layers, got %d", len(im))
+	}
+
+	if im[0].Transparency != 0 {
+		t.Errorf("expecting invalid opacity to be ignored, got transparency %d", im[0].Transparency)
+	}
+
+	for _, test := range [...]struct {
+		Layer  int
+		X, Y   int
+		Colour color.NRGBA
+	}{
+		{0, 10, 10, red},
+		{0, 100, 10, red},
+		{1, 10, 10, blue},
+		{1, 100, 10, color.NRGBA{}},
+	} {
+		if c := color.NRGBAModel.Convert(im[test.Layer].At(test.X, test.Y)).(color.NRGBA); c != test.Colour {
+			t.Errorf("layer %d at (%d, %d): expecting colour %v, got %v", test.Layer, test.X, test.Y, test.Colour, c)
+		}
+	}
+}
+
+func TestDecodeRecoveryOpaque(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+
+	for _, test := range [...]struct {
+		Compression Compression
+		Tile        []byte
+		Decode      func(io.ReaderAt, ...DecoderOption) (limage.Image, error)
+	}{
+		{
+			Compression: CompressionNone,
+			Tile:        bytes.Repeat([]byte{255, 0, 0}, 64*64),
+			Decode:      Decode,
+		},
+		{
+			Compression: CompressionRLE,
+			Tile:        []byte{127, 16, 0, 255, 127, 16, 0, 0, 127, 16, 0, 0},
+			Decode:      DecodeCompressed,
+		},
+	} {
+		buf := rgbFile(test.Compression, test.Tile)
+
+		buf = buf[:len(buf)-2] // truncate the second tile
+
+		im, err := test.Decode(bytes.NewReader(buf), WithRecovery())
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("compression %d: expecting error %v, got %v", test.Compression, io.ErrUnexpectedEOF, err)
+		}
+
+		if len(im) != 1 {
+			t.Errorf("compression %d: expecting 1 layer, got %d", test.Compression, len(im))
+
+			continue
+		}
+
+		if _, ok := im[0].Image.(*image.NRGBA); !ok {
+			t.Errorf("compression %d: expecting *image.NRGBA, got %T", test.Compression, im[0].Image)
+		}
+
+		for _, p := range [...]struct {
+			X, Y   int
+			Colour color.NRGBA
+		}{
+			{0, 0, red},
+			{63, 63, red},
+			{64, 0, color.NRGBA{}},
+			{127, 63, color.NRGBA{}},
+		} {
+			if c := color.NRGBAModel.Convert(im[0].At(p.X, p.Y)).(color.NRGBA); c != p.Colour {
+				t.Errorf("compression %d: at (%d, %d): expecting colour %v, got %v", test.Compression, p.X, p.Y, p.Colour, c)
+			}
+		}
+	}
+}
+
+// rgbFile returns a 128x64 image file with a single layer without an alpha
+// channel, with both of its tiles set to the given data.
+func rgbFile(compression Compression, tile []byte) []byte {
+	var (
+		buf  []byte
+		ptrs []int
+	)
+
+	u32 := func(vs ...uint32) {
+		for _, v := range vs {
+			buf = binary.BigEndian.AppendUint32(buf, v)
+		}
+	}
+	ptr := func() {
+		ptrs = append(ptrs, len(buf))
+
+		u32(0)
+	}
+	set := func() {
+		binary.BigEndian.PutUint32(buf[ptrs[0]:], uint32(len(buf)))
+
+		ptrs = ptrs[1:]
+	}
+
+	buf = append(buf, "gimp xcf file\x00"...)
+
+	u32(128, 64, 0)         // width, height, rgb
+	u32(propCompression, 1) // compression property
+	buf = append(buf, byte(compression))
+	u32(0, 0) // end of properties
+	ptr()     // layer
+	u32(0, 0) // end of layers, end of channels
+	set()
+	u32(128, 64, 0, 11) // width, height, rgb, name length
+	buf = append(buf, "Background\x00"...)
+	u32(0, 0) // end of properties
+	ptr()     // hierarchy
+	u32(0)    // mask
+	set()
+	u32(128, 64, 3) // width, height, bpp
+	ptr()           // level
+	u32(0)
+	set()
+	u32(128, 64)
+	ptr() // first tile
+	ptr() // second tile
+	u32(0)
+	set()
+	buf = append(buf, tile...)
+	set()
+
+	return append(buf, tile...)
+}
+
+func TestDecodeLimits(t *testing.T) {
+	layer := func(name string) limage.Layer {
+		return limage.Layer{
+			Name:        name,
+			LayerBounds: image.Rect(0, 0, 20, 20),
+			Image: singleColourImage{
+				Colour: color.NRGBA{R: 255, A: 255},
+				Width:  20,
+				Height: 20,
+			},
+		}
+	}
+
+	inner := layer("Inner")
+	inner.Parasites = []limage.Parasite{{Name: "data", Data: make([]byte, 100)}}
+
+	var buf []byte
+
+	if err := Encode(memio.Create(&buf), Image{
+		Image: limage.Image{
+			limage.Layer{
+				Name:        "Outer Group",
+				LayerBounds: image.Rect(0, 0, 20, 20),
+				Image: limage.Image{
+					limage.Layer{
+						Name:        "Inner Group",
+						LayerBounds: image.Rect(0, 0, 20, 20),
+						Image:       limage.Image{inner},
+					},
+				},
+			},
+			layer("Background"),
+		},
+		Channels: []Channel{
+			{Name: "A", Image: image.NewGray(image.Rect(0, 0, 20, 20))},
+			{Name: "B", Image: image.NewGray(image.Rect(0, 0, 20, 20))},
+		},
+		Paths: []Path{{Name: "A"}, {Name: "B"}},
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for n, test := range [...]struct {
+		Options []DecoderOption
+		Err     error
+	}{
+		{},
+		{
+			Options: []DecoderOption{WithMaxDimensions(20, 20), WithMaxPixels(1600), WithMaxLayers(4), WithMaxGroupDepth(2), WithMaxParasiteSize(100), WithMaxPaths(2), WithMaxChannels(2)},
+		},
+		{
+			Options: []DecoderOption{WithMaxDimensions(19, 20)},
+			Err:     ErrDimensionsTooLarge,
+		},
+		{
+			Options: []DecoderOption{WithMaxDimensions(20, 19)},
+			Err:     ErrDimensionsTooLarge,
+		},
+		{
+			Options: []DecoderOption{WithMaxPixels(1599)},
+			Err:     ErrTooManyPixels,
+		},
+		{
+			Options: []DecoderOption{WithMaxLayers(3)},
+			Err:     ErrTooManyLayers,
+		},
+		{
+			Options: []DecoderOption{WithMaxGroupDepth(1)},
+			Err:     ErrGroupTooDeep,
+		},
+		{
+			Options: []DecoderOption{WithMaxParasiteSize(99)},
+			Err:     ErrParasiteTooLarge,
+		},
+		{
+			Options: []DecoderOption{WithMaxPaths(1)},
+			Err:     ErrTooManyPaths,
+		},
+		{
+			Options: []DecoderOption{WithMaxChannels(1)},
+			Err:     ErrTooManyChannels,
+		},
+		{
+			Options: []DecoderOption{WithMaxPixels(1599), WithRecovery()},
+			Err:     ErrTooManyPixels,
+		},
+		{
+			Options: []DecoderOption{WithMaxPaths(1), WithRecovery()},
+			Err:     ErrTooManyPaths,
+		},
+		{
+			Options: []DecoderOption{WithMaxChannels(1), WithRecovery()},
+			Err:     ErrTooManyChannels,
+		},
+	} {
+		im, err := Decode(memio.Open(buf), test.Options...)
+		if !errors.Is(err, test.Err) {
+			t.Errorf("test %d: expecting error %v, got %v", n+1, test.Err, err)
+		} else if test.Err != nil && im != nil {
+			t.Errorf("test %d: expecting no image", n+1)
+		}
+	}
+
+	for n, data := range [...]string{v014File, v022File} {
+		f, err := openFile(data)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if _, err := Decode(f, WithMaxPaths(2)); err != nil {
+			t.Errorf("file %d: unexpected error: %s", n+1, err)
+		} else if _, err := Decode(f, WithMaxPaths(1)); n == 1 && !errors.Is(err, ErrTooManyPaths) {
+			t.Errorf("file %d: expecting error %v, got %v", n+1, ErrTooManyPaths, err)
+		}
+	}
+}
+
+func TestDecodeDeferred(t *testing.T) {
+	red := singleColourImage{Colour: color.NRGBA{R: 255, A: 255}, Width: 10, Height: 10}
+	mask := image.NewGray(image.Rect(0, 0, 10, 10))
+
+	for n := range mask.Pix {
+		mask.Pix[n] = 128
+	}
+
+	text := limage.TextData{{Data: "Hello", Font: "Sans", Size: 10, ForeColor: color.Black}}
+	im := limage.Image{
+		limage.Layer{
+			Name:        "Text",
+			LayerBounds: image.Rect(0, 0, 10, 10),
+			Image:       limage.Text{Image: red, TextData: text},
+		},
+		limage.Layer{
+			Name:        "Masked",
+			LayerBounds: image.Rect(0, 0, 10, 10),
+			Image:       limage.MaskedImage{Image: red, Mask: mask},
+		},
+		limage.Layer{
+			Name:        "Background",
+			LayerBounds: image.Rect(0, 0, 10, 10),
+			Image:       red,
+		},
+	}
+
+	var buf []byte
+
+	if err := Encode(memio.Create(&buf), im, WithCompression(CompressionNone)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	d, err := Decode(memio.Open(buf[:len(buf)-100]), WithLayerNames("Masked"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if di, ok := d[0].Image.(*DeferredImage); !ok {
+		t.Errorf("expecting deferred text layer, got %T", d[0].Image)
+	} else if di.Text.String() != "Hello" || di.Masked {
+		t.Errorf("expecting text %q without mask, got %q, %v", "Hello", di.Text, di.Masked)
+	} else if i, err := di.Decode(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if _, ok := i.(limage.Text); !ok {
+		t.Errorf("expecting text image, got %T", i)
+	}
+
+	if _, ok := d[1].Image.(limage.MaskedImage); !ok {
+		t.Errorf("expecting masked image, got %T", d[1].Image)
+	}
+
+	di, ok := d[2].Image.(*DeferredImage)
+	if !ok {
+		t.Fatalf("expecting deferred background, got %T", d[2].Image)
+	}
+
+	var de *DecodeError
+
+	if i, err := di.Decode(); i != nil || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expecting error %v and no image, got %v and %T", io.ErrUnexpectedEOF, err, i)
+	} else if !errors.As(err, &de) || de.Layer != 2 || de.LayerName != "Background" {
+		t.Errorf("expecting error in layer 2, got %v", err)
+	} else if _, err2 := di.Decode(); err2 != err {
+		t.Errorf("expecting the same error, got %v", err2)
+	} else if c := color.NRGBAModel.Convert(di.At(0, 0)); c != (color.NRGBA{}) {
+		t.Errorf("expecting transparent colour, got %v", c)
+	}
+
+	d, err = Decode(memio.Open(buf), WithLayerNames("Text"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if di, ok := d[1].Image.(*DeferredImage); !ok {
+		t.Errorf("expecting deferred masked layer, got %T", d[1].Image)
+	} else if !di.Masked || di.Text != nil {
+		t.Errorf("expecting masked layer without text, got %v, %v", di.Masked, di.Text)
+	} else if i, err := di.Decode(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if m, ok := i.(limage.MaskedImage); !ok {
+		t.Errorf("expecting masked image, got %T", i)
+	} else if !reflect.DeepEqual(m.Mask, mask) {
+		t.Errorf("expecting mask to match")
+	}
+}
+
+func TestDecodeColorMap(t *testing.T) {
+	var buf []byte
+
+	if err := Encode(memio.Create(&buf), limage.Image{
+		limage.Layer{
+			Name:        "Indexed",
+			LayerBounds: image.Rect(0, 0, 10, 10),
+			Image:       image.NewPaletted(image.Rect(0, 0, 10, 10), color.Palette{color.Black, color.White}),
+		},
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	colorMap := []byte{0, 0, 0, propColorMap, 0, 0, 0, 10, 0, 0, 0, 2}
+
+	pos := bytes.Index(buf, colorMap)
+	if pos < 0 {
+		t.Fatal("colour map property not found")
+	}
+
+	if _, err := Decode(memio.Open(buf)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	binary.BigEndian.PutUint32(buf[pos+8:], 257)
+
+	if _, err := Decode(memio.Open(buf)); !errors.Is(err, ErrInvalidColorMap) {
+		t.Errorf("expecting error %v, got %v", ErrInvalidColorMap, err)
+	}
+}
+
+func TestDecodeSelected(t *testing.T) {
+	layer := func(name string, c color.NRGBA) limage.Layer {
+		return limage.Layer{
+			Name:        name,
+			LayerBounds: image.Rect(0, 0, 10, 10),
+			Image: singleColourImage{
+				Colour: c,
+				Width:  10,
+				Height: 10,
+			},
+		}
+	}
+
+	im := limage.Image{
+		limage.Layer{
+			Name:        "Group",
+			LayerBounds: image.Rect(0, 0, 10, 10),
+			Image: limage.Image{
+				layer("A", color.NRGBA{R: 255, A: 255}),
+				layer("B", color.NRGBA{G: 255, A: 128}),
+			},
+		},
+		layer("C", color.NRGBA{B: 255, A: 64}),
+		layer("Background", color.NRGBA{R: 255, G: 255, A: 255}),
+	}
+
+	var buf []byte
+
+	if err := Encode(memio.Create(&buf), im); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var calls []string
+
+	for n, test := range [...]struct {
+		Option   DecoderOption
+		Deferred []LayerPath
+	}{
+		{
+			Option:   WithLayerNames("Group"),
+			Deferred: []LayerPath{{1}, {2}},
+		},
+		{
+			Option:   WithLayerPaths(LayerPath{0, 1}, LayerPath{2}),
+			Deferred: []LayerPath{{0, 0}, {1}},
+		},
+		{
+			Option: WithLayerSelector(func(p LayerPath, l limage.Layer) bool {
+				calls = append(calls, fmt.Sprintf("%v %s", p, l.Name))
+
+				return false
+			}),
+			Deferred: []LayerPath{{0, 0}, {0, 1}, {1}, {2}},
+		},
+	} {
+		d, err := Decode(memio.Open(buf), test.Option)
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		for _, path := range [...]LayerPath{{0, 0}, {0, 1}, {1}, {2}} {
+			_, deferred := layerAt(d, path).Image.(*DeferredImage)
+
+			var expectDeferred bool
+
+			for _, p := range test.Deferred {
+				expectDeferred = expectDeferred || p.equalPath(path)
+			}
+
+			if deferred != expectDeferred {
+				t.Errorf("test %d: layer %v: expecting deferred to be %v, got %v", n+1, path, expectDeferred, deferred)
+			}
+		}
+
+		if err := compareLayers(d, im); err != nil {
+			t.Errorf("test %d: %s", n+1, err)
+		}
+	}
+
+	if expected := []string{"[0] Group", "[0 0] A", "[0 1] B", "[1] C", "[2] Background"}; !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expecting selector calls %q, got %q", expected, calls)
+	}
+}
+
+func TestEncodeDeferred(t *testing.T) {
+	red := singleColourImage{Colour: color.NRGBA{R: 255, A: 128}, Width: 10, Height: 10}
+	mask := image.NewGray(image.Rect(0, 0, 10, 10))
+
+	for n := range mask.Pix {
+		mask.Pix[n] = uint8(n)
+	}
+
+	text := limage.TextData{{Data: "Hello", Font: "Sans", Size: 10, ForeColor: color.Black}}
+	im := limage.Image{
+		limage.Layer{
+			Name:        "Text",
+			LayerBounds: image.Rect(0, 0, 10, 10),
+			Image:       limage.Text{Image: red, TextData: text},
+		},
+		limage.Layer{
+			Name:        "Masked",
+			LayerBounds: image.Rect(0, 0, 10, 10),
+			Image:       limage.MaskedImage{Image: red, Mask: mask, EditMask: true, ShowMask: true},
+		},
+		limage.Layer{
+			Name:        "Masked Text",
+			LayerBounds: image.Rect(0, 0, 10, 10),
+			Image:       limage.MaskedImage{Image: limage.Text{Image: red, TextData: text}, Mask: mask, Disabled: true},
+		},
+		limage.Layer{
+			Name:        "Background",
+			LayerBounds: image.Rect(0, 0, 10, 10),
+			Image:       red,
+		},
+	}
+
+	var buf []byte
+
+	if err := Encode(memio.Create(&buf), im); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	full, err := Decode(memio.Open(buf))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	selected, err := Decode(memio.Open(buf), WithLayerNames("Background"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for n, l := range selected[:3] {
+		di, ok := l.Image.(*DeferredImage)
+		if !ok {
+			t.Fatalf("layer %d: expecting deferred image, got %T", n+1, l.Image)
+		} else if !reflect.DeepEqual(di.ColorModel(), full[n].Image.ColorModel()) {
+			t.Errorf("layer %d: expecting colour model %v, got %v", n+1, full[n].Image.ColorModel(), di.ColorModel())
+		} else if di.image != nil {
+			t.Errorf("layer %d: expecting the colour model not to decode the image", n+1)
+		}
+	}
+
+	buf = buf[:0]
+
+	if err := Encode(memio.Create(&buf), selected); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	reencoded, err := Decode(memio.Open(buf))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if t1, ok := reencoded[0].Image.(limage.Text); !ok || t1.TextData.String() != "Hello" {
+		t.Errorf("expecting text layer, got %T", reencoded[0].Image)
+	}
+
+	if m, ok := reencoded[1].Image.(limage.MaskedImage); !ok {
+		t.Errorf("expecting masked image, got %T", reencoded[1].Image)
+	} else if !m.EditMask || !m.ShowMask || m.Disabled || !reflect.DeepEqual(m.Mask, mask) {
+		t.Errorf("expecting mask and flags to be kept, got %v, %v, %v", m.EditMask, m.ShowMask, m.Disabled)
+	} else if c := color.NRGBAModel.Convert(m.Image.At(5, 5)); c != (color.NRGBA{R: 255, A: 128}) {
+		t.Errorf("expecting unmasked colour, got %v", c)
+	}
+
+	if m, ok := reencoded[2].Image.(limage.MaskedImage); !ok {
+		t.Errorf("expecting masked image, got %T", reencoded[2].Image)
+	} else if !m.Disabled {
+		t.Errorf("expecting disabled mask")
+	} else if t1, ok := m.Image.(limage.Text); !ok || t1.TextData.String() != "Hello" {
+		t.Errorf("expecting masked text layer, got %T", m.Image)
+	}
+}
@@ -1,6 +1,9 @@
 package xcf
 
 import (
+	"compress/zlib"
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
 	"io"
@@ -16,18 +19,80 @@ type colourBufFunc func(*encoder, color.Color)
 type encoder struct {
 	writer
 
+	version      uint32
+	fixedVersion bool
+	precision    Precision
+	components   componentFormat
+	compression  Compression
+	zlib         *zlib.Writer
+
 	colourPalette  lcolor.AlphaPalette
 	colourFunc     colourBufFunc
 	colourType     uint8
 	colourChannels uint8
 
-	channelBuf [4][chanLen]byte
-	colourBuf  [4]byte
+	selectedLayers []LayerPath
+	floating       *FloatingTarget
+	floatingTarget *pointerWriter
+
+	channelBuf [][chanLen]byte
+	colourBuf  [32]byte
+	tileBuf    []byte
+}
+
+// EncoderOption is a function that modifies how an image is encoded.
+type EncoderOption func(*encoder)
+
+// WithPrecision sets the bit-depth, data type and gamma used to store the
+// colour data of the image.
+//
+// Indexed images can only be stored with PrecisionU8NonLinear, which is the
+// default.
+func WithPrecision(p Precision) EncoderOption {
+	return func(e *encoder) {
+		e.precision = p
+	}
+}
+
+// WithCompression sets the method used to compress tile data.
+//
+// The default is CompressionRLE.
+func WithCompression(c Compression) EncoderOption {
+	return func(e *encoder) {
+		e.compression = c
+	}
+}
+
+// WithVersion sets the XCF file version to write, from 0 to 14.
+//
+// By default, version 3 is written, unless the image or the other options
+// require a later version, in which case the lowest suitable version is
+// chosen. When a version is set that cannot store the image, Encode returns
+// ErrVersionTooLow.
+//
+// From version 10, float opacity and the composite mode, composite space and
+// blend space layer properties are written. From version 11, file offsets are
+// 64-bit, allowing files larger than 4GiB, and from version 12 high bit-depth
+// colour data is stored in big-endian order. Version 14 allows more than one
+// layer and channel to be selected.
+func WithVersion(v uint32) EncoderOption {
+	return func(e *encoder) {
+		e.version = v
+		e.fixedVersion = true
+	}
 }
 
 // Encode encodes the given image as an XCF file to the given WriterAt.
-func Encode(w io.WriterAt, im image.Image) error {
+func Encode(w io.WriterAt, im image.Image, opts ...EncoderOption) error {
+	var xim Image // image-level data, when given an Image
+
 	switch imt := im.(type) {
+	case Image:
+		xim = imt
+		im = imt.Image
+	case *Image:
+		xim = *imt
+		im = imt.Image
 	case *limage.Image:
 		im = *imt
 	case limage.Layer:
@@ -37,18 +102,44 @@ func Encode(w io.WriterAt, im image.Image) error {
 	}
 
 	e := encoder{
-		writer: newWriter(w),
+		writer:      newWriter(w),
+		version:     3,
+		precision:   PrecisionU8NonLinear,
+		compression: CompressionRLE,
 	}
 
-	e.Write(header)
+	for _, opt := range opts {
+		opt(&e)
+	}
 
-	b := im.Bounds()
+	if e.version > maxEncodeVersion {
+		return ErrUnsupportedVersion
+	} else if !e.precision.valid() {
+		return ErrInvalidPrecision
+	}
 
-	e.WriteUint32(uint32(b.Dx()))
-	e.WriteUint32(uint32(b.Dy()))
+	switch e.compression {
+	case CompressionNone, CompressionRLE:
+	case CompressionZlib:
+		if !e.requireVersion(8) {
+			return ErrVersionTooLow
+		}
+
+		e.zlib = zlib.NewWriter(e.StickyBigEndianWriter)
+	default:
+		return ErrUnknownCompression
+	}
+
+	if l, ok := im.(limage.Image); ok && !e.requireVersion(layersVersion(l)) {
+		return ErrVersionTooLow
+	}
+
+	if (len(xim.SelectedLayers) > 1 || len(xim.SelectedChannels) > 1) && !e.requireVersion(14) {
+		return ErrVersionTooLow
+	}
 
 	switch cm := im.ColorModel(); cm {
-	case color.GrayModel, color.Gray16Model, lcolor.GrayAlphaModel:
+	case color.GrayModel, color.Gray16Model, lcolor.GrayAlphaModel, lcolor.GrayAlpha32Model:
 		e.colourType = 1
 		e.colourFunc = (*encoder).grayAlphaToBuf
 		e.colourChannels = 2
@@ -70,8 +161,70 @@ func Encode(w io.WriterAt, im image.Image) error {
 			e.colourChannels = 4
 		}
 	}
+
+	if e.precision != PrecisionU8NonLinear {
+		if e.colourPalette != nil {
+			return ErrInvalidPrecision
+		}
+
+		if _, ok := e.precision.id(e.version); !ok && !e.requireVersion(7) {
+			return ErrVersionTooLow
+		}
+	}
+
+	if e.precision.deep() {
+		switch e.colourType {
+		case 0:
+			e.colourFunc = (*encoder).rgbAlphaToDeepBuf
+		case 1:
+			e.colourFunc = (*encoder).grayAlphaToDeepBuf
+		}
+	}
+
+	e.widePointers = e.version >= 11
+	e.components = newComponentFormat(e.precision, e.version)
+	e.channelBuf = make([][chanLen]byte, int(e.colourChannels)*e.precision.bytes())
+
+	if e.compression != CompressionRLE {
+		e.tileBuf = make([]byte, chanLen*len(e.channelBuf))
+	}
+
+	b := im.Bounds()
+
+	for _, c := range xim.Channels {
+		if c.Image == nil || c.Bounds().Dx() != b.Dx() || c.Bounds().Dy() != b.Dy() {
+			return ErrInvalidChannel
+		}
+	}
+
+	if xim.Selection != nil && (xim.Selection.Rect.Dx() != b.Dx() || xim.Selection.Rect.Dy() != b.Dy()) {
+		return ErrInvalidChannel
+	}
+
+	if fs := xim.FloatingSelection; fs != nil && !validFloatingTarget(xim.Image, fs.Target, len(xim.Channels)) {
+		return ErrInvalidFloatingSelection
+	}
+
+	e.selectedLayers = xim.SelectedLayers
+
+	numChannels := uint32(len(xim.Channels))
+
+	if xim.Selection != nil {
+		numChannels++
+	}
+
+	e.writeHeader()
+
+	e.WriteUint32(uint32(b.Dx()))
+	e.WriteUint32(uint32(b.Dy()))
 	e.WriteUint32(uint32(e.colourType))
 
+	if e.version >= 4 {
+		p, _ := e.precision.id(e.version)
+
+		e.WriteUint32(p)
+	}
+
 	// write property list
 
 	if e.colourPalette != nil {
@@ -90,27 +243,99 @@ func Encode(w io.WriterAt, im image.Image) error {
 
 	e.WriteUint32(propCompression)
 	e.WriteUint32(1)
-	e.WriteUint8(1) // rle
+	e.WriteUint8(uint8(e.compression))
+
+	e.WriteMetadata(&xim.Metadata)
+
+	ps := importParasites(xim.Parasites)
+	if xim.Grid != nil {
+		ps = append(ps.Remove(gridParasiteName), xim.Grid.parasite())
+	}
+
+	if xim.Profile != nil && len(xim.Profile.Data) > 0 {
+		ps = append(ps, parasite{
+			name:  iccProfileParasiteName,
+			flags: parasitePersistent | parasiteUndoable,
+			data:  xim.Profile.Data,
+		})
+	}
+
+	if len(ps) > 0 {
+		e.WriteParasites(ps)
+	}
+
+	if len(xim.Paths) > 0 {
+		e.WriteVectors(xim.Paths, xim.activePath())
+	}
 
 	e.WriteUint32(0)
 	e.WriteUint32(0)
 
 	switch im := im.(type) {
 	case limage.Image:
-		pw := e.ReservePointerList(layerCount(im))
+		count := layerCount(im)
+		if xim.FloatingSelection != nil {
+			count++
+		}
+
+		pw := e.ReservePointerList(count)
+		cw := e.ReservePointerList(numChannels)
+
+		if xim.FloatingSelection != nil {
+			e.WriteFloatingSelection(xim.FloatingSelection, pw)
+		}
 
-		e.WriteUint32(0) // no channels
 		e.WriteLayers(im, 0, 0, make([]uint32, 0, 32), pw)
+		e.WriteChannels(xim.Channels, xim.Selection, xim.SelectedChannels, cw)
 	default:
 		pw := e.ReservePointerList(1)
+		cw := e.ReservePointerList(numChannels)
 
-		e.WriteUint32(0) // no channels
-		e.WriteLayer(limage.Layer{Image: im}, 0, 0, []uint32{}, pw)
+		e.WriteLayer(limage.Layer{LayerBounds: im.Bounds(), Image: im}, 0, 0, []uint32{}, pw)
+		e.WriteChannels(xim.Channels, xim.Selection, xim.SelectedChannels, cw)
 	}
 
 	return e.Err
 }
 
+// validFloatingTarget returns true if the target of a floating selection
+// exists.
+func validFloatingTarget(layers limage.Image, t FloatingTarget, channels int) bool {
+	if t.Layer == nil {
+		return t.Channel >= 0 && t.Channel < channels
+	}
+
+	var l limage.Layer
+
+	for _, i := range t.Layer {
+		if i < 0 || i >= len(layers) {
+			return false
+		}
+
+		l = layers[i]
+
+		switch g := l.Image.(type) {
+		case limage.Image:
+			layers = g
+		case *limage.Image:
+			layers = *g
+		default:
+			layers = nil
+		}
+	}
+
+	if !t.Mask {
+		return true
+	}
+
+	switch l.Image.(type) {
+	case limage.MaskedImage, *limage.MaskedImage:
+		return true
+	}
+
+	return false
+}
+
 func layerCount(g limage.Image) uint32 {
 	count := uint32(len(g))
 
@@ -126,4 +351,68 @@ func layerCount(g limage.Image) uint32 {
 	return count
 }
 
-var header = []byte{'g', 'i', 'm', 'p', ' ', 'x', 'c', 'f', ' ', 'v', '0', '0', '3', 0}
+// requireVersion raises the version to be written to at least v, returning
+// false if a lower version was explicitly requested.
+func (e *encoder) requireVersion(v uint32) bool {
+	if e.version >= v {
+		return true
+	} else if e.fixedVersion {
+		return false
+	}
+
+	e.version = v
+
+	return true
+}
+
+func layersVersion(layers limage.Image) uint32 {
+	var version uint32
+
+	for _, l := range layers {
+		if v := modeVersion(modeID(l.Mode, l.NonLegacy)); v > version {
+			version = v
+		}
+
+		if l.CompositeMode != limage.CompositeModeAuto || l.BlendSpace != limage.ColorSpaceAuto || l.CompositeSpace != limage.ColorSpaceAuto {
+			if version < 10 {
+				version = 10
+			}
+		}
+
+		var group limage.Image
+
+		switch g := l.Image.(type) {
+		case limage.Image:
+			group = g
+		case *limage.Image:
+			group = *g
+		default:
+			continue
+		}
+
+		if version < 3 {
+			version = 3
+		}
+
+		if v := layersVersion(group); v > version {
+			version = v
+		}
+	}
+
+	return version
+}
+
+func (e *encoder) writeHeader() {
+	if e.version == 0 {
+		e.Write([]byte(fileTypeID + fileVersion0 + "\x00"))
+	} else {
+		e.Write(fmt.Appendf(nil, "%sv%03d\x00", fileTypeID, e.version))
+	}
+}
+
+const maxEncodeVersion = 14
+
+// Errors.
+var (
+	ErrVersionTooLow = errors.New("file version too low to store image")
+)
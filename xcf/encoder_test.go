@@ -1,11 +1,21 @@
 package xcf
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
+	"io"
+	"math"
+	"reflect"
+	"strings"
 	"testing"
 
 	"vimagination.zapto.org/limage"
+	"vimagination.zapto.org/limage/lcolor"
 	"vimagination.zapto.org/memio"
 )
 
@@ -139,3 +149,1344 @@ func TestEncode(t *testing.T) {
 		}
 	}
 }
+
+func TestEncodePrecision(t *testing.T) {
+	im := image.NewNRGBA64(image.Rect(0, 0, 70, 70))
+
+	for y := 0; y < 70; y++ {
+		for x := 0; x < 70; x++ {
+			im.SetNRGBA64(x, y, color.NRGBA64{
+				R: uint16(x * 936),
+				G: uint16(y * 936),
+				B: uint16((x + y) * 468),
+				A: uint16(0xffff - x*y*13),
+			})
+		}
+	}
+
+	for n, test := range [...]struct {
+		Precision Precision
+		Tolerance uint16
+	}{
+		{PrecisionU8Linear, 0x1400},
+		{PrecisionU16Linear, 0x20},
+		{PrecisionU16NonLinear, 0},
+		{PrecisionU32Linear, 0},
+		{PrecisionU32NonLinear, 0},
+		{PrecisionHalfLinear, 0x40},
+		{PrecisionHalfNonLinear, 0x20},
+		{PrecisionFloatLinear, 0},
+		{PrecisionFloatNonLinear, 0},
+		{PrecisionDoubleLinear, 0},
+		{PrecisionDoubleNonLinear, 0},
+	} {
+		var buf []byte
+
+		if err := Encode(memio.Create(&buf), limage.Image{{Name: "Layer", LayerBounds: im.Rect, Image: im}}, WithPrecision(test.Precision)); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		for m, decode := range [...]func(io.ReaderAt, ...DecoderOption) (limage.Image, error){Decode, DecodeCompressed} {
+			l, err := decode(memio.Open(buf))
+			if err != nil {
+				t.Errorf("test %d.%d: unexpected error: %s", n+1, m+1, err)
+
+				continue
+			}
+
+			if err := compareImagesTolerance(l[0].Image, im, test.Tolerance); err != nil {
+				t.Errorf("test %d.%d: %s", n+1, m+1, err)
+			}
+		}
+	}
+}
+
+func TestEncodeVersion(t *testing.T) {
+	im := limage.Image{
+		limage.Layer{
+			Name:         "Layer",
+			Mode:         limage.CompositeMultiply,
+			Transparency: 100,
+			Image: singleColourImage{
+				Colour: color.NRGBA{R: 255, G: 128, A: 255},
+				Width:  70,
+				Height: 70,
+			},
+			LayerBounds: image.Rect(0, 0, 70, 70),
+		},
+		limage.Layer{
+			Name: "Background",
+			Image: singleColourImage{
+				Colour: color.NRGBA{A: 255},
+				Width:  70,
+				Height: 70,
+			},
+			LayerBounds: image.Rect(0, 0, 70, 70),
+		},
+	}
+
+	for v := uint32(0); v <= 14; v++ {
+		var buf []byte
+
+		if err := Encode(memio.Create(&buf), im, WithVersion(v)); err != nil {
+			t.Errorf("test %d: unexpected error: %s", v, err)
+
+			continue
+		}
+
+		header := fmt.Sprintf("gimp xcf v%03d\x00", v)
+		if v == 0 {
+			header = "gimp xcf file\x00"
+		}
+
+		if string(buf[:14]) != header {
+			t.Errorf("test %d: expecting header %q, got %q", v, header, buf[:14])
+		}
+
+		l, err := Decode(memio.Open(buf))
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", v, err)
+		} else if err := compareLayers(l, im); err != nil {
+			t.Errorf("test %d: %s", v, err)
+		}
+	}
+}
+
+func TestEncodeVersionPrecision(t *testing.T) {
+	im := image.NewNRGBA64(image.Rect(0, 0, 70, 70))
+
+	for y := 0; y < 70; y++ {
+		for x := 0; x < 70; x++ {
+			im.SetNRGBA64(x, y, color.NRGBA64{
+				R: uint16(x * 936),
+				G: uint16(y * 936),
+				B: uint16((x + y) * 468),
+				A: 0xffff,
+			})
+		}
+	}
+
+	for n, test := range [...]struct {
+		Version   uint32
+		Precision Precision
+		Tolerance uint16
+	}{
+		{4, PrecisionU16NonLinear, 0},
+		{4, PrecisionFloatLinear, 0},
+		{5, PrecisionU16Linear, 0x20},
+		{6, PrecisionHalfNonLinear, 0x20},
+		{11, PrecisionU32NonLinear, 0},
+		{12, PrecisionU16NonLinear, 0},
+		{13, PrecisionDoubleLinear, 0},
+	} {
+		var buf []byte
+
+		if err := Encode(memio.Create(&buf), limage.Image{{Name: "Layer", LayerBounds: im.Rect, Image: im}}, WithVersion(test.Version), WithPrecision(test.Precision)); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		l, err := Decode(memio.Open(buf))
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if err := compareImagesTolerance(l[0].Image, im, test.Tolerance); err != nil {
+			t.Errorf("test %d: %s", n+1, err)
+		}
+	}
+}
+
+func TestEncodeVersionErrors(t *testing.T) {
+	layer := limage.Layer{
+		Name: "Layer",
+		Image: singleColourImage{
+			Colour: color.NRGBA{A: 255},
+			Width:  10,
+			Height: 10,
+		},
+		LayerBounds: image.Rect(0, 0, 10, 10),
+	}
+	vivid := layer
+	vivid.Mode = limage.CompositeVividLight
+
+	for n, test := range [...]struct {
+		Image   image.Image
+		Options []EncoderOption
+		Err     error
+	}{
+		{limage.Image{layer}, []EncoderOption{WithVersion(15)}, ErrUnsupportedVersion},
+		{limage.Image{layer}, []EncoderOption{WithVersion(7), WithCompression(CompressionZlib)}, ErrVersionTooLow},
+		{limage.Image{layer}, []EncoderOption{WithVersion(3), WithPrecision(PrecisionU16NonLinear)}, ErrVersionTooLow},
+		{limage.Image{layer}, []EncoderOption{WithVersion(4), WithPrecision(PrecisionU16Linear)}, ErrVersionTooLow},
+		{limage.Image{layer}, []EncoderOption{WithVersion(6), WithPrecision(PrecisionDoubleLinear)}, ErrVersionTooLow},
+		{limage.Image{{Name: "Group", Image: limage.Image{layer}, LayerBounds: layer.LayerBounds}}, []EncoderOption{WithVersion(2)}, ErrVersionTooLow},
+		{limage.Image{vivid}, []EncoderOption{WithVersion(9)}, ErrVersionTooLow},
+		{limage.Image{vivid}, []EncoderOption{WithVersion(10)}, nil},
+		{limage.Image{layer}, []EncoderOption{WithCompression(CompressionZlib), WithVersion(11)}, nil},
+	} {
+		var buf []byte
+
+		if err := Encode(memio.Create(&buf), test.Image, test.Options...); err != test.Err {
+			t.Errorf("test %d: expecting error %v, got %v", n+1, test.Err, err)
+		}
+	}
+}
+
+func compareImagesTolerance(ia image.Image, ib *image.NRGBA64, tolerance uint16) error {
+	if !ia.Bounds().Eq(ib.Bounds()) {
+		return fmt.Errorf("bounds mismatch, expecting %v, got %v", ib.Bounds(), ia.Bounds())
+	}
+
+	if _, ok := ia.ColorModel().Convert(color.NRGBA64{}).(color.NRGBA64); !ok {
+		return fmt.Errorf("expecting NRGBA64 colour model, got %T", ia.ColorModel().Convert(color.NRGBA64{}))
+	}
+
+	for y := 0; y < ib.Rect.Dy(); y++ {
+		for x := 0; x < ib.Rect.Dx(); x++ {
+			ca := ia.At(x, y).(color.NRGBA64)
+			cb := ib.NRGBA64At(x, y)
+
+			for _, c := range [...][2]uint16{{ca.R, cb.R}, {ca.G, cb.G}, {ca.B, cb.B}, {ca.A, cb.A}} {
+				if c[0] > c[1] && c[0]-c[1] > tolerance || c[1] > c[0] && c[1]-c[0] > tolerance {
+					return fmt.Errorf("pixel mismatch at (%d, %d): expecting %v, got %v", x, y, cb, ca)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func TestEncodeChannels(t *testing.T) {
+	a := image.NewGray(image.Rect(0, 0, 70, 70))
+	b := image.NewGray(image.Rect(0, 0, 70, 70))
+	c := image.NewGray16(image.Rect(0, 0, 70, 70))
+
+	for y := 0; y < 70; y++ {
+		for x := 0; x < 70; x++ {
+			a.SetGray(x, y, color.Gray{uint8(x * 3)})
+			b.SetGray(x, y, color.Gray{uint8(x ^ y)})
+			c.SetGray16(x, y, color.Gray16{uint16(x*937 + y)})
+		}
+	}
+
+	im := Image{
+		Image: limage.Image{
+			limage.Layer{
+				Name: "Layer",
+				Image: singleColourImage{
+					Colour: color.NRGBA{R: 255, A: 255},
+					Width:  70,
+					Height: 70,
+				},
+				LayerBounds: image.Rect(0, 0, 70, 70),
+			},
+		},
+		Channels: []Channel{
+			{
+				Name:   "Channel A",
+				Colour: lcolor.RGB{R: 255, G: 0, B: 128},
+				Image:  a,
+			},
+			{
+				Name:         "Channel B",
+				Transparency: 128,
+				Invisible:    true,
+				Image:        b,
+			},
+		},
+	}
+
+	// high bit-depth values are only kept by high bit-depth precisions
+	deep := append(im.Channels[:len(im.Channels):len(im.Channels)], Channel{
+		Name:  "Channel C",
+		Image: c,
+	})
+
+	for n, test := range [...]struct {
+		Options  []EncoderOption
+		Channels []Channel
+		Model    color.Model
+	}{
+		{nil, im.Channels, color.GrayModel},
+		{[]EncoderOption{WithVersion(11), WithCompression(CompressionZlib)}, im.Channels, color.GrayModel},
+		{[]EncoderOption{WithPrecision(PrecisionFloatLinear)}, deep, color.Gray16Model},
+		{[]EncoderOption{WithPrecision(PrecisionU16NonLinear)}, deep, color.Gray16Model},
+	} {
+		var buf []byte
+
+		if err := Encode(memio.Create(&buf), &Image{Image: im.Image, Channels: test.Channels}, test.Options...); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		d, err := DecodeImage(memio.Open(buf))
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		if len(d.Channels) != len(test.Channels) {
+			t.Errorf("test %d: expecting %d channels, got %d", n+1, len(test.Channels), len(d.Channels))
+
+			continue
+		}
+
+		for m, c := range d.Channels {
+			e := test.Channels[m]
+
+			if c.ColorModel() != test.Model {
+				t.Errorf("test %d.%d: expecting %T, got %T", n+1, m+1, test.Model.Convert(color.Gray{}), c.ColorModel().Convert(color.Gray{}))
+			} else if err := compareImages(c.Image, modelImage{e.Image, test.Model}); err != nil {
+				t.Errorf("test %d.%d: %s", n+1, m+1, err)
+			}
+
+			c.Image, e.Image = nil, nil
+
+			if c != e {
+				t.Errorf("test %d.%d: expecting channel %#v, got %#v", n+1, m+1, e, c)
+			}
+		}
+	}
+
+	var buf []byte
+
+	if err := Encode(memio.Create(&buf), Image{Image: im.Image, Channels: []Channel{{Image: image.NewGray(image.Rect(0, 0, 10, 10))}}}); err != ErrInvalidChannel {
+		t.Errorf("expecting error %v, got %v", ErrInvalidChannel, err)
+	}
+}
+
+// modelImage converts the colours of an image to the colour model.
+type modelImage struct {
+	image.Image
+	Model color.Model
+}
+
+func (m modelImage) At(x, y int) color.Color {
+	return m.Model.Convert(m.Image.At(x, y))
+}
+
+func TestEncodeSelection(t *testing.T) {
+	selection := image.NewGray(image.Rect(0, 0, 50, 40))
+
+	for y := 10; y < 30; y++ {
+		for x := 5; x < 45; x++ {
+			selection.SetGray(x, y, color.Gray{255})
+		}
+	}
+
+	layers := limage.Image{
+		limage.Layer{
+			Name: "Layer",
+			Image: singleColourImage{
+				Colour: color.NRGBA{G: 255, A: 255},
+				Width:  50,
+				Height: 40,
+			},
+			LayerBounds: image.Rect(0, 0, 50, 40),
+		},
+	}
+
+	for n, test := range [...]Image{
+		{Image: layers},
+		{Image: layers, Selection: selection},
+		{Image: layers, Channels: []Channel{{Name: "Channel", Image: image.NewGray(selection.Rect)}}, Selection: selection},
+	} {
+		var buf []byte
+
+		if err := Encode(memio.Create(&buf), test); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		d, err := DecodeImage(memio.Open(buf))
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		if len(d.Channels) != len(test.Channels) {
+			t.Errorf("test %d: expecting %d channels, got %d", n+1, len(test.Channels), len(d.Channels))
+		}
+
+		if test.Selection == nil {
+			if d.Selection != nil {
+				t.Errorf("test %d: expecting no selection", n+1)
+			}
+		} else if d.Selection == nil {
+			t.Errorf("test %d: expecting selection", n+1)
+		} else if err := compareImages(d.Selection, test.Selection); err != nil {
+			t.Errorf("test %d: %s", n+1, err)
+		}
+	}
+}
+
+func TestEncodeMetadata(t *testing.T) {
+	layers := limage.Image{
+		limage.Layer{
+			Name: "Layer",
+			Image: singleColourImage{
+				Colour: color.NRGBA{B: 255, A: 255},
+				Width:  20,
+				Height: 10,
+			},
+			LayerBounds: image.Rect(0, 0, 20, 10),
+		},
+	}
+
+	grid := &Grid{
+		Style:       "solid",
+		Foreground:  color.NRGBA64{A: 0xffff},
+		Background:  color.NRGBA64{R: 0xffff, G: 0xffff, B: 0xffff, A: 0xffff},
+		XSpacing:    16.5,
+		YSpacing:    8,
+		SpacingUnit: "inches",
+		XOffset:     1,
+		YOffset:     2.25,
+		OffsetUnit:  "pixels",
+	}
+
+	for n, test := range [...]struct {
+		Metadata
+		Version uint32
+	}{
+		{},
+		{
+			Metadata: Metadata{
+				XResolution: 300,
+				YResolution: 150,
+				Unit:        UnitMillimeter,
+			},
+		},
+		{
+			Metadata: Metadata{
+				UserUnit: &UserUnit{
+					Factor:       2.5,
+					Digits:       2,
+					ID:           "furlong",
+					Symbol:       "fl",
+					Abbreviation: "fl",
+					Singular:     "furlong",
+					Plural:       "furlongs",
+				},
+			},
+		},
+		{
+			Metadata: Metadata{
+				Guides: []Guide{
+					{Orientation: GuideHorizontal, Position: 5},
+					{Orientation: GuideVertical, Position: -3},
+				},
+				SamplePoints: []SamplePoint{{X: 1, Y: 2}, {X: 19, Y: 9}},
+			},
+		},
+		{
+			Metadata: Metadata{
+				SamplePoints: []SamplePoint{{X: 1, Y: 2, PickMode: 1}},
+			},
+			Version: 10,
+		},
+		{
+			Metadata: Metadata{
+				Grid: grid,
+			},
+		},
+	} {
+		var (
+			buf  []byte
+			opts []EncoderOption
+		)
+
+		if test.Version != 0 {
+			opts = append(opts, WithVersion(test.Version))
+		}
+
+		if err := Encode(memio.Create(&buf), Image{Image: layers, Metadata: test.Metadata}, opts...); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		d, err := DecodeImage(memio.Open(buf))
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		if !reflect.DeepEqual(d.Metadata, test.Metadata) {
+			t.Errorf("test %d: expecting metadata %+v, got %+v", n+1, test.Metadata, d.Metadata)
+		}
+	}
+}
+
+func TestEncodeParasites(t *testing.T) {
+	imageParasites := []limage.Parasite{
+		{Name: "gimp-comment", Flags: limage.ParasitePersistent, Data: []byte("A comment\x00")},
+		{Name: "custom-plugin", Data: []byte{0, 1, 2, 3}},
+	}
+	layerParasites := []limage.Parasite{
+		{Name: "custom-layer", Flags: limage.ParasitePersistent | limage.ParasiteUndoable, Data: []byte("data")},
+	}
+
+	im := Image{
+		Image: limage.Image{
+			limage.Layer{
+				Name:        "Text",
+				LayerBounds: image.Rect(0, 0, 20, 10),
+				Parasites:   layerParasites,
+				Image: limage.Text{
+					Image: singleColourImage{
+						Colour: color.NRGBA{A: 255},
+						Width:  20,
+						Height: 10,
+					},
+					TextData: limage.TextData{{Data: "Hello", Font: "Sans", Size: 10, ForeColor: color.Black}},
+				},
+			},
+			limage.Layer{
+				Name:        "Layer",
+				LayerBounds: image.Rect(0, 0, 20, 10),
+				Parasites:   layerParasites,
+				Image: singleColourImage{
+					Colour: color.NRGBA{R: 255, A: 255},
+					Width:  20,
+					Height: 10,
+				},
+			},
+		},
+		Metadata: Metadata{
+			Grid: &Grid{Style: "solid"},
+		},
+		Parasites: imageParasites,
+	}
+
+	var buf []byte
+
+	if err := Encode(memio.Create(&buf), im); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	d, err := DecodeImage(memio.Open(buf))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !reflect.DeepEqual(d.Parasites, imageParasites) {
+		t.Errorf("expecting image parasites %v, got %v", imageParasites, d.Parasites)
+	}
+
+	if d.Grid == nil {
+		t.Errorf("expecting grid to be decoded")
+	}
+
+	if len(d.Image) != 2 {
+		t.Fatalf("expecting 2 layers, got %d", len(d.Image))
+	}
+
+	for n, l := range d.Image {
+		if !reflect.DeepEqual(l.Parasites, layerParasites) {
+			t.Errorf("layer %d: expecting parasites %v, got %v", n+1, layerParasites, l.Parasites)
+		}
+	}
+
+	if _, ok := d.Image[0].Image.(limage.Text); !ok {
+		t.Errorf("expecting text layer, got %T", d.Image[0].Image)
+	}
+}
+
+// testICCProfile builds a matrix/TRC profile with the Adobe RGB (1998)
+// primaries and a gamma of 2.2.
+func TestGridColours(t *testing.T) {
+	escape := func(data []byte) string {
+		var sb strings.Builder
+
+		for _, b := range data {
+			if b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' {
+				sb.WriteByte(b)
+			} else {
+				fmt.Fprintf(&sb, "\\%o", b)
+			}
+		}
+
+		return sb.String()
+	}
+	floats := func(fs ...float32) string {
+		var data []byte
+
+		for _, f := range fs {
+			data = binary.LittleEndian.AppendUint32(data, math.Float32bits(f))
+		}
+
+		return fmt.Sprintf("%d \"%s\"", len(data), escape(data))
+	}
+
+	for n, test := range [...]struct {
+		Colour string
+		Output color.NRGBA64
+		Err    error
+	}{
+		{
+			Colour: "(color-rgba 1 0.5 0 0.25)",
+			Output: color.NRGBA64{R: 0xffff, G: 0x8000, A: 0x4000},
+		},
+		{
+			Colour: "(color-rgb 0 0 1)",
+			Output: color.NRGBA64{B: 0xffff, A: 0xffff},
+		},
+		{
+			Colour: "(color-rgb 0 0)",
+			Err:    ErrInvalidColour,
+		},
+		{
+			Colour: "(color \"R'G'B'A float\" " + floats(1, 0.5, 0, 0.25) + ")",
+			Output: color.NRGBA64{R: 0xffff, G: 0x8000, A: 0x4000},
+		},
+		{
+			Colour: "(color \"R'G'B' u8\" 3 \"" + escape([]byte{255, 'A', 0}) + "\")",
+			Output: color.NRGBA64{R: 0xffff, G: 0x4141, A: 0xffff},
+		},
+		{
+			Colour: "(color \"RGBA float\" " + floats(0.21404114, 0, 1, 1) + ")",
+			Output: color.NRGBA64{R: 0x8000, B: 0xffff, A: 0xffff},
+		},
+		{
+			Colour: "(color \"R'G'B'A float\" " + floats(1, 0.5, 0) + ")",
+			Err:    ErrInvalidColour,
+		},
+		{
+			Colour: "(color \"CIE Lab float\" " + floats(50, 0, 0) + ")",
+			Err:    ErrUnknownColourFormat,
+		},
+		{
+			Colour: "(color \"R'G'B'A float\" " + floats(1, 0.5, 0, 1) + " 4 \"abcd\")",
+			Err:    ErrUnknownColourFormat,
+		},
+		{
+			Colour: "(color-hsv 0 0 1)",
+			Err:    ErrUnknownColourFormat,
+		},
+	} {
+		g, err := parseGrid(&parasite{
+			name: gridParasiteName,
+			data: []byte("(style solid)\n(fgcolor " + test.Colour + ")\n"),
+		})
+		if !errors.Is(err, test.Err) {
+			t.Errorf("test %d: expecting error %v, got %v", n+1, test.Err, err)
+		} else if err == nil && !closeColours(g.Foreground, test.Output, 1) {
+			t.Errorf("test %d: expecting colour %v, got %v", n+1, test.Output, g.Foreground)
+		}
+	}
+
+	unparsed := limage.Parasite{
+		Name:  gridParasiteName,
+		Flags: limage.ParasitePersistent,
+		Data:  []byte("(style solid)\n(fgcolor (color-hsv 0 0 1))\n"),
+	}
+	im := Image{
+		Image: limage.Image{
+			limage.Layer{
+				Name: "Layer",
+				Image: singleColourImage{
+					Colour: color.NRGBA{A: 255},
+					Width:  20,
+					Height: 10,
+				},
+				LayerBounds: image.Rect(0, 0, 20, 10),
+			},
+		},
+		Parasites: []limage.Parasite{unparsed},
+	}
+
+	var buf []byte
+
+	if err := Encode(memio.Create(&buf), im); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	d, err := DecodeImage(memio.Open(buf))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if d.Grid != nil {
+		t.Errorf("expecting no grid, got %v", d.Grid)
+	}
+
+	if !reflect.DeepEqual(d.Parasites, im.Parasites) {
+		t.Errorf("expecting parasites %v, got %v", im.Parasites, d.Parasites)
+	}
+
+	im.Grid = &Grid{Style: "solid"}
+	buf = buf[:0]
+
+	if err := Encode(memio.Create(&buf), im); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if d, err = DecodeImage(memio.Open(buf)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if d.Grid == nil || d.Grid.Style != "solid" {
+		t.Errorf("expecting grid to replace the parasite, got %v", d.Grid)
+	}
+
+	if len(d.Parasites) != 0 {
+		t.Errorf("expecting no parasites, got %v", d.Parasites)
+	}
+}
+
+func testICCProfile() []byte {
+	const tags = 6
+
+	data := make([]byte, 128+4+tags*12, 128+4+tags*12+3*20+16)
+
+	copy(data[16:], "RGB XYZ ")
+	copy(data[36:], "acsp")
+	binary.BigEndian.PutUint32(data[128:], tags)
+
+	for n, c := range [...]struct {
+		name string
+		xyz  [3]float64
+	}{
+		{"r", [3]float64{0.6097559, 0.3111145, 0.0194702}},
+		{"g", [3]float64{0.2052401, 0.6256561, 0.0608902}},
+		{"b", [3]float64{0.1492240, 0.0632294, 0.7448387}},
+	} {
+		entry := data[132+n*24:]
+
+		copy(entry, c.name+"XYZ")
+		binary.BigEndian.PutUint32(entry[4:], uint32(len(data)))
+		binary.BigEndian.PutUint32(entry[8:], 20)
+
+		data = append(data, "XYZ \x00\x00\x00\x00"...)
+
+		for _, v := range c.xyz {
+			data = binary.BigEndian.AppendUint32(data, uint32(int32(v*0x10000)))
+		}
+	}
+
+	for n, c := range [...]string{"r", "g", "b"} {
+		entry := data[144+n*24:]
+
+		copy(entry, c+"TRC")
+		binary.BigEndian.PutUint32(entry[4:], uint32(len(data)))
+		binary.BigEndian.PutUint32(entry[8:], 14)
+	}
+
+	data = append(data, "curv\x00\x00\x00\x00\x00\x00\x00\x01\x02\x33\x00\x00"...)
+
+	binary.BigEndian.PutUint32(data, uint32(len(data)))
+
+	return data
+}
+
+func TestEncodeProfile(t *testing.T) {
+	profile, err := lcolor.ParseICCProfile(testICCProfile())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if !profile.Convertible() {
+		t.Fatalf("expecting convertible profile")
+	}
+
+	im := Image{
+		Image: limage.Image{
+			limage.Layer{
+				Name:        "Layer",
+				LayerBounds: image.Rect(0, 0, 20, 10),
+				Image: singleColourImage{
+					Colour: color.NRGBA{R: 255, A: 255},
+					Width:  20,
+					Height: 10,
+				},
+			},
+		},
+		Profile: profile,
+	}
+
+	var buf []byte
+
+	if err := Encode(memio.Create(&buf), im); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	d, err := DecodeImage(memio.Open(buf))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if d.Profile == nil {
+		t.Fatalf("expecting profile")
+	} else if !bytes.Equal(d.Profile.Data, profile.Data) {
+		t.Errorf("profile data does not match")
+	} else if len(d.Parasites) != 0 {
+		t.Errorf("expecting no parasites, got %d", len(d.Parasites))
+	}
+
+	for n, test := range [...]struct {
+		In, SRGB color.NRGBA64
+	}{
+		{
+			In:   color.NRGBA64{R: 0xffff, G: 0xffff, B: 0xffff, A: 0xffff},
+			SRGB: color.NRGBA64{R: 0xffff, G: 0xffff, B: 0xffff, A: 0xffff},
+		},
+		{
+			In:   color.NRGBA64{A: 0x8000},
+			SRGB: color.NRGBA64{A: 0x8000},
+		},
+		{
+			In:   color.NRGBA64{R: 0x90a5, G: 0xffff, B: 0x3bf0, A: 0xffff},
+			SRGB: color.NRGBA64{G: 0xffff, A: 0xffff},
+		},
+	} {
+		srgb := d.Profile.ToSRGB(test.In)
+
+		if !closeColours(srgb, test.SRGB, 0x200) {
+			t.Errorf("test %d: expecting sRGB colour %v, got %v", n+1, test.SRGB, srgb)
+		}
+
+		if back := d.Profile.FromSRGB(test.SRGB); !closeColours(back, test.In, 0x200) {
+			t.Errorf("test %d: expecting profile colour %v, got %v", n+1, test.In, back)
+		}
+	}
+
+	layer := limage.ProfiledImage{Image: d.Image, Profile: d.Profile}
+	expected := d.Profile.ToSRGB(d.Image.At(0, 0))
+
+	if c := color.NRGBA64Model.Convert(layer.At(0, 0)).(color.NRGBA64); c != expected {
+		t.Errorf("expecting profiled image to convert to sRGB, got %v", c)
+	}
+
+	if c := color.NRGBA64Model.Convert(d.At(0, 0)).(color.NRGBA64); c != expected {
+		t.Errorf("expecting composited image to convert to sRGB, got %v", c)
+	}
+
+	if c := d.Flatten().NRGBA64At(5, 5); c != expected {
+		t.Errorf("expecting flattened image to convert to sRGB, got %v", c)
+	}
+
+	dst := image.NewNRGBA(d.Bounds())
+
+	if err := d.RenderContext(context.Background(), dst, 2); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if c := dst.NRGBAAt(19, 9); c != color.NRGBAModel.Convert(expected) {
+		t.Errorf("expecting rendered image to convert to sRGB, got %v", c)
+	}
+}
+
+func closeColours(a, b color.NRGBA64, tolerance int) bool {
+	for _, d := range [...]int{
+		int(a.R) - int(b.R),
+		int(a.G) - int(b.G),
+		int(a.B) - int(b.B),
+		int(a.A) - int(b.A),
+	} {
+		if d < -tolerance || d > tolerance {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestEncodeCompositeSpaces(t *testing.T) {
+	for n, test := range [...]struct {
+		Mode           limage.Composite
+		NonLegacy      bool
+		CompositeMode  limage.CompositeMode
+		BlendSpace     limage.ColorSpace
+		CompositeSpace limage.ColorSpace
+		Top            color.NRGBA
+	}{
+		{
+			Mode: limage.CompositeMultiply,
+			Top:  color.NRGBA{R: 255, G: 64, A: 128},
+		},
+		{
+			Mode:       limage.CompositeMultiply,
+			BlendSpace: limage.ColorSpaceLinear,
+			Top:        color.NRGBA{R: 255, G: 64, A: 128},
+		},
+		{
+			Mode:           limage.CompositeScreen,
+			CompositeMode:  limage.CompositeModeUnion,
+			BlendSpace:     limage.ColorSpacePerceptual,
+			CompositeSpace: limage.ColorSpaceLinear,
+			Top:            color.NRGBA{B: 255, A: 200},
+		},
+		{
+			Mode:          limage.CompositeNormal,
+			CompositeMode: limage.CompositeModeClipToLayer,
+			Top:           color.NRGBA{},
+		},
+		{
+			Mode:          limage.CompositeNormal,
+			CompositeMode: limage.CompositeModeIntersection,
+			Top:           color.NRGBA{G: 255, A: 128},
+		},
+		{
+			Mode:      limage.CompositeNormal,
+			NonLegacy: true,
+			Top:       color.NRGBA{G: 255, A: 128},
+		},
+		{
+			Mode:      limage.CompositeMultiply,
+			NonLegacy: true,
+			Top:       color.NRGBA{R: 255, G: 64, A: 128},
+		},
+		{
+			Mode:       limage.CompositeSoftLight,
+			NonLegacy:  true,
+			BlendSpace: limage.ColorSpaceLinear,
+			Top:        color.NRGBA{R: 255, G: 64, A: 128},
+		},
+	} {
+		im := limage.Image{
+			limage.Layer{
+				Name:           "Top",
+				LayerBounds:    image.Rect(0, 0, 10, 10),
+				Mode:           test.Mode,
+				CompositeMode:  test.CompositeMode,
+				BlendSpace:     test.BlendSpace,
+				CompositeSpace: test.CompositeSpace,
+				NonLegacy:      test.NonLegacy,
+				Image: singleColourImage{
+					Colour: test.Top,
+					Width:  10,
+					Height: 10,
+				},
+			},
+			limage.Layer{
+				Name:        "Background",
+				LayerBounds: image.Rect(0, 0, 10, 10),
+				Image: singleColourImage{
+					Colour: color.NRGBA{R: 128, G: 128, B: 128, A: 255},
+					Width:  10,
+					Height: 10,
+				},
+			},
+		}
+
+		var buf []byte
+
+		if err := Encode(memio.Create(&buf), im); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		d, err := Decode(memio.Open(buf))
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		l := d[0]
+
+		if l.CompositeMode != test.CompositeMode || l.BlendSpace != test.BlendSpace || l.CompositeSpace != test.CompositeSpace {
+			t.Errorf("test %d: expecting composite settings %d, %d, %d, got %d, %d, %d", n+1, test.CompositeMode, test.BlendSpace, test.CompositeSpace, l.CompositeMode, l.BlendSpace, l.CompositeSpace)
+		} else if l.Mode != test.Mode || l.NonLegacy != test.NonLegacy {
+			t.Errorf("test %d: expecting mode %s (non-legacy %v), got %s (non-legacy %v)", n+1, test.Mode, test.NonLegacy, l.Mode, l.NonLegacy)
+		}
+
+		expected := color.NRGBA64Model.Convert(im.At(5, 5))
+		if got := color.NRGBA64Model.Convert(d.At(5, 5)); got != expected {
+			t.Errorf("test %d: expecting colour %v, got %v", n+1, expected, got)
+		}
+	}
+
+	bottom := color.NRGBA{R: 128, G: 128, B: 128, A: 255}
+	top := color.NRGBA{R: 255, G: 64, A: 128}
+
+	perceptual := limage.CompositeMultiply.Composite(bottom, top)
+	linear := limage.CompositeMultiply.CompositeWith(bottom, top, limage.CompositeModeAuto, limage.ColorSpaceLinear, limage.ColorSpaceLinear)
+
+	if color.NRGBA64Model.Convert(perceptual) == color.NRGBA64Model.Convert(linear) {
+		t.Errorf("expecting linear blending to differ from perceptual blending")
+	}
+
+	for _, b := range [...]color.NRGBA{bottom, {R: 128, G: 200, B: 32, A: 64}} {
+		for _, mode := range [...]limage.Composite{limage.CompositeNormal, limage.CompositeMultiply, limage.CompositeHue, limage.CompositeSoftLight} {
+			compositeMode := limage.CompositeModeClipToBackdrop
+			if mode == limage.CompositeNormal {
+				compositeMode = limage.CompositeModeUnion
+			}
+
+			auto := color.NRGBA64Model.Convert(mode.Composite(b, top))
+			explicit := color.NRGBA64Model.Convert(mode.CompositeWith(b, top, compositeMode, limage.ColorSpacePerceptual, limage.ColorSpacePerceptual))
+
+			if auto != explicit {
+				t.Errorf("mode %s: expecting automatic settings to match explicit settings, got %v and %v", mode, auto, explicit)
+			}
+		}
+	}
+
+	if _, _, _, a := limage.CompositeNormal.CompositeWith(bottom, color.NRGBA{}, limage.CompositeModeClipToLayer, limage.ColorSpaceAuto, limage.ColorSpaceAuto).RGBA(); a != 0 {
+		t.Errorf("expecting clip to layer to remove the backdrop, got alpha %d", a)
+	}
+
+	if _, _, _, a := limage.CompositeNormal.CompositeWith(bottom, color.NRGBA{}, limage.CompositeModeUnion, limage.ColorSpaceAuto, limage.ColorSpaceAuto).RGBA(); a != 0xffff {
+		t.Errorf("expecting union to keep the backdrop, got alpha %d", a)
+	}
+}
+
+func TestDecodeAutoSettings(t *testing.T) {
+	for n, test := range [...]struct {
+		Mode                                limage.Composite
+		NonLegacy                           bool
+		StoredMode, StoredBlend, StoredComp int32
+		CompositeMode                       limage.CompositeMode
+		BlendSpace, CompositeSpace          limage.ColorSpace
+	}{
+		{limage.CompositeNormal, true, -1, -1, -1, limage.CompositeModeAuto, limage.ColorSpaceAuto, limage.ColorSpaceAuto},
+		{limage.CompositeMultiply, true, -2, -1, -1, limage.CompositeModeAuto, limage.ColorSpaceAuto, limage.ColorSpaceAuto},
+		{limage.CompositeScreen, true, -2, -2, -1, limage.CompositeModeAuto, limage.ColorSpaceAuto, limage.ColorSpaceAuto},
+		{limage.CompositeLuminance, false, -2, -1, -1, limage.CompositeModeAuto, limage.ColorSpaceAuto, limage.ColorSpaceAuto},
+		{limage.CompositeChroma, false, -2, -3, -1, limage.CompositeModeAuto, limage.ColorSpaceAuto, limage.ColorSpaceAuto},
+		{limage.CompositeMultiply, false, -2, -2, -2, limage.CompositeModeAuto, limage.ColorSpaceAuto, limage.ColorSpaceAuto},
+		{limage.CompositeNormal, false, -1, -1, -1, limage.CompositeModeAuto, limage.ColorSpaceLinear, limage.ColorSpaceLinear},
+		{limage.CompositeNormal, true, -2, -2, -4, limage.CompositeModeClipToBackdrop, limage.ColorSpacePerceptual, limage.ColorSpacePerceptual},
+		{limage.CompositeNormal, true, 3, 2, 1, limage.CompositeModeClipToLayer, limage.ColorSpacePerceptual, limage.ColorSpaceLinear},
+		{limage.CompositeNormal, true, 0, 3, 0, limage.CompositeModeAuto, limage.ColorSpaceAuto, limage.ColorSpaceAuto},
+	} {
+		var buf []byte
+
+		if err := Encode(memio.Create(&buf), limage.Image{
+			limage.Layer{
+				Name:        "Layer",
+				LayerBounds: image.Rect(0, 0, 1, 1),
+				Mode:        test.Mode,
+				NonLegacy:   test.NonLegacy,
+				Image:       image.NewNRGBA(image.Rect(0, 0, 1, 1)),
+			},
+			limage.Layer{
+				Name:        "Background",
+				LayerBounds: image.Rect(0, 0, 1, 1),
+				Image:       image.NewNRGBA(image.Rect(0, 0, 1, 1)),
+			},
+		}, WithVersion(10)); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		var settings []byte
+
+		for _, prop := range [...]uint32{propCompositeMode, propCompositeSpace, propBlendSpace} {
+			settings = binary.BigEndian.AppendUint32(settings, prop)
+			settings = binary.BigEndian.AppendUint32(settings, 4)
+			settings = binary.BigEndian.AppendUint32(settings, 0)
+		}
+
+		pos := bytes.Index(buf, settings) // those of the first layer
+		if pos < 0 {
+			t.Errorf("test %d: composite settings not found", n+1)
+
+			continue
+		}
+
+		binary.BigEndian.PutUint32(buf[pos+8:], uint32(test.StoredMode))
+		binary.BigEndian.PutUint32(buf[pos+20:], uint32(test.StoredComp))
+		binary.BigEndian.PutUint32(buf[pos+32:], uint32(test.StoredBlend))
+
+		d, err := Decode(memio.Open(buf))
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		if l := d[0]; l.Mode != test.Mode || l.NonLegacy != test.NonLegacy {
+			t.Errorf("test %d: expecting mode %s (non-legacy %v), got %s (non-legacy %v)", n+1, test.Mode, test.NonLegacy, l.Mode, l.NonLegacy)
+		} else if l.CompositeMode != test.CompositeMode || l.BlendSpace != test.BlendSpace || l.CompositeSpace != test.CompositeSpace {
+			t.Errorf("test %d: expecting composite settings %d, %d, %d, got %d, %d, %d", n+1, test.CompositeMode, test.BlendSpace, test.CompositeSpace, l.CompositeMode, l.BlendSpace, l.CompositeSpace)
+		}
+	}
+}
+
+func TestEncodeLayerAttributes(t *testing.T) {
+	layer := func(name string) limage.Layer {
+		return limage.Layer{
+			Name:        name,
+			LayerBounds: image.Rect(0, 0, 10, 10),
+			Image: singleColourImage{
+				Colour: color.NRGBA{R: 255, A: 255},
+				Width:  10,
+				Height: 10,
+			},
+		}
+	}
+
+	locked := layer("Locked")
+	locked.Linked = true
+	locked.LockContent = true
+	locked.LockAlpha = true
+	locked.LockPosition = true
+	locked.LockVisibility = true
+	locked.ColorTag = limage.ColorTagOrange
+	locked.Tattoo = 5
+
+	tagged := layer("Tagged")
+	tagged.ColorTag = limage.ColorTagGray
+	tagged.Tattoo = 7
+
+	im := limage.Image{
+		limage.Layer{
+			Name:        "Expanded Group",
+			LayerBounds: image.Rect(0, 0, 10, 10),
+			Expanded:    true,
+			Tattoo:      1,
+			Image:       limage.Image{locked},
+		},
+		limage.Layer{
+			Name:         "Collapsed Group",
+			LayerBounds:  image.Rect(0, 0, 10, 10),
+			LockPosition: true,
+			Image:        limage.Image{tagged},
+		},
+		layer("Background"),
+	}
+
+	var buf []byte
+
+	if err := Encode(memio.Create(&buf), im); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	d, err := Decode(memio.Open(buf))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := compareLayers(d, im); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEncodeFloatingSelection(t *testing.T) {
+	layer := func(name string, bounds image.Rectangle) limage.Layer {
+		return limage.Layer{
+			Name:        name,
+			LayerBounds: bounds,
+			Image: singleColourImage{
+				Colour: color.NRGBA{R: 255, A: 255},
+				Width:  bounds.Dx(),
+				Height: bounds.Dy(),
+			},
+		}
+	}
+
+	masked := layer("Masked", image.Rect(0, 0, 20, 20))
+	masked.Image = limage.MaskedImage{
+		Image: masked.Image,
+		Mask:  image.NewGray(image.Rect(0, 0, 20, 20)),
+	}
+
+	layers := limage.Image{
+		limage.Layer{
+			Name:        "Group",
+			LayerBounds: image.Rect(0, 0, 20, 20),
+			Image:       limage.Image{masked},
+		},
+		layer("Background", image.Rect(0, 0, 20, 20)),
+	}
+
+	channels := []Channel{
+		{Name: "Channel", Image: image.NewGray(image.Rect(0, 0, 20, 20))},
+		{Name: "Other", Image: image.NewGray(image.Rect(0, 0, 20, 20))},
+	}
+
+	for n, test := range [...]struct {
+		Target           FloatingTarget
+		SelectedLayers   []LayerPath
+		SelectedChannels []int
+		Version          uint32
+		Err              error
+	}{
+		{
+			Target:           FloatingTarget{Layer: LayerPath{1}},
+			SelectedLayers:   []LayerPath{{0, 0}},
+			SelectedChannels: []int{0},
+		},
+		{
+			Target:           FloatingTarget{Layer: LayerPath{0, 0}, Mask: true},
+			SelectedLayers:   []LayerPath{{1}},
+			SelectedChannels: []int{1},
+			Version:          11,
+		},
+		{
+			Target: FloatingTarget{Channel: 0},
+		},
+		{
+			Target:           FloatingTarget{Channel: 1},
+			SelectedLayers:   []LayerPath{{0}, {0, 0}, {1}},
+			SelectedChannels: []int{0, 1},
+		},
+		{
+			Target:         FloatingTarget{Layer: LayerPath{1}},
+			SelectedLayers: []LayerPath{{0}, {1}},
+			Version:        13,
+			Err:            ErrVersionTooLow,
+		},
+		{
+			Target:           FloatingTarget{Layer: LayerPath{1}},
+			SelectedChannels: []int{0, 1},
+			Version:          13,
+			Err:              ErrVersionTooLow,
+		},
+		{
+			Target: FloatingTarget{Layer: LayerPath{1}, Mask: true},
+			Err:    ErrInvalidFloatingSelection,
+		},
+		{
+			Target: FloatingTarget{Layer: LayerPath{0, 1}},
+			Err:    ErrInvalidFloatingSelection,
+		},
+		{
+			Target: FloatingTarget{Channel: 2},
+			Err:    ErrInvalidFloatingSelection,
+		},
+	} {
+		var buf []byte
+
+		fs := &FloatingSelection{
+			Layer:  layer("Floating Selection", image.Rect(2, 3, 7, 9)),
+			Target: test.Target,
+		}
+
+		var opts []EncoderOption
+
+		if test.Version != 0 {
+			opts = append(opts, WithVersion(test.Version))
+		}
+
+		err := Encode(memio.Create(&buf), Image{
+			Image:             layers,
+			Channels:          channels,
+			SelectedLayers:    test.SelectedLayers,
+			SelectedChannels:  test.SelectedChannels,
+			FloatingSelection: fs,
+		}, opts...)
+		if !errors.Is(err, test.Err) {
+			t.Errorf("test %d: expecting error %v, got %v", n+1, test.Err, err)
+
+			continue
+		} else if err != nil {
+			continue
+		}
+
+		d, err := DecodeImage(memio.Open(buf))
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		if err := compareLayers(d.Image, layers); err != nil {
+			t.Errorf("test %d: %s", n+1, err)
+		}
+
+		if !reflect.DeepEqual(d.SelectedLayers, test.SelectedLayers) {
+			t.Errorf("test %d: expecting selected layers %v, got %v", n+1, test.SelectedLayers, d.SelectedLayers)
+		}
+
+		if len(d.Channels) != 2 {
+			t.Errorf("test %d: expecting 2 channels, got %d", n+1, len(d.Channels))
+		} else if !reflect.DeepEqual(d.SelectedChannels, test.SelectedChannels) {
+			t.Errorf("test %d: expecting selected channels %v, got %v", n+1, test.SelectedChannels, d.SelectedChannels)
+		}
+
+		if d.FloatingSelection == nil {
+			t.Errorf("test %d: expecting floating selection", n+1)
+		} else if !reflect.DeepEqual(d.FloatingSelection.Target, test.Target) {
+			t.Errorf("test %d: expecting target %v, got %v", n+1, test.Target, d.FloatingSelection.Target)
+		} else if d.FloatingSelection.Name != fs.Name || d.FloatingSelection.LayerBounds != fs.LayerBounds {
+			t.Errorf("test %d: expecting floating selection %q at %v, got %q at %v", n+1, fs.Name, fs.LayerBounds, d.FloatingSelection.Name, d.FloatingSelection.LayerBounds)
+		}
+	}
+}
+
+func TestEncodeMask(t *testing.T) {
+	mask := image.NewGray(image.Rect(0, 0, 10, 10))
+
+	for n := range mask.Pix {
+		mask.Pix[n] = 0x80
+	}
+
+	red := singleColourImage{
+		Colour: color.NRGBA{R: 255, A: 255},
+		Width:  10,
+		Height: 10,
+	}
+
+	im := limage.Image{
+		limage.Layer{
+			Name:        "Disabled",
+			LayerBounds: image.Rect(5, 5, 15, 15),
+			Image: limage.MaskedImage{
+				Image:            red,
+				Mask:             mask,
+				Disabled:         true,
+				ShowMask:         true,
+				MaskName:         "Disabled mask",
+				MaskColour:       lcolor.RGB{R: 1, G: 2, B: 3},
+				MaskTransparency: 64,
+			},
+		},
+		limage.Layer{
+			Name:        "Enabled",
+			LayerBounds: image.Rect(0, 0, 10, 10),
+			Image: limage.MaskedImage{
+				Image:    red,
+				Mask:     mask,
+				EditMask: true,
+				MaskName: "Enabled mask",
+			},
+		},
+		limage.Layer{
+			Name:        "Background",
+			LayerBounds: image.Rect(0, 0, 20, 20),
+			Image: singleColourImage{
+				Colour: color.NRGBA{B: 255, A: 255},
+				Width:  20,
+				Height: 20,
+			},
+		},
+	}
+
+	var buf []byte
+
+	if err := Encode(memio.Create(&buf), im); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	d, err := Decode(memio.Open(buf))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := compareLayers(d, im); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range [...]struct {
+		X, Y   int
+		Colour color.NRGBA
+	}{
+		{X: 12, Y: 12, Colour: color.NRGBA{R: 255, A: 255}},
+		{X: 2, Y: 2, Colour: color.NRGBA{R: 128, B: 127, A: 255}},
+		{X: 17, Y: 2, Colour: color.NRGBA{B: 255, A: 255}},
+	} {
+		if c := color.NRGBAModel.Convert(d.At(test.X, test.Y)).(color.NRGBA); c != test.Colour {
+			t.Errorf("at (%d, %d): expecting colour %v, got %v", test.X, test.Y, test.Colour, c)
+		}
+	}
+}
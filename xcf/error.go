@@ -0,0 +1,110 @@
+package xcf
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const noProperty = -1
+
+// DecodeError records where in an XCF file an error occurred while decoding.
+//
+// It wraps the underlying error, which is usually one of the errors of this
+// package, so errors.Is can be used to check for it.
+type DecodeError struct {
+	Err error
+
+	// Offset is the position in the file at which the error was detected.
+	Offset int64
+
+	// Layer is the index, in the order stored in the file, of the layer that
+	// was being read, or -1 when the error did not occur within a layer.
+	// LayerName is the name of that layer, when it had been read.
+	Layer     int
+	LayerName string
+
+	// Property is the ID of the property that was being read, or -1 when the
+	// error did not occur within a property.
+	Property int64
+}
+
+// Error implements the error interface.
+func (d *DecodeError) Error() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "%s at offset %d", d.Err, d.Offset)
+
+	if d.Layer >= 0 {
+		fmt.Fprintf(&sb, " in layer %d %q", d.Layer, d.LayerName)
+	}
+
+	if d.Property != noProperty {
+		fmt.Fprintf(&sb, " in property %d", d.Property)
+	}
+
+	return sb.String()
+}
+
+// Unwrap returns the underlying error.
+func (d *DecodeError) Unwrap() error {
+	return d.Err
+}
+
+// DecodeErrors is the error returned when more than one problem is found while
+// decoding, either because several layers, which are read concurrently, failed
+// to decode, or because the decoder is recovering from errors.
+//
+// errors.Is matches any of the errors, and errors.As finds the first that
+// matches.
+type DecodeErrors []*DecodeError
+
+// Error implements the error interface.
+func (d DecodeErrors) Error() string {
+	switch len(d) {
+	case 0:
+		return "no errors"
+	case 1:
+		return d[0].Error()
+	case 2:
+		return d[0].Error() + " (and 1 other error)"
+	default:
+		return fmt.Sprintf("%s (and %d other errors)", d[0], len(d)-1)
+	}
+}
+
+// Is returns true if any of the errors matches the target.
+func (d DecodeErrors) Is(target error) bool {
+	for _, e := range d {
+		if errors.Is(e, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// As finds the first of the errors that matches the target, setting the
+// target to that error and returning true.
+func (d DecodeErrors) As(target interface{}) bool {
+	for _, e := range d {
+		if errors.As(e, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// joinErrors returns nil when there are no errors, the only error when there
+// is one, and the errors as a DecodeErrors otherwise.
+func joinErrors(errs []*DecodeError) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+
+	return DecodeErrors(errs)
+}
@@ -23,4 +23,10 @@ var (
 
 	//go:embed testfiles/white.xcf
 	whiteFile string
+
+	//go:embed testfiles/v014.xcf
+	v014File string
+
+	//go:embed testfiles/v022.xcf
+	v022File string
 )
@@ -0,0 +1,221 @@
+package xcf
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"vimagination.zapto.org/limage"
+	"vimagination.zapto.org/limage/lcolor"
+)
+
+// Image represents a complete XCF image: its layers, as well as the
+// image-level data that is not part of any layer.
+type Image struct {
+	limage.Image
+	Metadata
+
+	// Profile is the ICC colour profile of the image, or nil when the image
+	// uses the built-in sRGB profile. The layers are not converted, but can be
+	// wrapped in a limage.ProfiledImage to use them as sRGB images.
+	//
+	// As in GIMP, the layers of the Image are composited in the colour space
+	// of the profile; when the profile is Convertible, the At, Render,
+	// RenderContext and Flatten methods of the Image then convert the
+	// composited colours to sRGB. Those of the embedded limage.Image do not.
+	Profile *lcolor.ICCProfile
+
+	Parasites []limage.Parasite
+	Channels  []Channel
+	Paths     []Path
+
+	// Selection is the saved selection mask, which is nil when there is no
+	// selection.
+	Selection *image.Gray
+
+	// SelectedLayers are the paths to the layers selected for editing.
+	// SelectedChannels and SelectedPaths are the indexes, in Channels and
+	// Paths, of the selected channels and paths.
+	//
+	// Files before version 14 can only select a single layer and channel, and
+	// a single path can be selected in all of the versions that can be
+	// encoded.
+	SelectedLayers   []LayerPath
+	SelectedChannels []int
+	SelectedPaths    []int
+
+	// FloatingSelection is the floating selection, which is nil when there is
+	// none. It is not one of the layers of the image.
+	FloatingSelection *FloatingSelection
+}
+
+// ColorModel returns the colour model of the composited image, which is
+// color.NRGBA64Model when the image has a Convertible profile.
+func (im Image) ColorModel() color.Model {
+	if im.Profile.Convertible() {
+		return color.NRGBA64Model
+	}
+
+	return im.Image.ColorModel()
+}
+
+// At returns the colour of the composited layers at the given coords,
+// converted to sRGB when the image has a Convertible profile.
+func (im Image) At(x, y int) color.Color {
+	if im.Profile.Convertible() {
+		return im.Profile.ToSRGB(im.Image.At(x, y))
+	}
+
+	return im.Image.At(x, y)
+}
+
+// Flatten composites the layers of the image, as At, into a new image with the
+// bounds of the image.
+func (im Image) Flatten() *image.NRGBA64 {
+	dst := image.NewNRGBA64(im.Bounds())
+
+	im.Render(dst)
+
+	return dst
+}
+
+// Render composites the layers of the image into dst, as limage.Image.Render,
+// converting the result to sRGB when the image has a Convertible profile.
+func (im Image) Render(dst draw.Image) {
+	if !im.Profile.Convertible() {
+		im.Image.Render(dst)
+
+		return
+	}
+
+	tmp := profileTarget(dst)
+
+	im.Image.Render(tmp)
+	im.toSRGB(tmp, dst)
+}
+
+// RenderContext composites the layers of the image into dst, as
+// limage.Image.RenderContext, converting the result to sRGB when the image has
+// a Convertible profile.
+func (im Image) RenderContext(ctx context.Context, dst draw.Image, workers int) error {
+	if !im.Profile.Convertible() {
+		return im.Image.RenderContext(ctx, dst, workers)
+	}
+
+	tmp := profileTarget(dst)
+
+	if err := im.Image.RenderContext(ctx, tmp, workers); err != nil {
+		return err
+	}
+
+	im.toSRGB(tmp, dst)
+
+	return nil
+}
+
+// profileTarget returns the image that the layers are composited into before
+// conversion, so that no precision is lost before the colours are converted.
+func profileTarget(dst draw.Image) *image.NRGBA64 {
+	if n, ok := dst.(*image.NRGBA64); ok {
+		return n
+	}
+
+	return image.NewNRGBA64(dst.Bounds())
+}
+
+func (im Image) toSRGB(src *image.NRGBA64, dst draw.Image) {
+	b := src.Bounds()
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			dst.Set(x, y, im.Profile.ToSRGB(src.NRGBA64At(x, y)))
+		}
+	}
+}
+
+// addPaths adds the paths read from an image property, selecting the path at
+// the active index.
+func (im *Image) addPaths(paths []Path, active uint32) {
+	if active < uint32(len(paths)) {
+		im.SelectedPaths = append(im.SelectedPaths, len(im.Paths)+int(active))
+	}
+
+	im.Paths = append(im.Paths, paths...)
+}
+
+// activePath returns the index of the first selected path, or zero when there
+// is none.
+func (im *Image) activePath() uint32 {
+	for _, p := range im.SelectedPaths {
+		if p >= 0 && p < len(im.Paths) {
+			return uint32(p)
+		}
+	}
+
+	return 0
+}
+
+// LayerPath identifies a layer by its index within each of the nested layer
+// groups containing it, starting with its index in the top-level image.
+type LayerPath []int
+
+func (l LayerPath) equalPath(m LayerPath) bool {
+	if len(l) != len(m) {
+		return false
+	}
+
+	for n, i := range l {
+		if i != m[n] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// selectedLayer returns true if the layer at the position given by groups is
+// one of the selected layers.
+func selectedLayer(selected []LayerPath, groups []uint32) bool {
+	for _, l := range selected {
+		if l.equal(groups) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (l LayerPath) equal(groups []uint32) bool {
+	if len(l) != len(groups) {
+		return false
+	}
+
+	for n, i := range l {
+		if uint32(i) != groups[n] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// FloatingSelection represents pasted content that has not yet been anchored
+// to the drawable it is attached to.
+//
+// The LayerBounds of the floating selection are relative to the image.
+type FloatingSelection struct {
+	limage.Layer
+	Target FloatingTarget
+}
+
+// FloatingTarget identifies the drawable a floating selection is attached to.
+//
+// Layer is the path of the layer the selection is attached to, and Mask is set
+// when it is attached to the mask of that layer. When Layer is nil, the
+// selection is attached to the channel with the index Channel.
+type FloatingTarget struct {
+	Layer   LayerPath
+	Mask    bool
+	Channel int
+}
@@ -1,29 +1,67 @@
 package xcf
 
 import (
+	"compress/zlib"
 	"image"
 	"image/color"
+	"image/draw"
 	"io"
 	"math"
 
+	"vimagination.zapto.org/byteio"
 	"vimagination.zapto.org/limage"
 	"vimagination.zapto.org/limage/lcolor"
 	"vimagination.zapto.org/memio"
 )
 
+type colourReader interface {
+	ReadColour(int, int, []byte)
+}
+
 func (d *decoder) ReadImage(width, height, mode uint32) image.Image {
+	if !d.AllocatePixels(width, height) {
+		return nil
+	}
+
+	bpp, tiles := d.readHierarchy(width, height, mode)
+	r := image.Rect(0, 0, int(width), int(height))
+
+	if tiles == nil {
+		if d.Recover() {
+			im, _ := d.newImage(mode, r)
+
+			return d.clearTiles(mode, im, []image.Rectangle{r})
+		}
+
+		return nil
+	}
+
+	if d.tiles == tilesLazy {
+		return d.newCompressedImage(mode, r, d.newLazyTiles(bpp, width, height, tiles))
+	}
+
+	if d.tiles == tilesDecompressed || d.compression == CompressionNone {
+		im, imReader := d.newImage(mode, r)
+
+		return d.clearTiles(mode, im, d.readAndDecompressImage(imReader, bpp, width, height, tiles))
+	}
+
+	return d.readCompressedImage(mode, r, bpp, width, height, tiles)
+}
+
+func (d *decoder) readHierarchy(width, height, mode uint32) (uint32, []uint64) {
 	twidth := d.ReadUint32()
 	theight := d.ReadUint32()
 
 	if twidth != width || theight != height {
 		d.SetError(ErrInconsistantData)
 
-		return nil
+		return 0, nil
 	}
 
 	bpp := d.ReadUint32()
 	if !d.validBPP(mode, bpp) {
-		return nil
+		return 0, nil
 	}
 
 	d.Goto(d.readLayerPointer())
@@ -31,58 +69,61 @@ func (d *decoder) ReadImage(width, height, mode uint32) image.Image {
 	if w, h := d.ReadUint32(), d.ReadUint32(); w != width || h != height {
 		d.SetError(ErrInconsistantData)
 
-		return nil
+		return 0, nil
 	}
 
 	tiles := d.readTiles(width, height)
 
-	if d.ReadUint32() != 0 {
+	if d.readLayerPointer() != 0 {
 		d.SetError(ErrInconsistantData)
-		return nil
-	}
-
-	r := image.Rect(0, 0, int(width), int(height))
 
-	if d.decompress || d.compression == 0 {
-		return d.readAndDecompressImage(mode, r, bpp, width, height, tiles)
+		return 0, nil
 	}
 
-	return d.readCompressedImage(mode, r, bpp, width, height, tiles)
+	return bpp, tiles
 }
 
 func (d *decoder) validBPP(mode, bpp uint32) bool {
+	var channels uint32
+
 	switch mode {
-	case 2, 4:
+	case 2:
+		channels = 1
+	case 3:
+		channels = 2
+	case 0:
+		channels = 3
+	case 1:
+		channels = 4
+	case 4:
 		if bpp != 1 {
 			d.SetError(ErrInconsistantData)
 
 			return false
 		}
-	case 3, 5:
+
+		return true
+	case 5:
 		if bpp != 2 {
 			d.SetError(ErrInconsistantData)
 
 			return false
 		}
-	case 0:
-		if bpp != 3 {
-			d.SetError(ErrInconsistantData)
 
-			return false
-		}
-	case 1:
-		if bpp != 4 {
-			d.SetError(ErrInconsistantData)
+		return true
+	}
 
-			return false
-		}
+	if bpp != channels*uint32(d.precision.bytes()) {
+		d.SetError(ErrInconsistantData)
+
+		return false
 	}
 
 	return true
 }
 
 func (d *decoder) readLayerPointer() uint64 {
-	if d.mode < 2 {
+	if d.version < 11 {
 		return uint64(d.ReadUint32())
 	}
 
@@ -92,7 +133,7 @@ func (d *decoder) readLayerPointer() uint64 {
 func (d *decoder) readTiles(width, height uint32) []uint64 {
 	tiles := make([]uint64, int(math.Ceil(float64(width)/64)*math.Ceil(float64(height)/64)))
 
-	if d.mode < 2 {
+	if d.version < 11 {
 		for i := range tiles {
 			tiles[i] = uint64(d.ReadUint32())
 		}
@@ -105,53 +146,101 @@ func (d *decoder) readTiles(width, height uint32) []uint64 {
 	return tiles
 }
 
-func (d *decoder) readAndDecompressImage(mode uint32, r image.Rectangle, bpp, width, height uint32, tiles []uint64) image.Image {
-	var pixBuffer [64 * 64 * 4]byte
+// colorModel returns the colour model of the images of the given mode that are
+// returned by ReadImage, without reading them.
+func (d *decoder) colorModel(mode uint32) color.Model {
+	if d.precision.deep() {
+		switch mode {
+		case 0: // rgb
+			return lcolor.RGB48Model
+		case 1: // rgba
+			return color.NRGBA64Model
+		case 2: // gray
+			return color.Gray16Model
+		case 3: // gray + alpha
+			return lcolor.GrayAlpha32Model
+		}
+	}
 
-	var (
-		im       image.Image
-		imReader interface {
-			ReadColour(int, int, []byte)
+	switch mode {
+	case 0: // rgb
+		return lcolor.RGBModel
+	case 1: // rgba
+		return color.NRGBAModel
+	case 2: // gray
+		return color.GrayModel
+	case 3: // gray + alpha
+		return lcolor.GrayAlphaModel
+	case 4: // indexed
+		return color.Palette(d.palette)
+	case 5: // indexed + alpha
+		return d.palette
+	default:
+		return color.NRGBAModel
+	}
+}
+
+func (d *decoder) newImage(mode uint32, r image.Rectangle) (image.Image, colourReader) {
+	if d.precision.deep() {
+		cf := newComponentFormat(d.precision, d.version)
+
+		switch mode {
+		case 0: // rgb
+			rgb := limage.NewRGB48(r)
+
+			return rgb, rgb48ImageReader{rgb, cf}
+		case 1: // rgba
+			rgba := image.NewNRGBA64(r)
+
+			return rgba, nrgba64ImageReader{rgba, cf}
+		case 2: // gray
+			g := image.NewGray16(r)
+
+			return g, gray16ImageReader{g, cf}
+		case 3: // gray + alpha
+			ga := limage.NewGrayAlpha32(r)
+
+			return ga, grayAlpha32ImageReader{ga, cf}
 		}
-	)
+	}
 
 	switch mode {
 	case 0: // rgb
 		rgb := limage.NewRGB(r)
-		im = rgb
-		imReader = rgbImageReader{rgb}
+
+		return rgb, rgbImageReader{rgb}
 	case 1: // rgba
 		rgba := image.NewNRGBA(r)
-		im = rgba
-		imReader = rgbaImageReader{rgba}
+
+		return rgba, rgbaImageReader{rgba}
 	case 2: // gray
 		g := image.NewGray(r)
-		im = g
-		imReader = grayImageReader{g}
+
+		return g, grayImageReader{g}
 	case 3: // gray + alpha
 		ga := limage.NewGrayAlpha(r)
-		im = ga
-		imReader = grayAlphaImageReader{ga}
+
+		return ga, grayAlphaImageReader{ga}
 	case 4: // indexed
 		in := image.NewPaletted(r, color.Palette(d.palette))
-		im = in
-		imReader = indexedImageReader{in}
+
+		return in, indexedImageReader{in}
 	case 5: // indexed + alpha
 		in := limage.NewPalettedAlpha(r, d.palette)
-		im = in
-		imReader = palettedAlphaReader{in}
+
+		return in, palettedAlphaReader{in}
 	}
 
-	var cr io.Reader
+	return nil, nil
+}
 
-	if d.compression == 0 { // no compression
-		cr = &d.reader
-	} else { // rle
-		cr = &rle{Reader: d.reader.StickyBigEndianReader}
-	}
+// readAndDecompressImage reads the tiles of an image into imReader, returning
+// the areas of the tiles that could not be read when recovering.
+func (d *decoder) readAndDecompressImage(imReader colourReader, bpp, width, height uint32, tiles []uint64) []image.Rectangle {
+	var damaged []image.Rectangle
 
-	pixel := make([]byte, bpp)
-	channels := make([][]byte, bpp)
+	pixBuffer := make([]byte, 64*64*bpp)
+	planes := make([]byte, 64*64*bpp)
 
 	for y := uint32(0); y < height; y += 64 {
 		for x := uint32(0); x < width; x += 64 {
@@ -168,36 +257,142 @@ func (d *decoder) readAndDecompressImage(mode uint32, r image.Rectangle, bpp, wi
 				h = 64
 			}
 
-			n := w * h
-			_, err := cr.Read(pixBuffer[:n*bpp])
+			pixels := pixBuffer[:w*h*bpp]
 
-			d.SetError(err)
+			if d.SetError(readTile(d.reader.StickyBigEndianReader, d.compression, pixels, planes[:len(pixels)], int(bpp))); d.Recover() {
+				damaged = append(damaged, image.Rect(int(x), int(y), int(x+w), int(y+h)))
 
-			for i := uint32(0); i < bpp; i++ {
-				channels[i] = pixBuffer[n*i : n*(i+1)]
+				continue // leave the tile empty
 			}
 
 			for j := uint32(0); j < h; j++ {
 				for i := uint32(0); i < w; i++ {
-					for k := uint32(0); k < bpp; k++ {
-						pixel[k] = channels[k][0]
-						channels[k] = channels[k][1:]
-					}
+					imReader.ReadColour(int(x+i), int(y+j), pixels[:bpp])
 
-					imReader.ReadColour(int(x+i), int(y+j), pixel)
+					pixels = pixels[bpp:]
 				}
 			}
 		}
 	}
 
-	return im
+	return damaged
+}
+
+// clearTiles makes the tiles of an image that could not be read transparent.
+//
+// The empty tiles of an image with an alpha channel are already transparent,
+// so only an image without one, in which they would be opaque, is replaced by
+// a copy that has an alpha channel.
+func (d *decoder) clearTiles(mode uint32, im image.Image, damaged []image.Rectangle) image.Image {
+	var alphaMode uint32
+
+	switch mode {
+	case 0: // rgb
+		alphaMode = 1
+	case 2: // gray
+		alphaMode = 3
+	case 4: // indexed
+		alphaMode = 5
+	default:
+		return im
+	}
+
+	if len(damaged) == 0 {
+		return im
+	}
+
+	b := im.Bounds()
+	a, _ := d.newImage(alphaMode, b)
+	dst := a.(draw.Image)
+
+	if p, ok := im.(*image.Paletted); ok {
+		pa := dst.(*limage.PalettedAlpha)
+
+		for n, i := range p.Pix {
+			pa.Pix[n] = lcolor.IndexedAlpha{I: i, A: 0xff}
+		}
+	} else {
+		draw.Draw(dst, b, im, b.Min, draw.Src)
+	}
+
+	for _, r := range damaged {
+		draw.Draw(dst, r, image.Transparent, image.Point{}, draw.Src)
+	}
+
+	return dst
+}
+
+// readTile reads a single tile, storing the pixels, each of bpp bytes, in
+// order into dst.
+//
+// RLE data is stored as a plane for each byte of a pixel, so it is read into
+// planes before being interleaved into dst.
+func readTile(r *byteio.StickyBigEndianReader, compression Compression, dst, planes []byte, bpp int) error {
+	switch compression {
+	case CompressionNone:
+		_, err := io.ReadFull(r, dst)
+
+		return err
+	case CompressionZlib:
+		zr, err := zlib.NewReader(r.Reader)
+		if err != nil {
+			return err
+		}
+
+		if _, err = io.ReadFull(zr, dst); err != nil {
+			return err
+		}
+
+		return zr.Close()
+	default: // rle
+		if _, err := io.ReadFull(&rle{Reader: r}, planes); err != nil {
+			return err
+		}
+	}
+
+	n := len(dst) / bpp
+
+	for k := 0; k < bpp; k++ {
+		for i, b := range planes[n*k : n*(k+1)] {
+			dst[i*bpp+k] = b
+		}
+	}
+
+	return nil
+}
+
+// newLazyTiles returns the data of an image that is read from the file as it
+// is needed.
+func (d *decoder) newLazyTiles(bpp, width, height uint32, tiles []uint64) compressedImage {
+	return compressedImage{
+		width:       int(width),
+		height:      int(height),
+		bpp:         int(bpp),
+		compression: d.compression,
+		tile:        -1,
+		lazy:        &lazyTiles{r: d.rs, offsets: tiles, cache: d.tileCache},
+	}
 }
 
 func (d *decoder) readCompressedImage(mode uint32, r image.Rectangle, bpp, width, height uint32, tiles []uint64) image.Image {
+	ci, damaged := d.readCompressedTiles(bpp, width, height, tiles)
+
+	return d.clearTiles(mode, d.newCompressedImage(mode, r, ci), damaged)
+}
+
+// readCompressedTiles reads the tiles of an image without decompressing them,
+// also returning the areas of the tiles that could not be read when
+// recovering.
+func (d *decoder) readCompressedTiles(bpp, width, height uint32, tiles []uint64) (compressedImage, []image.Rectangle) {
+	var damaged []image.Rectangle
+
 	ci := compressedImage{
-		tiles: make([][][]byte, 0, len(tiles)),
-		width: int(width),
-		tile:  -1,
+		tiles:       make([][]byte, 0, len(tiles)),
+		width:       int(width),
+		height:      int(height),
+		bpp:         int(bpp),
+		compression: d.compression,
+		tile:        -1,
 	}
 
 	buf := make(memio.Buffer, 0, 64*64*4)
@@ -218,21 +413,47 @@ func (d *decoder) readCompressedImage(mode uint32, r image.Rectangle, bpp, width
 				h = 64
 			}
 
-			n := w * h
-			ts := make([][]byte, 0, bpp)
+			if d.compression == CompressionZlib {
+				d.SetError(d.readZlib(&buf))
+			} else {
+				n := w * h
 
-			for i := uint32(0); i < bpp; i++ {
-				d.SetError(d.readRLE(int(n), &buf))
+				for i := uint32(0); i < bpp; i++ {
+					d.SetError(d.readRLE(int(n), &buf))
+				}
+			}
 
-				b := make([]byte, len(buf))
+			var b []byte
 
-				copy(b, buf)
+			if d.Recover() { // an unreadable tile is left empty
+				damaged = append(damaged, image.Rect(int(x), int(y), int(x+w), int(y+h)))
+			} else {
+				b = make([]byte, len(buf))
 
-				buf = buf[:0]
-				ts = append(ts, b)
+				copy(b, buf)
 			}
 
-			ci.tiles = append(ci.tiles, ts)
+			buf = buf[:0]
+			ci.tiles = append(ci.tiles, b)
+		}
+	}
+
+	return ci, damaged
+}
+
+func (d *decoder) newCompressedImage(mode uint32, r image.Rectangle, ci compressedImage) image.Image {
+	if d.precision.deep() {
+		cf := newComponentFormat(d.precision, d.version)
+
+		switch mode {
+		case 0: // rgb
+			return &CompressedRGB48{ci, r, cf}
+		case 1: // rgba
+			return &CompressedNRGBA64{ci, r, cf}
+		case 2: // gray
+			return &CompressedGray16{ci, r, cf}
+		case 3: // gray + alpha
+			return &CompressedGrayAlpha32{ci, r, cf}
 		}
 	}
 
@@ -254,12 +475,6 @@ func (d *decoder) readCompressedImage(mode uint32, r image.Rectangle, bpp, width
 	}
 }
 
-/*
-type colourReader interface {
-	ReadByte() byte
-}
-*/
-
 type rgbaImageReader struct {
 	*image.NRGBA
 }
@@ -315,3 +530,57 @@ type rgbImageReader struct {
 func (rg rgbImageReader) ReadColour(x, y int, pixels []byte) {
 	rg.SetRGB(x, y, lcolor.RGB{R: pixels[0], G: pixels[1], B: pixels[2]})
 }
+
+type nrgba64ImageReader struct {
+	*image.NRGBA64
+	componentFormat
+}
+
+func (rgba nrgba64ImageReader) ReadColour(x, y int, pixel []byte) {
+	rgba.SetNRGBA64(x, y, rgba.nrgba64(pixel))
+}
+
+type gray16ImageReader struct {
+	*image.Gray16
+	componentFormat
+}
+
+func (g gray16ImageReader) ReadColour(x, y int, pixel []byte) {
+	g.SetGray16(x, y, color.Gray16{g.read(pixel, true)})
+}
+
+type grayAlpha32ImageReader struct {
+	*limage.GrayAlpha32
+	componentFormat
+}
+
+func (ga grayAlpha32ImageReader) ReadColour(x, y int, pixel []byte) {
+	ga.SetGrayAlpha32(x, y, ga.grayAlpha32(pixel))
+}
+
+type rgb48ImageReader struct {
+	*limage.RGB48
+	componentFormat
+}
+
+func (rg rgb48ImageReader) ReadColour(x, y int, pixel []byte) {
+	rg.SetRGB48(x, y, rg.rgb48(pixel))
+}
+
+type channelImageReader struct {
+	*image.Gray
+	componentFormat
+}
+
+func (c channelImageReader) ReadColour(x, y int, pixel []byte) {
+	c.SetGray(x, y, color.Gray{uint8(c.read(pixel, false) >> 8)})
+}
+
+type channel16ImageReader struct {
+	*image.Gray16
+	componentFormat
+}
+
+func (c channel16ImageReader) ReadColour(x, y int, pixel []byte) {
+	c.SetGray16(x, y, color.Gray16{c.read(pixel, false)})
+}
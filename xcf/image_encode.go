@@ -7,7 +7,7 @@ import (
 	"vimagination.zapto.org/limage/lcolor"
 )
 
-func (e *encoder) WriteImage(im image.Image, colourFunc colourBufFunc, colourChannels uint8) {
+func (e *encoder) WriteImage(im image.Image, colourFunc colourBufFunc, bpp uint8) {
 	bounds := im.Bounds()
 
 	dx := int64(bounds.Dx())
@@ -17,10 +17,10 @@ func (e *encoder) WriteImage(im image.Image, colourFunc colourBufFunc, colourCha
 
 	e.WriteUint32(uint32(dx))
 	e.WriteUint32(uint32(dy))
-	e.WriteUint32(uint32(colourChannels))
+	e.WriteUint32(uint32(bpp))
 
-	e.WriteUint32(uint32(e.pos) + 8) // currPos + this pointer (4) + zero pointer (4)
-	e.WriteUint32(0)
+	e.WritePointer(e.pos + 2*e.pointerSize()) // currPos + this pointer + zero pointer
+	e.WritePointer(0)
 
 	// Level
 
@@ -50,7 +50,7 @@ func (e *encoder) WriteImage(im image.Image, colourFunc colourBufFunc, colourCha
 				for i := x; i < x+64 && i < bounds.Max.X; i++ {
 					colourFunc(e, im.At(i, j))
 
-					for n := uint8(0); n < colourChannels; n++ {
+					for n := uint8(0); n < bpp; n++ {
 						e.channelBuf[n][l] = e.colourBuf[n]
 					}
 
@@ -58,13 +58,38 @@ func (e *encoder) WriteImage(im image.Image, colourFunc colourBufFunc, colourCha
 				}
 			}
 
-			w.WritePointer(uint32(e.pos))
+			w.WritePointer(e.pos)
+			e.writeTile(int(l), int(bpp))
+		}
+	}
+}
 
-			for n := uint8(0); n < colourChannels; n++ {
-				e.WriteRLE(e.channelBuf[n][:l])
-			}
+func (e *encoder) writeTile(l, bpp int) {
+	if e.compression == CompressionRLE {
+		for n := 0; n < bpp; n++ {
+			e.WriteRLE(e.channelBuf[n][:l])
+		}
+
+		return
+	}
+
+	tile := e.tileBuf[:l*bpp]
+
+	for n := 0; n < bpp; n++ {
+		for i, b := range e.channelBuf[n][:l] {
+			tile[i*bpp+n] = b
 		}
 	}
+
+	if e.compression == CompressionNone {
+		e.Write(tile)
+
+		return
+	}
+
+	e.zlib.Reset(e.StickyBigEndianWriter)
+	e.zlib.Write(tile)
+	e.zlib.Close()
 }
 
 func (e *encoder) rgbAlphaToBuf(c color.Color) {
@@ -82,7 +107,24 @@ func (e *encoder) grayAlphaToBuf(c color.Color) {
 }
 
 func (e *encoder) grayToBuf(c color.Color) {
-	e.colourBuf[0] = color.GrayModel.Convert(c).(color.Gray).Y
+	e.components.write(e.colourBuf[:], color.Gray16Model.Convert(c).(color.Gray16).Y, false)
+}
+
+func (e *encoder) rgbAlphaToDeepBuf(c color.Color) {
+	rgba := color.NRGBA64Model.Convert(c).(color.NRGBA64)
+	s := e.precision.bytes()
+
+	e.components.write(e.colourBuf[:], rgba.R, true)
+	e.components.write(e.colourBuf[s:], rgba.G, true)
+	e.components.write(e.colourBuf[2*s:], rgba.B, true)
+	e.components.write(e.colourBuf[3*s:], rgba.A, false)
+}
+
+func (e *encoder) grayAlphaToDeepBuf(c color.Color) {
+	ga := lcolor.GrayAlpha32Model.Convert(c).(lcolor.GrayAlpha32)
+
+	e.components.write(e.colourBuf[:], ga.Y, true)
+	e.components.write(e.colourBuf[e.precision.bytes():], ga.A, false)
 }
 
 func (e *encoder) paletteAlphaToBuf(c color.Color) {
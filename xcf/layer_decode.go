@@ -3,6 +3,7 @@ package xcf
 import (
 	"errors"
 	"image"
+	"math"
 
 	"vimagination.zapto.org/limage"
 )
@@ -11,65 +12,100 @@ type layer struct {
 	limage.Layer
 	alpha    bool
 	group    bool
+	active   bool
 	itemPath []rune
+	floating uint64 // pointer to the drawable a floating selection is attached to
+	typ      uint32
+	hptr     uint64
+	maskPtr  uint64
+	text     limage.TextData
+
+	maskDisabled, maskEdit, maskShow bool
+
+	// the settings that GIMP resolved the automatic composite settings to
+	autoMode                 limage.CompositeMode
+	autoBlend, autoComposite limage.ColorSpace
+
+	index  int    // position in the layer list of the file
+	ptr    uint64 // offset of the layer in the file
+	failed bool   // set in recovery mode when the layer could not be read
 }
 
 func (d *decoder) ReadLayer() layer {
 	var l layer
 
-	l.LayerBounds.Max.X = int(d.ReadUint32())
-	l.LayerBounds.Max.Y = int(d.ReadUint32())
-	typ := d.ReadUint32()
+	width := d.ReadUint32()
+	height := d.ReadUint32()
 
-	if typ>>1 != d.baseType {
+	if !d.CheckDimensions(width, height) {
+		return l
+	}
+
+	l.LayerBounds.Max.X = int(width)
+	l.LayerBounds.Max.Y = int(height)
+	l.typ = d.ReadUint32()
+
+	if l.typ>>1 != d.baseType {
 		d.SetError(ErrInvalidLayerType)
 
 		return l
 	}
 
-	l.alpha = typ&1 == 1
+	l.alpha = l.typ&1 == 1
 	l.Name = d.ReadString()
 
 	parasites := l.readProperties(d)
+	l.Parasites = parasites.Export()
 
-	var hptr, mptr uint64
-
-	if d.mode < 2 {
-		hptr = uint64(d.ReadUint32())
-		mptr = uint64(d.ReadUint32())
+	if d.version < 11 {
+		l.hptr = uint64(d.ReadUint32())
+		l.maskPtr = uint64(d.ReadUint32())
 	} else {
-		hptr = d.ReadUint64()
-		mptr = d.ReadUint64()
+		l.hptr = d.ReadUint64()
+		l.maskPtr = d.ReadUint64()
 	}
 
-	d.Goto(hptr)
-	// read hierarchy
+	// GIMP 3 files may follow these with pointers to non-destructive filter
+	// (layer effect) blocks, which are skipped; the hierarchy always holds the
+	// unfiltered pixel data.
 
-	if !l.group { // skip reading image if its a group
-		if l.Image = d.ReadImage(uint32(l.LayerBounds.Dx()), uint32(l.LayerBounds.Dy()), typ); l.Image == nil {
+	if t := parasites.Get(textParasiteName); t != nil {
+		if textData, err := parseTextData(t); err == nil {
+			l.text = textData
+		} else if d.SetError(ErrInvalidLayerType); !d.Recover() {
 			return l
 		}
 	}
-	if t := parasites.Get(textParasiteName); t != nil {
-		textData, err := parseTextData(t)
-		if err != nil {
-			d.SetError(ErrInvalidLayerType)
 
-			return l
+	if d.selector == nil || l.floating != 0 {
+		l.readPixels(d)
+	}
+
+	return l
+}
+
+// readPixels reads the image data and mask of the layer.
+func (l *layer) readPixels(d *decoder) {
+	d.Goto(l.hptr)
+
+	if !l.group { // skip reading image if its a group
+		if l.Image = d.ReadImage(uint32(l.LayerBounds.Dx()), uint32(l.LayerBounds.Dy()), l.typ); l.Image == nil {
+			return
 		}
+	}
 
+	if l.text != nil {
 		l.Image = limage.Text{
 			Image:    l.Image,
-			TextData: textData,
+			TextData: l.text,
 		}
 	}
 
-	if mptr != 0 { // read layer mask
-		d.Goto(mptr)
+	if l.maskPtr != 0 { // read layer mask
+		d.Goto(l.maskPtr)
 		l.readMask(d)
+		d.Recover() // the layer is kept without its mask
 	}
-
-	return l
 }
 
 func (l *layer) readProperties(d *decoder) parasites {
@@ -77,8 +113,8 @@ func (l *layer) readProperties(d *decoder) parasites {
 
 PropertyLoop:
 	for {
-		typ := d.ReadUint32()
-		plength := d.ReadUint32()
+		typ, plength := d.ReadProperty()
+		end := d.Pos() + int64(plength)
 
 		switch typ {
 		// general properties
@@ -89,71 +125,110 @@ PropertyLoop:
 
 			break PropertyLoop
 		case propLinked:
-			d.SkipBoolProperty()
+			l.Linked = d.ReadBoolProperty()
 		case propLockContent:
-			d.SkipBoolProperty()
+			l.LockContent = d.ReadBoolProperty()
 		case propOpacity:
 			o := d.ReadUint32()
 			if o > 255 {
 				d.SetError(ErrInvalidOpacity)
+			} else {
+				l.Transparency = 255 - uint8(o)
 			}
-
-			l.Transparency = 255 - uint8(o)
 		case propParasites:
-			parasites = d.ReadParasites(plength)
+			parasites = append(parasites, d.ReadParasites(plength)...)
 		case propTattoo:
-			d.SkipUint32()
+			l.Tattoo = d.ReadUint32()
 		case propVisible:
 			l.Invisible = !d.ReadBoolProperty()
 
 		// layer properties
 		case propActiveLayer:
-			// active layer
+			l.active = true
 		case propApplyMask:
-			d.SkipBoolProperty()
+			l.maskDisabled = !d.ReadBoolProperty()
 		case propEditMask:
-			d.SkipBoolProperty()
+			l.maskEdit = d.ReadBoolProperty()
 		case propFloatingSelection:
-			d.SkipUint32()
+			l.floating = d.readLayerPointer()
 		case propGroupItem:
 			l.group = true
 		case propItemPath:
 			l.readItemPath(d, plength)
 		case propGroupItemFlags:
-			d.SkipUint32()
+			l.Expanded = d.ReadUint32()&groupItemExpanded != 0
 		case propLockAlpha:
-			d.SkipBoolProperty()
+			l.LockAlpha = d.ReadBoolProperty()
+		case propLockPosition:
+			l.LockPosition = d.ReadBoolProperty()
+		case propLockVisibility:
+			l.LockVisibility = d.ReadBoolProperty()
+		case propColorTag:
+			if t := d.ReadUint32(); t <= uint32(limage.ColorTagGray) {
+				l.ColorTag = limage.ColorTag(t)
+			}
 		case propMode:
+			id := d.ReadUint32()
+
 			if d.baseType != 0 {
-				switch d.ReadUint32() {
-				case 2: // Behind
+				switch id {
+				case 2, 29: // Behind
 					l.Mode = limage.CompositeBehind
 				default:
 					l.Mode = limage.CompositeNormal
 				}
 			} else {
-				l.readMode(d)
+				l.readMode(id)
 			}
+
+			l.NonLegacy = id >= 23 && modeID(l.Mode, false) < 23
 		case propOffsets:
 			offsetX := int(d.ReadInt32())
 			offsetY := int(d.ReadInt32())
 			l.LayerBounds = l.LayerBounds.Add(image.Pt(offsetX, offsetY))
 		case propShowMask:
-			d.SkipBoolProperty()
+			l.maskShow = d.ReadBoolProperty()
 		case propTextLayerFlags:
 			d.SkipUint32()
 		case propFloatOpacity:
-			l.Transparency = 255 - uint8(d.ReadFloat32()*255)
+			o := d.ReadFloat32()
+			if !(o >= 0 && o <= 1) {
+				d.SetError(ErrInvalidOpacity)
+			} else {
+				l.Transparency = 255 - uint8(math.Round(float64(o)*255))
+			}
+		case propCompositeMode:
+			if m := d.ReadInt32(); m < 0 {
+				l.autoMode = compositeMode(-m)
+			} else {
+				l.CompositeMode = compositeMode(m)
+			}
+		case propCompositeSpace:
+			if s := d.ReadInt32(); s < 0 {
+				l.autoComposite = colorSpace(-s)
+			} else {
+				l.CompositeSpace = colorSpace(s)
+			}
+		case propBlendSpace:
+			if s := d.ReadInt32(); s < 0 {
+				l.autoBlend = colorSpace(-s)
+			} else {
+				l.BlendSpace = colorSpace(s)
+			}
 		default:
 			d.Skip(plength)
 		}
+
+		d.RecoverProperty(end)
 	}
 
+	l.resolveAuto()
+
 	return parasites
 }
 
-func (l *layer) readMode(d *decoder) {
-	switch d.ReadUint32() {
+func (l *layer) readMode(id uint32) {
+	switch id {
 	case 0, 28:
 		l.Mode = limage.CompositeNormal
 	case 1:
@@ -231,11 +306,61 @@ func (l *layer) readMode(d *decoder) {
 	}
 }
 
+// resolveAuto handles the automatic composite settings, which GIMP stores as
+// the negation of the setting that the layer mode resolves to.
+//
+// They are kept as automatic, so that they remain so when the image is
+// encoded, unless they resolve to a different setting here, in which case the
+// setting that GIMP resolved them to is used, so that the layer is composited
+// as it would be in GIMP.
+func (l *layer) resolveAuto() {
+	mode, blendSpace, compositeSpace := l.CompositeSettings()
+
+	if l.autoMode != limage.CompositeModeAuto && l.autoMode != mode {
+		l.CompositeMode = l.autoMode
+	}
+
+	if l.autoBlend != limage.ColorSpaceAuto && l.autoBlend != blendSpace {
+		l.BlendSpace = l.autoBlend
+	}
+
+	if l.autoComposite != limage.ColorSpaceAuto && l.autoComposite != compositeSpace {
+		l.CompositeSpace = l.autoComposite
+	}
+}
+
+func compositeMode(v int32) limage.CompositeMode {
+	if v > 0 && v <= int32(limage.CompositeModeIntersection) {
+		return limage.CompositeMode(v)
+	}
+
+	return limage.CompositeModeAuto
+}
+
+// colorSpace converts a stored colour space to a limage.ColorSpace.
+//
+// The Lab colour space, which GIMP uses to blend the LCh modes, is converted to
+// ColorSpaceAuto, as those modes are blended in it regardless.
+func colorSpace(v int32) limage.ColorSpace {
+	switch v {
+	case colorSpaceLinear:
+		return limage.ColorSpaceLinear
+	case colorSpacePerceptual, colorSpaceNonLinear:
+		return limage.ColorSpacePerceptual
+	}
+
+	return limage.ColorSpaceAuto
+}
+
 func (l *layer) readItemPath(d *decoder, plength uint32) {
 	if plength&3 != 0 {
 		d.SetError(ErrInvalidItemPathLength)
 	}
 
+	if !d.CheckGroupDepth(plength >> 2) {
+		return
+	}
+
 	l.itemPath = make([]rune, plength>>2)
 
 	for i := uint32(0); i < plength>>2; i++ {
@@ -243,22 +368,39 @@ func (l *layer) readItemPath(d *decoder, plength uint32) {
 	}
 }
 
-func (l *layer) readMask(d *decoder) {
-	var m limage.MaskedImage
-
-	m.Image = l.Image
+// decodeError returns a DecodeError for an error concerning the whole layer.
+func (l *layer) decodeError(err error) *DecodeError {
+	return &DecodeError{
+		Err:       err,
+		Offset:    int64(l.ptr),
+		Layer:     l.index,
+		LayerName: l.Name,
+		Property:  noProperty,
+	}
+}
 
-	if m.Mask = d.ReadChannel(); m.Mask == nil {
+func (l *layer) readMask(d *decoder) {
+	c := d.ReadChannel(false)
+	if c.Image == nil {
 		return
 	}
 
-	if !l.LayerBounds.Eq(m.Mask.Bounds()) {
+	if l.LayerBounds.Dx() != c.Bounds().Dx() || l.LayerBounds.Dy() != c.Bounds().Dy() {
 		d.SetError(ErrInconsistantData)
 
 		return
 	}
 
-	l.Image = m
+	l.Image = limage.MaskedImage{
+		Image:            l.Image,
+		Mask:             c.Image.(limage.GrayImage),
+		Disabled:         l.maskDisabled,
+		ShowMask:         l.maskShow,
+		EditMask:         l.maskEdit,
+		MaskName:         c.Name,
+		MaskColour:       c.Colour,
+		MaskTransparency: c.Transparency,
+	}
 }
 
 // Errors.
@@ -14,47 +14,76 @@ func (e *encoder) WriteLayers(layers limage.Image, offsetX, offsetY int32, group
 	}
 }
 
+// WriteFloatingSelection writes the floating selection as a layer. It must be
+// written before the drawable it is attached to.
+func (e *encoder) WriteFloatingSelection(fs *FloatingSelection, pw *pointerWriter) {
+	e.WriteLayer(fs.Layer, int32(fs.LayerBounds.Min.X), int32(fs.LayerBounds.Min.Y), nil, pw)
+
+	e.floating = &fs.Target
+}
+
 func (e *encoder) WriteLayer(im limage.Layer, offsetX, offsetY int32, groups []uint32, pw *pointerWriter) {
-	pw.WritePointer(uint32(e.pos))
+	pw.WritePointer(e.pos)
+
+	target := e.floating != nil && e.floating.Layer != nil && e.floating.Layer.equal(groups)
+	if target && !e.floating.Mask {
+		e.floatingTarget.WritePointer(e.pos)
+	}
+
+	if di, ok := im.Image.(*DeferredImage); ok {
+		decoded, err := di.Decode()
+		if decoded == nil {
+			if e.Err == nil {
+				e.Err = err
+			}
+
+			return
+		}
+
+		im.Image = decoded
+	}
 
 	var (
-		mask  *image.Gray
+		mask  *limage.MaskedImage
 		img   image.Image
 		text  limage.TextData
 		group limage.Image
 	)
 
 	if mim, ok := im.Image.(limage.MaskedImage); ok {
-		mask = mim.Mask
+		mask = &mim
 		img = mim.Image
 	} else if mim, ok := im.Image.(*limage.MaskedImage); ok {
-		mask = mim.Mask
+		mask = mim
 		img = mim.Image
 	} else {
 		img = im.Image
 	}
 
-	switch i := im.Image.(type) {
+	switch i := img.(type) {
 	case limage.Text:
 		text = i.TextData
 	case *limage.Text:
 		text = i.TextData
+	}
+
+	switch i := im.Image.(type) {
 	case limage.Image:
 		group = i
 	case *limage.Image:
 		group = *i
 	}
 
-	writeProperties(e, im, offsetX, offsetY, groups, group, text)
+	writeProperties(e, im, offsetX, offsetY, groups, group, text, mask)
 	e.WriteUint32(0)
-	writeLayer(e, img, mask)
+	writeLayer(e, img, mask, target && e.floating.Mask)
 
 	if group != nil {
 		e.WriteLayers(group, offsetX, offsetY, groups, pw)
 	}
 }
 
-func writeProperties(e *encoder, im limage.Layer, offsetX, offsetY int32, groups []uint32, group limage.Image, text limage.TextData) {
+func writeProperties(e *encoder, im limage.Layer, offsetX, offsetY int32, groups []uint32, group limage.Image, text limage.TextData, mask *limage.MaskedImage) {
 	b := im.Bounds()
 	dx, dy := uint32(b.Dx()), uint32(b.Dy())
 
@@ -76,6 +105,16 @@ func writeProperties(e *encoder, im limage.Layer, offsetX, offsetY int32, groups
 		e.WriteUint32(1)
 	}
 
+	if groups == nil { // floating selection
+		e.WriteUint32(propFloatingSelection)
+		e.WriteUint32(uint32(e.pointerSize()))
+
+		e.floatingTarget = e.ReservePointers(1)
+	} else if selectedLayer(e.selectedLayers, groups) {
+		e.WriteUint32(propActiveLayer)
+		e.WriteUint32(0)
+	}
+
 	e.WriteUint32(propOffsets)
 	e.WriteUint32(8)
 	e.WriteInt32(offsetX)
@@ -90,24 +129,179 @@ func writeProperties(e *encoder, im limage.Layer, offsetX, offsetY int32, groups
 		}
 	}
 
+	ps := importParasites(im.Parasites)
+
 	if len(text) > 0 {
-		e.WriteText(text, dx, dy)
+		e.WriteUint32(propTextLayerFlags)
+		e.WriteUint32(4)
+		e.WriteUint32(1)
+
+		ps = append(ps, textParasite(text, dx, dy))
+	}
+
+	if len(ps) > 0 {
+		e.WriteParasites(ps)
 	}
 
 	if group != nil {
 		e.WriteUint32(propGroupItem)
 		e.WriteUint32(0)
+
+		if im.Expanded {
+			e.WriteUint32(propGroupItemFlags)
+			e.WriteUint32(4)
+			e.WriteUint32(groupItemExpanded)
+		}
+	}
+
+	for _, p := range [...]struct {
+		typ uint32
+		set bool
+	}{
+		{propLinked, im.Linked},
+		{propLockContent, im.LockContent},
+		{propLockAlpha, im.LockAlpha},
+		{propLockPosition, im.LockPosition},
+		{propLockVisibility, im.LockVisibility},
+	} {
+		if p.set {
+			e.WriteUint32(p.typ)
+			e.WriteUint32(4)
+			e.WriteBoolProperty(true)
+		}
+	}
+
+	if mask != nil && mask.Mask != nil {
+		for _, p := range [...]struct {
+			typ uint32
+			set bool
+		}{
+			{propApplyMask, !mask.Disabled},
+			{propEditMask, mask.EditMask},
+			{propShowMask, mask.ShowMask},
+		} {
+			e.WriteUint32(p.typ)
+			e.WriteUint32(4)
+			e.WriteBoolProperty(p.set)
+		}
+	}
+
+	if im.ColorTag != limage.ColorTagNone {
+		e.WriteUint32(propColorTag)
+		e.WriteUint32(4)
+		e.WriteUint32(uint32(im.ColorTag))
+	}
+
+	if im.Tattoo != 0 {
+		e.WriteUint32(propTattoo)
+		e.WriteUint32(4)
+		e.WriteUint32(im.Tattoo)
 	}
 
 	e.WriteUint32(propMode)
 	e.WriteUint32(4)
 
-	e.WriteUint32(modeID(im.Mode))
+	e.WriteUint32(modeID(im.Mode, im.NonLegacy))
+
+	if e.version >= 10 {
+		e.WriteUint32(propFloatOpacity)
+		e.WriteUint32(4)
+		e.WriteFloat32(float32(255-im.Transparency) / 255)
+
+		e.WriteUint32(propCompositeMode)
+		e.WriteUint32(4)
+		e.WriteInt32(int32(im.CompositeMode))
+
+		e.WriteUint32(propCompositeSpace)
+		e.WriteUint32(4)
+		e.WriteInt32(colorSpaceID(im.CompositeSpace))
+
+		e.WriteUint32(propBlendSpace)
+		e.WriteUint32(4)
+		e.WriteInt32(colorSpaceID(im.BlendSpace))
+	}
 
 	e.WriteUint32(0) // end of properties
 }
 
-func modeID(mode limage.Composite) uint32 {
+func colorSpaceID(space limage.ColorSpace) int32 {
+	switch space {
+	case limage.ColorSpaceLinear:
+		return colorSpaceLinear
+	case limage.ColorSpacePerceptual:
+		return colorSpaceNonLinear
+	}
+
+	return compositeAuto
+}
+
+// modeVersion returns the minimum file version able to store the given layer
+// mode.
+func modeVersion(id uint32) uint32 {
+	switch {
+	case id < 19:
+		return 0
+	case id < 23:
+		return 2
+	case id < 28:
+		return 9
+	default:
+		return 10
+	}
+}
+
+// modeID returns the ID of the layer mode, which is that of its non-legacy
+// version when nonLegacy is set and it has one.
+func modeID(mode limage.Composite, nonLegacy bool) uint32 {
+	if nonLegacy {
+		switch mode {
+		case limage.CompositeNormal:
+			return 28
+		case limage.CompositeBehind:
+			return 29
+		case limage.CompositeMultiply:
+			return 30
+		case limage.CompositeScreen:
+			return 31
+		case limage.CompositeOverlay:
+			return 23
+		case limage.CompositeDifference:
+			return 32
+		case limage.CompositeAddition:
+			return 33
+		case limage.CompositeSubtract:
+			return 34
+		case limage.CompositeDarkenOnly:
+			return 35
+		case limage.CompositeLightenOnly:
+			return 36
+		case limage.CompositeHue:
+			return 37
+		case limage.CompositeSaturation:
+			return 38
+		case limage.CompositeColor:
+			return 39
+		case limage.CompositeValue:
+			return 40
+		case limage.CompositeDivide:
+			return 41
+		case limage.CompositeDodge:
+			return 42
+		case limage.CompositeBurn:
+			return 43
+		case limage.CompositeHardLight:
+			return 44
+		case limage.CompositeSoftLight:
+			return 45
+		case limage.CompositeGrainExtract:
+			return 46
+		case limage.CompositeGrainMerge:
+			return 47
+		case limage.CompositeColorErase:
+			return 57
+		}
+	}
+
 	switch mode {
 	case limage.CompositeNormal:
 		return 0
@@ -154,7 +348,7 @@ func modeID(mode limage.Composite) uint32 {
 	case limage.CompositeGrainMerge:
 		return 21
 	case limage.CompositeLuminosity:
-		return 22
+		return 27 // closest is LCH lightness
 	case limage.CompositeColorErase:
 		return 22
 	case limage.CompositeChroma:
@@ -173,6 +367,8 @@ func modeID(mode limage.Composite) uint32 {
 		return 52
 	case limage.CompositeLinearBurn:
 		return 53
+	case limage.CompositeLuminance:
+		return 56
 	case limage.CompositeErase:
 		return 58
 	case limage.CompositeMerge:
@@ -186,16 +382,26 @@ func modeID(mode limage.Composite) uint32 {
 	}
 }
 
-func writeLayer(e *encoder, img image.Image, mask *image.Gray) {
+func writeLayer(e *encoder, img image.Image, mask *limage.MaskedImage, floatingTarget bool) {
 	ptrs := e.ReservePointers(2)
 
-	ptrs.WritePointer(uint32(e.pos))
+	ptrs.WritePointer(e.pos)
 
-	e.WriteImage(img, e.colourFunc, e.colourChannels)
+	e.WriteImage(img, e.colourFunc, e.colourChannels*uint8(e.precision.bytes()))
+
+	if mask != nil && mask.Mask != nil {
+		ptrs.WritePointer(e.pos)
+
+		if floatingTarget {
+			e.floatingTarget.WritePointer(e.pos)
+		}
 
-	if mask != nil {
-		ptrs.WritePointer(uint32(e.pos))
-		e.WriteChannel(mask)
+		e.WriteChannel(Channel{
+			Name:         mask.MaskName,
+			Colour:       mask.MaskColour,
+			Transparency: mask.MaskTransparency,
+			Image:        mask.Mask,
+		})
 	} else {
 		ptrs.WritePointer(0)
 	}
@@ -0,0 +1,137 @@
+package xcf
+
+import (
+	"bufio"
+	"container/list"
+	"io"
+	"sync"
+
+	"vimagination.zapto.org/byteio"
+)
+
+const defaultTileCacheSize = 256
+
+// WithTileCacheSize sets the maximum number of decompressed tiles, each of up
+// to 64x64 pixels, kept in memory by an image decoded with DecodeLazy. When
+// the cache is full, the least recently used tile is discarded.
+//
+// The default is 256 tiles; a size of zero disables the cache, so that only
+// the tile last read by each layer is kept.
+func WithTileCacheSize(n int) DecoderOption {
+	return func(d *decoder) {
+		d.tileCacheSize = n
+	}
+}
+
+// lazyTiles reads the tiles of an image from the file as they are needed.
+type lazyTiles struct {
+	r       *io.SectionReader
+	offsets []uint64
+	cache   *tileCache
+}
+
+// Tile returns the decompressed data of the numbered tile, reading it from the
+// file when it is not in the cache. The length of planes is the length of the
+// decompressed data.
+//
+// A tile that cannot be read is returned with all of its pixels set to zero.
+func (l *lazyTiles) Tile(tile int, compression Compression, planes []byte, bpp int) []byte {
+	key := tileKey{offset: l.offsets[tile], length: len(planes)}
+
+	if data := l.cache.Get(key); data != nil {
+		return data
+	}
+
+	data := make([]byte, len(planes))
+
+	if offset := int64(key.offset); offset < l.r.Size() {
+		r := &byteio.StickyBigEndianReader{Reader: bufio.NewReader(io.NewSectionReader(l.r, offset, l.r.Size()-offset))}
+
+		if readTile(r, compression, data, planes, bpp) != nil {
+			for i := range data {
+				data[i] = 0
+			}
+		}
+	}
+
+	l.cache.Put(key, data)
+
+	return data
+}
+
+// tileKey identifies a tile by its position in the file and decompressed
+// length.
+type tileKey struct {
+	offset uint64
+	length int
+}
+
+type cachedTile struct {
+	key  tileKey
+	data []byte
+}
+
+// tileCache is a least recently used cache of decompressed tiles, which is
+// shared by all of the layers of an image.
+type tileCache struct {
+	mu    sync.Mutex
+	max   int
+	tiles map[tileKey]*list.Element
+	lru   list.List
+}
+
+func newTileCache(max int) *tileCache {
+	return &tileCache{
+		max:   max,
+		tiles: make(map[tileKey]*list.Element),
+	}
+}
+
+// Get returns the data of the tile, or nil when it is not in the cache.
+func (t *tileCache) Get(key tileKey) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.tiles[key]
+	if !ok {
+		return nil
+	}
+
+	t.lru.MoveToFront(e)
+
+	return e.Value.(*cachedTile).data
+}
+
+// Put adds the data of a tile to the cache, discarding the least recently used
+// tiles when it is full.
+func (t *tileCache) Put(key tileKey, data []byte) {
+	if t.max <= 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if e, ok := t.tiles[key]; ok {
+		t.lru.MoveToFront(e)
+
+		return
+	}
+
+	t.tiles[key] = t.lru.PushFront(&cachedTile{key: key, data: data})
+
+	for t.lru.Len() > t.max {
+		e := t.lru.Back()
+
+		delete(t.tiles, e.Value.(*cachedTile).key)
+		t.lru.Remove(e)
+	}
+}
+
+// Len returns the number of tiles in the cache.
+func (t *tileCache) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.lru.Len()
+}
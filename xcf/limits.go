@@ -0,0 +1,190 @@
+package xcf
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// limits restrict the resources used when decoding a file, with zero meaning
+// no limit.
+type limits struct {
+	maxWidth, maxHeight uint32
+	maxPixels           int64
+	maxLayers           int
+	maxGroupDepth       int
+	maxParasiteSize     uint32
+	maxPaths            int
+	maxChannels         int
+
+	pixels *int64 // number of pixels allocated, shared between readers
+}
+
+// WithMaxDimensions limits the width and height of the image, and of each of
+// its layers, masks and channels. When exceeded, decoding returns
+// ErrDimensionsTooLarge.
+func WithMaxDimensions(width, height uint32) DecoderOption {
+	return func(d *decoder) {
+		d.maxWidth = width
+		d.maxHeight = height
+	}
+}
+
+// WithMaxPixels limits the total number of pixels in all of the layers, masks
+// and channels of the image. When exceeded, decoding returns
+// ErrTooManyPixels.
+func WithMaxPixels(n int64) DecoderOption {
+	return func(d *decoder) {
+		d.maxPixels = n
+	}
+}
+
+// WithMaxLayers limits the number of layers, including layer groups. When
+// exceeded, decoding returns ErrTooManyLayers.
+func WithMaxLayers(n int) DecoderOption {
+	return func(d *decoder) {
+		d.maxLayers = n
+	}
+}
+
+// WithMaxGroupDepth limits how deeply layer groups can be nested, with a
+// depth of one allowing groups that only contain layers. When exceeded,
+// decoding returns ErrGroupTooDeep.
+func WithMaxGroupDepth(n int) DecoderOption {
+	return func(d *decoder) {
+		d.maxGroupDepth = n
+	}
+}
+
+// WithMaxParasiteSize limits the size of the data of each parasite. When
+// exceeded, decoding returns ErrParasiteTooLarge.
+func WithMaxParasiteSize(n uint32) DecoderOption {
+	return func(d *decoder) {
+		d.maxParasiteSize = n
+	}
+}
+
+// WithMaxPaths limits the number of paths in the image. When exceeded,
+// decoding returns ErrTooManyPaths.
+func WithMaxPaths(n int) DecoderOption {
+	return func(d *decoder) {
+		d.maxPaths = n
+	}
+}
+
+// WithMaxChannels limits the number of channels in the image, including the
+// saved selection. When exceeded, decoding returns ErrTooManyChannels.
+func WithMaxChannels(n int) DecoderOption {
+	return func(d *decoder) {
+		d.maxChannels = n
+	}
+}
+
+// CheckDimensions sets ErrDimensionsTooLarge, returning false, when the given
+// dimensions exceed the limits.
+func (r *reader) CheckDimensions(width, height uint32) bool {
+	if r.maxWidth > 0 && width > r.maxWidth || r.maxHeight > 0 && height > r.maxHeight {
+		r.SetError(ErrDimensionsTooLarge)
+
+		return false
+	}
+
+	return true
+}
+
+// AllocatePixels adds the pixels of an image of the given dimensions to the
+// total, setting ErrTooManyPixels, and returning false, when the total
+// exceeds the limit.
+func (r *reader) AllocatePixels(width, height uint32) bool {
+	if r.maxPixels == 0 {
+		return true
+	}
+
+	if atomic.AddInt64(r.pixels, int64(width)*int64(height)) > r.maxPixels {
+		r.SetError(ErrTooManyPixels)
+
+		return false
+	}
+
+	return true
+}
+
+// CheckGroupDepth sets ErrGroupTooDeep, returning false, when a layer with an
+// item path of the given length would exceed the group depth limit.
+func (r *reader) CheckGroupDepth(pathLength uint32) bool {
+	if r.maxGroupDepth > 0 && pathLength > uint32(r.maxGroupDepth)+1 {
+		r.SetError(ErrGroupTooDeep)
+
+		return false
+	}
+
+	return true
+}
+
+// CheckParasiteSize sets ErrParasiteTooLarge, returning false, when the given
+// size exceeds the limit.
+func (r *reader) CheckParasiteSize(size uint32) bool {
+	if r.maxParasiteSize > 0 && size > r.maxParasiteSize {
+		r.SetError(ErrParasiteTooLarge)
+
+		return false
+	}
+
+	return true
+}
+
+func isLimitError(err error) bool {
+	for _, l := range [...]error{ErrDimensionsTooLarge, ErrTooManyPixels, ErrTooManyLayers, ErrGroupTooDeep, ErrParasiteTooLarge, ErrTooManyPaths, ErrTooManyChannels} {
+		if errors.Is(err, l) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckPaths sets ErrTooManyPaths, returning false, when the given number of
+// paths exceeds the limit.
+func (r *reader) CheckPaths(count int64) bool {
+	if r.maxPaths > 0 && count > int64(r.maxPaths) {
+		r.SetError(ErrTooManyPaths)
+
+		return false
+	}
+
+	return true
+}
+
+// CheckLayers sets ErrTooManyLayers, returning false, when the given number of
+// layers exceeds the limit.
+func (r *reader) CheckLayers(count int64) bool {
+	if r.maxLayers > 0 && count > int64(r.maxLayers) {
+		r.SetError(ErrTooManyLayers)
+
+		return false
+	}
+
+	return true
+}
+
+// CheckChannels sets ErrTooManyChannels, returning false, when the given
+// number of channels exceeds the limit.
+func (r *reader) CheckChannels(count int64) bool {
+	if r.maxChannels > 0 && count > int64(r.maxChannels) {
+		r.SetError(ErrTooManyChannels)
+
+		return false
+	}
+
+	return true
+}
+
+// Errors.
+var (
+	ErrDimensionsTooLarge = errors.New("dimensions exceed limit")
+	ErrTooManyPixels      = errors.New("total pixels exceed limit")
+	ErrTooManyLayers      = errors.New("number of layers exceeds limit")
+	ErrGroupTooDeep       = errors.New("layer group depth exceeds limit")
+	ErrParasiteTooLarge   = errors.New("parasite size exceeds limit")
+	ErrTooManyPaths       = errors.New("number of paths exceeds limit")
+	ErrTooManyChannels    = errors.New("number of channels exceeds limit")
+)
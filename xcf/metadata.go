@@ -0,0 +1,456 @@
+package xcf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image/color"
+	"math"
+	"strings"
+
+	"vimagination.zapto.org/limage/internal"
+)
+
+// Metadata contains the image-level settings of an XCF file that do not affect
+// the pixel data.
+type Metadata struct {
+	// XResolution and YResolution are in pixels per inch, and are zero when
+	// not set.
+	XResolution, YResolution float64
+
+	// Unit is the unit used to display measurements. When UserUnit is set, it
+	// takes precedence.
+	Unit     Unit
+	UserUnit *UserUnit
+
+	Guides       []Guide
+	SamplePoints []SamplePoint
+
+	// Grid is the grid configuration, stored in the gimp-image-grid
+	// parasite; it is nil when the image has none. When the parasite cannot
+	// be parsed, Grid is nil and the raw parasite is kept in the image
+	// Parasites. When Grid is set, it replaces any such parasite on encode.
+	Grid *Grid
+}
+
+// Unit represents one of the built-in GIMP units.
+type Unit uint32
+
+// Unit constants.
+const (
+	UnitPixel Unit = iota
+	UnitInch
+	UnitMillimeter
+	UnitPoint
+	UnitPica
+)
+
+// UserUnit represents a user-defined unit.
+type UserUnit struct {
+	// Factor is the number of units per inch.
+	Factor float64
+	Digits uint32
+
+	ID, Symbol, Abbreviation, Singular, Plural string
+}
+
+// GuideOrientation determines whether a guide is horizontal or vertical.
+type GuideOrientation uint8
+
+// GuideOrientation constants.
+const (
+	GuideHorizontal GuideOrientation = 1
+	GuideVertical   GuideOrientation = 2
+)
+
+// Guide represents a single guide line.
+type Guide struct {
+	Orientation GuideOrientation
+	Position    int32
+}
+
+// SamplePoint represents a colour sample point.
+type SamplePoint struct {
+	X, Y int32
+
+	// PickMode is GIMP's colour pick mode for the point, which determines how
+	// the colour is displayed.
+	PickMode uint32
+}
+
+// Grid represents the image grid configuration.
+type Grid struct {
+	Style                  string
+	Foreground, Background color.NRGBA64
+	XSpacing, YSpacing     float64
+	SpacingUnit            string
+	XOffset, YOffset       float64
+	OffsetUnit             string
+}
+
+const gridParasiteName = "gimp-image-grid"
+
+func (d *reader) ReadGuides(plength uint32, m *Metadata) {
+	if plength%5 != 0 {
+		d.SetError(ErrInvalidGuideLength)
+
+		return
+	}
+
+	m.Guides = make([]Guide, plength/5)
+
+	for n := range m.Guides {
+		m.Guides[n].Position = d.ReadInt32()
+		m.Guides[n].Orientation = GuideOrientation(d.ReadUint8())
+	}
+}
+
+func (d *reader) ReadSamplePoints(plength uint32, m *Metadata) {
+	if plength%20 != 0 {
+		d.SetError(ErrInvalidSampleLength)
+
+		return
+	}
+
+	m.SamplePoints = make([]SamplePoint, plength/20)
+
+	for n := range m.SamplePoints {
+		m.SamplePoints[n].X = d.ReadInt32()
+		m.SamplePoints[n].Y = d.ReadInt32()
+		m.SamplePoints[n].PickMode = d.ReadUint32()
+		d.Skip(8) // padding
+	}
+}
+
+func (d *reader) ReadOldSamplePoints(plength uint32, m *Metadata) {
+	if plength%8 != 0 {
+		d.SetError(ErrInvalidSampleLength)
+
+		return
+	}
+
+	m.SamplePoints = make([]SamplePoint, plength/8)
+
+	for n := range m.SamplePoints {
+		m.SamplePoints[n].X = d.ReadInt32()
+		m.SamplePoints[n].Y = d.ReadInt32()
+	}
+}
+
+// ReadUserUnit reads a user-defined unit. The number of strings stored has
+// changed between versions, so as many are read as the property holds.
+func (d *reader) ReadUserUnit(plength uint32) *UserUnit {
+	if plength < 8 {
+		d.SetError(ErrInvalidUnitLength)
+
+		return nil
+	}
+
+	end := d.Pos() + int64(plength)
+	u := &UserUnit{
+		Factor: float64(d.ReadFloat32()),
+		Digits: d.ReadUint32(),
+	}
+
+	for _, s := range [...]*string{&u.ID, &u.Symbol, &u.Abbreviation, &u.Singular, &u.Plural} {
+		if d.Pos() >= end || d.Err != nil {
+			break
+		}
+
+		*s = d.ReadString()
+	}
+
+	pos := d.Pos()
+	if pos > end {
+		d.SetError(ErrInvalidUnitLength)
+
+		return nil
+	}
+
+	d.Skip(uint32(end - pos))
+
+	return u
+}
+
+func parseGrid(p *parasite) (*Grid, error) {
+	tags, err := p.Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	var g Grid
+
+	for _, tg := range tags {
+		if len(tg.Values) != 1 {
+			continue
+		}
+
+		switch v := tg.Values[0].(type) {
+		case string:
+			switch tg.Name {
+			case "style":
+				g.Style = v
+			case "spacing-unit":
+				g.SpacingUnit = v
+			case "offset-unit":
+				g.OffsetUnit = v
+			}
+		case float64:
+			switch tg.Name {
+			case "xspacing":
+				g.XSpacing = v
+			case "yspacing":
+				g.YSpacing = v
+			case "xoffset":
+				g.XOffset = v
+			case "yoffset":
+				g.YOffset = v
+			}
+		case tag:
+			switch tg.Name {
+			case "fgcolor":
+				g.Foreground, err = parseColourTag(v)
+			case "bgcolor":
+				g.Background, err = parseColourTag(v)
+			}
+
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &g, nil
+}
+
+func parseColourTag(t tag) (color.NRGBA64, error) {
+	var f [4]float64
+
+	f[3] = 1
+
+	switch t.Name {
+	case "color-rgb":
+		if len(t.Values) != 3 {
+			return color.NRGBA64{}, ErrInvalidColour
+		}
+	case "color-rgba":
+		if len(t.Values) != 4 {
+			return color.NRGBA64{}, ErrInvalidColour
+		}
+	case "color":
+		return parseGeglColour(t.Values)
+	default:
+		return color.NRGBA64{}, ErrUnknownColourFormat
+	}
+
+	for n, v := range t.Values {
+		f[n], _ = v.(float64)
+	}
+
+	return floatsToColour(f), nil
+}
+
+// parseGeglColour parses the colour form written by GIMP 3, which holds the
+// babl encoding of the pixel, its length in bytes and the raw pixel data,
+// optionally followed by the ICC profile of a non-sRGB space.
+//
+// Only RGB and RGBA pixels in the sRGB space are supported; the pixel data is
+// in the byte order of the machine that wrote it, which is assumed to be
+// little-endian.
+func parseGeglColour(values []interface{}) (color.NRGBA64, error) {
+	if len(values) != 3 {
+		return color.NRGBA64{}, ErrUnknownColourFormat
+	}
+
+	encoding, _ := values[0].(string)
+	length, _ := values[1].(float64)
+	raw, _ := values[2].(string)
+	data := unescapeData(raw)
+
+	if float64(len(data)) != length {
+		return color.NRGBA64{}, ErrInvalidColour
+	}
+
+	components, typ, _ := strings.Cut(encoding, " ")
+
+	var (
+		linear   bool
+		channels int
+	)
+
+	switch components {
+	case "RGB":
+		linear, channels = true, 3
+	case "RGBA":
+		linear, channels = true, 4
+	case "R'G'B'", "R~G~B~":
+		channels = 3
+	case "R'G'B'A", "R~G~B~A":
+		channels = 4
+	default:
+		return color.NRGBA64{}, ErrUnknownColourFormat
+	}
+
+	var (
+		size int
+		get  func([]byte) float64
+	)
+
+	switch typ {
+	case "u8":
+		size, get = 1, func(b []byte) float64 { return float64(b[0]) / 0xff }
+	case "u16":
+		size, get = 2, func(b []byte) float64 { return float64(binary.LittleEndian.Uint16(b)) / 0xffff }
+	case "float":
+		size, get = 4, func(b []byte) float64 { return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))) }
+	case "double":
+		size, get = 8, func(b []byte) float64 { return math.Float64frombits(binary.LittleEndian.Uint64(b)) }
+	default:
+		return color.NRGBA64{}, ErrUnknownColourFormat
+	}
+
+	if len(data) != size*channels {
+		return color.NRGBA64{}, ErrInvalidColour
+	}
+
+	var f [4]float64
+
+	f[3] = 1
+
+	for n := 0; n < channels; n++ {
+		f[n] = get(data[n*size:])
+
+		if linear && n < 3 {
+			f[n] = internal.LinearToSRGB(f[n])
+		}
+	}
+
+	return floatsToColour(f), nil
+}
+
+// unescapeData converts the octal escapes GIMP uses when writing binary data
+// back into bytes.
+func unescapeData(s string) []byte {
+	data := make([]byte, 0, len(s))
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			data = append(data, s[i])
+
+			continue
+		}
+
+		var (
+			c uint
+			j int
+		)
+
+		for j = i + 1; j < len(s) && j < i+4 && s[j] >= '0' && s[j] <= '7'; j++ {
+			c = c<<3 | uint(s[j]-'0')
+		}
+
+		if j == i+1 {
+			continue
+		}
+
+		data = append(data, byte(c))
+		i = j - 1
+	}
+
+	return data
+}
+
+func floatsToColour(f [4]float64) color.NRGBA64 {
+	return color.NRGBA64{
+		R: internal.FloatToUint16(f[0]),
+		G: internal.FloatToUint16(f[1]),
+		B: internal.FloatToUint16(f[2]),
+		A: internal.FloatToUint16(f[3]),
+	}
+}
+
+func (g *Grid) parasite() parasite {
+	colour := func(c color.NRGBA64) string {
+		return fmt.Sprintf("(color-rgba %f %f %f %f)", float64(c.R)/0xffff, float64(c.G)/0xffff, float64(c.B)/0xffff, float64(c.A)/0xffff)
+	}
+
+	return parasite{
+		name:  gridParasiteName,
+		flags: parasitePersistent,
+		data: fmt.Appendf(nil, "(style %s)\n"+
+			"(fgcolor %s)\n"+
+			"(bgcolor %s)\n"+
+			"(xspacing %f)\n"+
+			"(yspacing %f)\n"+
+			"(spacing-unit %s)\n"+
+			"(xoffset %f)\n"+
+			"(yoffset %f)\n"+
+			"(offset-unit %s)\n"+
+			"\x00", g.Style, colour(g.Foreground), colour(g.Background), g.XSpacing, g.YSpacing, g.SpacingUnit, g.XOffset, g.YOffset, g.OffsetUnit),
+	}
+}
+
+func (e *encoder) WriteMetadata(m *Metadata) {
+	if m.XResolution != 0 || m.YResolution != 0 {
+		e.WriteUint32(propResolution)
+		e.WriteUint32(8)
+		e.WriteFloat32(float32(m.XResolution))
+		e.WriteFloat32(float32(m.YResolution))
+	}
+
+	if u := m.UserUnit; u != nil {
+		e.WriteUint32(propUserUnit)
+		e.WriteUint32(8 + 5*5 + uint32(len(u.ID)+len(u.Symbol)+len(u.Abbreviation)+len(u.Singular)+len(u.Plural)))
+		e.WriteFloat32(float32(u.Factor))
+		e.WriteUint32(u.Digits)
+		e.WriteString(u.ID)
+		e.WriteString(u.Symbol)
+		e.WriteString(u.Abbreviation)
+		e.WriteString(u.Singular)
+		e.WriteString(u.Plural)
+	} else if m.Unit != UnitPixel {
+		e.WriteUint32(propUnit)
+		e.WriteUint32(4)
+		e.WriteUint32(uint32(m.Unit))
+	}
+
+	if len(m.Guides) > 0 {
+		e.WriteUint32(propGuides)
+		e.WriteUint32(5 * uint32(len(m.Guides)))
+
+		for _, g := range m.Guides {
+			e.WriteInt32(g.Position)
+			e.WriteUint8(uint8(g.Orientation))
+		}
+	}
+
+	if len(m.SamplePoints) > 0 {
+		if e.version >= 10 {
+			e.WriteUint32(propSamplePoints)
+			e.WriteUint32(20 * uint32(len(m.SamplePoints)))
+
+			for _, s := range m.SamplePoints {
+				e.WriteInt32(s.X)
+				e.WriteInt32(s.Y)
+				e.WriteUint32(s.PickMode)
+				e.WriteUint32(0) // padding
+				e.WriteUint32(0)
+			}
+		} else {
+			e.WriteUint32(propOldSamplePoints)
+			e.WriteUint32(8 * uint32(len(m.SamplePoints)))
+
+			for _, s := range m.SamplePoints {
+				e.WriteInt32(s.X)
+				e.WriteInt32(s.Y)
+			}
+		}
+	}
+}
+
+// Errors.
+var (
+	ErrInvalidUnitLength   = errors.New("invalid user unit length")
+	ErrInvalidColour       = errors.New("invalid colour")
+	ErrUnknownColourFormat = errors.New("unknown colour format")
+)
@@ -6,15 +6,21 @@ import (
 	"strconv"
 	"strings"
 
+	"vimagination.zapto.org/limage"
 	"vimagination.zapto.org/parser"
 )
 
 const (
-	// iccProfileParasiteName = "icc-profile"
+	iccProfileParasiteName = "icc-profile"
 	// commentParasiteName    = "gimp-comment"
 	textParasiteName = "gimp-text-layer"
 )
 
+const (
+	parasitePersistent = uint32(limage.ParasitePersistent)
+	parasiteUndoable   = uint32(limage.ParasiteUndoable)
+)
+
 type parasite struct {
 	name  string
 	flags uint32
@@ -33,6 +39,62 @@ func (p parasites) Get(name string) *parasite {
 	return nil
 }
 
+// Remove returns the parasites without the one with the given name.
+func (p parasites) Remove(name string) parasites {
+	for n := range p {
+		if p[n].name == name {
+			return append(p[:n:n], p[n+1:]...)
+		}
+	}
+
+	return p
+}
+
+// decodedParasite returns true for parasites whose data is decoded into other
+// structures, and so are not exposed directly.
+func decodedParasite(name string) bool {
+	switch name {
+	case textParasiteName, iccProfileParasiteName:
+		return true
+	}
+
+	return false
+}
+
+// Export converts the parasites to their exported form, dropping those that
+// have been decoded into other structures.
+func (p parasites) Export() []limage.Parasite {
+	var ps []limage.Parasite
+
+	for _, pa := range p {
+		if !decodedParasite(pa.name) {
+			ps = append(ps, limage.Parasite{
+				Name:  pa.name,
+				Flags: limage.ParasiteFlags(pa.flags),
+				Data:  pa.data,
+			})
+		}
+	}
+
+	return ps
+}
+
+func importParasites(ps []limage.Parasite) parasites {
+	var p parasites
+
+	for _, pa := range ps {
+		if !decodedParasite(pa.Name) {
+			p = append(p, parasite{
+				name:  pa.Name,
+				flags: uint32(pa.Flags),
+				data:  pa.Data,
+			})
+		}
+	}
+
+	return p
+}
+
 func (d *reader) ReadParasites(l uint32) parasites {
 	ps := make(parasites, 0, 32)
 
@@ -50,6 +112,8 @@ func (d *reader) ReadParasites(l uint32) parasites {
 		if read > l {
 			d.SetError(ErrInvalidParasites)
 
+			return nil
+		} else if !d.CheckParasiteSize(pplength) {
 			return nil
 		}
 
@@ -64,6 +128,24 @@ func (d *reader) ReadParasites(l uint32) parasites {
 	return ps
 }
 
+func (e *encoder) WriteParasites(ps parasites) {
+	var l uint32
+
+	for _, p := range ps {
+		l += 4 + uint32(len(p.name)) + 1 + 4 + 4 + uint32(len(p.data))
+	}
+
+	e.WriteUint32(propParasites)
+	e.WriteUint32(l)
+
+	for _, p := range ps {
+		e.WriteString(p.name)
+		e.WriteUint32(p.flags)
+		e.WriteUint32(uint32(len(p.data)))
+		e.Write(p.data)
+	}
+}
+
 func (d *reader) ReadParasite() parasite {
 	var p parasite
 
@@ -71,6 +153,10 @@ func (d *reader) ReadParasite() parasite {
 	p.flags = d.ReadUint32()
 	pplength := d.ReadUint32()
 
+	if !d.CheckParasiteSize(pplength) || !d.CheckCount(pplength, 1) {
+		return p
+	}
+
 	p.data = make([]byte, pplength)
 
 	d.Read(p.data)
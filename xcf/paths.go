@@ -2,51 +2,65 @@ package xcf
 
 import "errors"
 
-type paths struct {
-	aIndex uint32
-	paths  []path
-}
+const (
+	pathPointAnchor  = 1
+	pathPointControl = 2
+	pathPointMove    = 3
+)
 
-type path struct {
-	name   string
-	linked bool
-	// state   byte
-	closed bool
-	// version uint32
-	tattoo uint32
-	points []pathPoint
+type pathPoint struct {
+	typ  uint32
+	x, y float64
 }
 
-type pathPoint struct {
-	control bool
-	x, y    float64
+func (p *pathPoint) pathPoint(control bool) PathPoint {
+	return PathPoint{
+		Control:  control,
+		X:        p.x,
+		Y:        p.y,
+		Pressure: 1,
+		XTilt:    0.5,
+		YTilt:    0.5,
+		Wheel:    0.5,
+	}
 }
 
-func (d *reader) ReadPaths() paths {
-	var p paths
+// Minimum sizes, in bytes, of the structures of old style paths.
+const (
+	minOldPathSize   = 21 // name + linked + state + closed + number of points + version
+	oldPathPointSize = 12 // type + x + y
+)
 
-	p.aIndex = d.ReadUint32()
+// ReadPaths reads the paths stored by old versions of GIMP, converting them to
+// Bézier paths, also returning the index of the active path. The image already
+// has the given number of paths.
+func (d *reader) ReadPaths(existing int) ([]Path, uint32) {
+	active := d.ReadUint32()
 
 	n := d.ReadUint32()
-	p.paths = make([]path, n)
+	if !d.CheckPaths(int64(existing)+int64(n)) || !d.CheckCount(n, minOldPathSize) {
+		return nil, 0
+	}
 
-	for i := uint32(0); i < n; i++ {
-		p.paths[i].name = d.ReadString()
-		p.paths[i].linked = d.ReadBoolProperty()
+	paths := make([]Path, n)
+
+	for i := range paths {
+		paths[i].Name = d.ReadString()
+		paths[i].Linked = d.ReadBoolProperty()
 		state := d.ReadUint8()
-		p.paths[i].closed = d.ReadBoolProperty()
+		closed := d.ReadBoolProperty()
 
-		if p.paths[i].closed {
+		if closed {
 			if state != 4 {
 				d.SetError(ErrInconsistantClosedState)
 
-				return p
+				return paths, active
 			}
 		} else {
 			if state != 2 {
 				d.SetError(ErrInconsistantClosedState)
 
-				return p
+				return paths, active
 			}
 		}
 
@@ -56,7 +70,7 @@ func (d *reader) ReadPaths() paths {
 		if v < 1 || v > 3 {
 			d.SetError(ErrUnknownPathsVersion)
 
-			return p
+			return paths, active
 		}
 
 		if v == 2 || v == 3 {
@@ -64,25 +78,96 @@ func (d *reader) ReadPaths() paths {
 		}
 
 		if v == 3 {
-			p.paths[i].tattoo = d.ReadUint32()
+			paths[i].Tattoo = d.ReadUint32()
 		}
 
-		p.paths[i].points = make([]pathPoint, np)
+		if !d.CheckCount(np, oldPathPointSize) {
+			return paths, active
+		}
 
-		for j := uint32(0); j < np; j++ {
-			p.paths[i].points[j].control = d.ReadBoolProperty()
+		points := make([]pathPoint, np)
+
+		for j := range points {
+			points[j].typ = d.ReadUint32()
 
 			if v == 1 {
-				p.paths[i].points[j].x = float64(d.ReadInt32())
-				p.paths[i].points[j].y = float64(d.ReadInt32())
+				points[j].x = float64(d.ReadInt32())
+				points[j].y = float64(d.ReadInt32())
 			} else {
-				p.paths[i].points[j].x = float64(d.ReadFloat32())
-				p.paths[i].points[j].y = float64(d.ReadFloat32())
+				points[j].x = float64(d.ReadFloat32())
+				points[j].y = float64(d.ReadFloat32())
 			}
 		}
+
+		paths[i].Strokes = pathStrokes(points, closed)
+	}
+
+	return paths, active
+}
+
+// pathStrokes converts old style path points, in which each pair of anchors
+// is separated by two control points, into strokes in which each anchor is
+// surrounded by its own control points.
+//
+// A move point starts a new stroke.
+func pathStrokes(points []pathPoint, closed bool) []Stroke {
+	var (
+		strokes  []Stroke
+		controls int
+		in       *pathPoint
+	)
+
+	finish := func() {
+		if len(strokes) > 0 && closed && in != nil {
+			s := strokes[len(strokes)-1]
+			s.Points[0] = in.pathPoint(true)
+		}
+
+		in = nil
 	}
 
-	return p
+	for n := range points {
+		p := &points[n]
+
+		switch p.typ {
+		case pathPointMove:
+			finish()
+
+			strokes = append(strokes, Stroke{Closed: closed})
+
+			fallthrough
+		case pathPointAnchor:
+			if len(strokes) == 0 {
+				strokes = append(strokes, Stroke{Closed: closed})
+			}
+
+			c := p
+			if in != nil {
+				c = in
+			}
+
+			s := &strokes[len(strokes)-1]
+			s.Points = append(s.Points, c.pathPoint(true), p.pathPoint(false), p.pathPoint(true))
+			controls = 0
+			in = nil
+		case pathPointControl:
+			if len(strokes) == 0 {
+				continue
+			}
+
+			s := strokes[len(strokes)-1]
+
+			if controls++; controls == 1 {
+				s.Points[len(s.Points)-1] = p.pathPoint(true)
+			} else {
+				in = p
+			}
+		}
+	}
+
+	finish()
+
+	return strokes
 }
 
 // Errors.
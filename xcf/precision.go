@@ -0,0 +1,335 @@
+package xcf
+
+import (
+	"encoding/binary"
+	"errors"
+	"image/color"
+	"math"
+
+	"vimagination.zapto.org/limage/internal"
+	"vimagination.zapto.org/limage/lcolor"
+)
+
+// Precision represents the bit-depth, data type and gamma of the colour data
+// stored in an XCF file.
+//
+// The values match those used by GIMP from XCF version 7.
+type Precision uint32
+
+// Precision constants.
+const (
+	PrecisionU8Linear         Precision = 100
+	PrecisionU8NonLinear      Precision = 150
+	PrecisionU8Perceptual     Precision = 175
+	PrecisionU16Linear        Precision = 200
+	PrecisionU16NonLinear     Precision = 250
+	PrecisionU16Perceptual    Precision = 275
+	PrecisionU32Linear        Precision = 300
+	PrecisionU32NonLinear     Precision = 350
+	PrecisionU32Perceptual    Precision = 375
+	PrecisionHalfLinear       Precision = 500
+	PrecisionHalfNonLinear    Precision = 550
+	PrecisionHalfPerceptual   Precision = 575
+	PrecisionFloatLinear      Precision = 600
+	PrecisionFloatNonLinear   Precision = 650
+	PrecisionFloatPerceptual  Precision = 675
+	PrecisionDoubleLinear     Precision = 700
+	PrecisionDoubleNonLinear  Precision = 750
+	PrecisionDoublePerceptual Precision = 775
+)
+
+func readPrecision(version, p uint32) (Precision, error) {
+	switch version {
+	case 4:
+		switch p {
+		case 0:
+			return PrecisionU8NonLinear, nil
+		case 1:
+			return PrecisionU16NonLinear, nil
+		case 2:
+			return PrecisionU32Linear, nil
+		case 3:
+			return PrecisionHalfLinear, nil
+		case 4:
+			return PrecisionFloatLinear, nil
+		}
+	case 5, 6:
+		switch p {
+		case 100, 150, 200, 250, 300, 350:
+			return Precision(p), nil
+		case 400, 450, 500, 550:
+			return Precision(p + 100), nil
+		}
+	default:
+		if Precision(p).valid() {
+			return Precision(p), nil
+		}
+	}
+
+	return 0, ErrInvalidPrecision
+}
+
+// id returns the value used to store the precision in a file of the given
+// version, and whether that version is able to store it.
+func (p Precision) id(version uint32) (uint32, bool) {
+	switch version {
+	case 0, 1, 2, 3:
+		return 0, p == PrecisionU8NonLinear
+	case 4:
+		switch p {
+		case PrecisionU8NonLinear:
+			return 0, true
+		case PrecisionU16NonLinear:
+			return 1, true
+		case PrecisionU32Linear:
+			return 2, true
+		case PrecisionHalfLinear:
+			return 3, true
+		case PrecisionFloatLinear:
+			return 4, true
+		}
+	case 5, 6:
+		switch p {
+		case PrecisionU8Linear, PrecisionU8NonLinear, PrecisionU16Linear, PrecisionU16NonLinear, PrecisionU32Linear, PrecisionU32NonLinear:
+			return uint32(p), true
+		case PrecisionHalfLinear, PrecisionHalfNonLinear, PrecisionFloatLinear, PrecisionFloatNonLinear:
+			return uint32(p) - 100, true
+		}
+	default:
+		return uint32(p), p.valid()
+	}
+
+	return 0, false
+}
+
+func (p Precision) valid() bool {
+	switch p {
+	case PrecisionU8Linear, PrecisionU8NonLinear, PrecisionU8Perceptual,
+		PrecisionU16Linear, PrecisionU16NonLinear, PrecisionU16Perceptual,
+		PrecisionU32Linear, PrecisionU32NonLinear, PrecisionU32Perceptual,
+		PrecisionHalfLinear, PrecisionHalfNonLinear, PrecisionHalfPerceptual,
+		PrecisionFloatLinear, PrecisionFloatNonLinear, PrecisionFloatPerceptual,
+		PrecisionDoubleLinear, PrecisionDoubleNonLinear, PrecisionDoublePerceptual:
+		return true
+	}
+
+	return false
+}
+
+func (p Precision) linear() bool {
+	return p%100 == 0
+}
+
+func (p Precision) deep() bool {
+	return p != PrecisionU8NonLinear && p != PrecisionU8Perceptual
+}
+
+func (p Precision) bytes() int {
+	switch p / 100 {
+	case 1:
+		return 1
+	case 2, 5:
+		return 2
+	case 3, 6:
+		return 4
+	default:
+		return 8
+	}
+}
+
+// componentFormat describes how a single colour component is stored.
+//
+// XCF files prior to version 12 stored high bit-depth data in little-endian
+// order.
+type componentFormat struct {
+	Precision
+	littleEndian bool
+}
+
+func newComponentFormat(p Precision, version uint32) componentFormat {
+	return componentFormat{
+		Precision:    p,
+		littleEndian: version < 12,
+	}
+}
+
+func (c componentFormat) order() binary.ByteOrder {
+	if c.littleEndian {
+		return binary.LittleEndian
+	}
+
+	return binary.BigEndian
+}
+
+// read converts a stored component into a 16-bit value. When linear is true
+// and the precision stores linear light, the value is converted to the sRGB
+// gamma curve.
+func (c componentFormat) read(b []byte, linear bool) uint16 {
+	linear = linear && c.linear()
+
+	var f float64
+
+	switch c.Precision / 100 {
+	case 1:
+		v := uint16(b[0])
+		v |= v << 8
+
+		if linear {
+			return internal.LinearToSRGB16(v)
+		}
+
+		return v
+	case 2:
+		v := c.order().Uint16(b)
+
+		if linear {
+			return internal.LinearToSRGB16(v)
+		}
+
+		return v
+	case 3:
+		v := c.order().Uint32(b)
+
+		if linear {
+			f = float64(v) / math.MaxUint32
+		} else {
+			return uint16(v >> 16)
+		}
+	case 5:
+		f = halfToFloat(c.order().Uint16(b))
+	case 6:
+		f = float64(math.Float32frombits(c.order().Uint32(b)))
+	default:
+		f = math.Float64frombits(c.order().Uint64(b))
+	}
+
+	if linear && f > 0 {
+		f = internal.LinearToSRGB(f)
+	}
+
+	return internal.FloatToUint16(f)
+}
+
+// write stores a 16-bit value as a component. When linear is true and the
+// precision stores linear light, the value is converted from the sRGB gamma
+// curve.
+func (c componentFormat) write(b []byte, v uint16, linear bool) {
+	linear = linear && c.linear()
+
+	switch c.Precision / 100 {
+	case 1:
+		if linear {
+			v = internal.SRGBToLinear16(v)
+		}
+
+		b[0] = uint8((uint32(v)*0xff + 0x7fff) / 0xffff)
+
+		return
+	case 2:
+		if linear {
+			v = internal.SRGBToLinear16(v)
+		}
+
+		c.order().PutUint16(b, v)
+
+		return
+	}
+
+	f := float64(v) / 0xffff
+
+	if linear {
+		f = internal.SRGBToLinear(f)
+	}
+
+	switch c.Precision / 100 {
+	case 3:
+		c.order().PutUint32(b, uint32(math.Round(f*math.MaxUint32)))
+	case 5:
+		c.order().PutUint16(b, floatToHalf(f))
+	case 6:
+		c.order().PutUint32(b, math.Float32bits(float32(f)))
+	default:
+		c.order().PutUint64(b, math.Float64bits(f))
+	}
+}
+
+func (c componentFormat) nrgba64(pixel []byte) color.NRGBA64 {
+	s := c.bytes()
+
+	return color.NRGBA64{
+		R: c.read(pixel, true),
+		G: c.read(pixel[s:], true),
+		B: c.read(pixel[2*s:], true),
+		A: c.read(pixel[3*s:], false),
+	}
+}
+
+func (c componentFormat) rgb48(pixel []byte) lcolor.RGB48 {
+	s := c.bytes()
+
+	return lcolor.RGB48{
+		R: c.read(pixel, true),
+		G: c.read(pixel[s:], true),
+		B: c.read(pixel[2*s:], true),
+	}
+}
+
+func (c componentFormat) grayAlpha32(pixel []byte) lcolor.GrayAlpha32 {
+	return lcolor.GrayAlpha32{
+		Y: c.read(pixel, true),
+		A: c.read(pixel[c.bytes():], false),
+	}
+}
+
+func halfToFloat(h uint16) float64 {
+	var f float64
+
+	frac := h & 0x3ff
+
+	switch exp := int(h>>10) & 0x1f; exp {
+	case 0:
+		f = math.Ldexp(float64(frac), -24)
+	case 0x1f:
+		if frac == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(float64(frac|0x400), exp-25)
+	}
+
+	if h&0x8000 != 0 {
+		return -f
+	}
+
+	return f
+}
+
+func floatToHalf(f float64) uint16 {
+	if f <= 0 || f != f {
+		return 0
+	} else if f >= 65504 {
+		return 0x7bff
+	}
+
+	frac, exp := math.Frexp(f)
+
+	e := exp + 14
+	if e <= 0 {
+		return uint16(math.RoundToEven(math.Ldexp(f, 24)))
+	}
+
+	m := uint16(math.RoundToEven((frac*2 - 1) * 1024))
+	if m == 1024 {
+		m = 0
+		e++
+	}
+
+	return uint16(e)<<10 | m
+}
+
+// Errors.
+var (
+	ErrInvalidPrecision = errors.New("invalid precision")
+)
@@ -43,6 +43,29 @@ const (
 	propBlendSpace        = 37
 	propFloatColour       = 38
 	propSamplePoints      = 39
+	propItemSet           = 40
+	propItemSetItem       = 41
+	propLockVisibility    = 42
+	propSelectedPath      = 43
+	propFilterRegion      = 44
+	propFilterArgument    = 45
+	propFilterClip        = 46
+)
+
+// groupItemExpanded is the flag of the group item flags property that marks a
+// layer group as expanded.
+const groupItemExpanded = 1
+
+// compositeAuto is the value of the composite mode, composite space and blend
+// space properties that selects the default for the layer mode.
+const compositeAuto = 0
+
+// Colour space values of the composite space and blend space properties.
+const (
+	colorSpaceLinear     = 1
+	colorSpaceNonLinear  = 2 // perceptual before GIMP 3
+	colorSpaceLab        = 3
+	colorSpacePerceptual = 4
 )
 
 func (d *reader) ReadBoolProperty() bool {
@@ -3,6 +3,8 @@ package xcf
 import (
 	"errors"
 	"io"
+	"io/fs"
+	"math"
 	"unicode/utf8"
 
 	"vimagination.zapto.org/byteio"
@@ -10,12 +12,24 @@ import (
 
 type reader struct {
 	*byteio.StickyBigEndianReader
-	rs *io.SectionReader
+	rs       *io.SectionReader
+	property int64 // ID of the property being read, or noProperty
+	problems []*DecodeError
+
+	decodeOptions
+}
+
+// decodeOptions are the options set with DecoderOption functions, which are
+// shared by all of the readers of a file.
+type decodeOptions struct {
+	recovering bool
+	limits
 }
 
 func newReader(r io.ReaderAt) reader {
 	nr := reader{
-		rs: io.NewSectionReader(r, 0, maxString),
+		rs:       io.NewSectionReader(r, 0, readerSize(r)),
+		property: noProperty,
 	}
 
 	nr.StickyBigEndianReader = &byteio.StickyBigEndianReader{Reader: nr.rs}
@@ -23,6 +37,34 @@ func newReader(r io.ReaderAt) reader {
 	return nr
 }
 
+// readerSize attempts to determine the size of the data available from the
+// ReaderAt, returning the largest possible size when it cannot.
+func readerSize(r io.ReaderAt) int64 {
+	if s, ok := r.(interface{ Size() int64 }); ok {
+		return s.Size()
+	}
+
+	if s, ok := r.(interface{ Stat() (fs.FileInfo, error) }); ok {
+		if fi, err := s.Stat(); err == nil && fi.Mode().IsRegular() {
+			return fi.Size()
+		}
+	}
+
+	if s, ok := r.(io.Seeker); ok {
+		if pos, err := s.Seek(0, io.SeekCurrent); err == nil {
+			size, err := s.Seek(0, io.SeekEnd)
+
+			s.Seek(pos, io.SeekStart)
+
+			if err == nil {
+				return size
+			}
+		}
+	}
+
+	return math.MaxInt64
+}
+
 const maxString = 16 * 1024 * 1024
 
 func (r *reader) ReadString() string {
@@ -38,7 +80,7 @@ func (r *reader) ReadString() string {
 	b := make([]byte, length)
 
 	if _, err := io.ReadFull(r, b); err != nil {
-		r.Err = err
+		r.SetError(err)
 
 		return ""
 	}
@@ -52,13 +94,115 @@ func (r *reader) ReadString() string {
 	return string(b[:length-1])
 }
 
+// CheckCount sets ErrInvalidCount, returning false, when count items, each of
+// at least size bytes, cannot fit in the remainder of the file, so that
+// nothing is allocated for them. It also returns false if an error has
+// already occurred.
+func (r *reader) CheckCount(count, size uint32) bool {
+	if r.Err != nil {
+		return false
+	} else if int64(count)*int64(size) > r.rs.Size()-r.Pos() {
+		r.SetError(ErrInvalidCount)
+
+		return false
+	}
+
+	return true
+}
+
+// Goto moves to the given offset in the file, unless an error has occurred,
+// so that the offset of the error can be reported.
 func (r *reader) Goto(n uint64) {
-	r.rs.Seek(int64(n), io.SeekStart)
+	if r.Err == nil {
+		r.rs.Seek(int64(n), io.SeekStart)
+	}
+}
+
+func (r *reader) Pos() int64 {
+	pos, _ := r.rs.Seek(0, io.SeekCurrent)
+
+	return pos
+}
+
+// ReadProperty reads the ID and length of a property, recording the ID so
+// that it can be reported with any error that occurs while reading it.
+func (r *reader) ReadProperty() (uint32, uint32) {
+	if r.Err != nil {
+		return propEnd, 0
+	}
+
+	typ := r.ReadUint32()
+	plength := r.ReadUint32()
+
+	if r.Err != nil || typ == propEnd && plength == 0 {
+		r.property = noProperty
+	} else {
+		r.property = int64(typ)
+	}
+
+	return typ, plength
 }
 
 func (r *reader) SetError(err error) {
+	if r.Err == nil && err != nil {
+		r.Err = r.wrapErrors(err)
+	}
+}
+
+// Recover records and clears the current error when in recovery mode, so that
+// reading can continue, returning true if it did so.
+func (r *reader) Recover() bool {
+	if !r.recovering || r.Err == nil || isLimitError(r.Err) {
+		return false
+	}
+
+	r.problems = append(r.problems, r.WrapError(r.Err))
+	r.Err = nil
+
+	return true
+}
+
+// RecoverProperty recovers from an error that occurred while reading the
+// contents of a property, continuing from the end of the property.
+func (r *reader) RecoverProperty(end int64) {
+	if r.property != noProperty && r.Recover() {
+		r.Goto(uint64(end))
+	}
+}
+
+// DecodeErr returns the error of the reader, if any, as a DecodeError.
+func (r *reader) DecodeErr() error {
 	if r.Err == nil {
-		r.Err = err
+		return nil
+	}
+
+	r.Err = r.wrapErrors(r.Err)
+
+	return r.Err
+}
+
+// wrapErrors returns the error as a DecodeError, as WrapError, unless it is
+// already a DecodeErrors.
+func (r *reader) wrapErrors(err error) error {
+	if des, ok := err.(DecodeErrors); ok {
+		return des
+	}
+
+	return r.WrapError(err)
+}
+
+// WrapError returns the error as a DecodeError, recording the current offset
+// and property when it is not one already.
+func (r *reader) WrapError(err error) *DecodeError {
+	if de, ok := err.(*DecodeError); ok {
+		return de
+	}
+
+	return &DecodeError{
+		Err:      err,
+		Offset:   r.Pos(),
+		Layer:    -1,
+		Property: r.property,
 	}
 }
 
@@ -67,4 +211,5 @@ var (
 	ErrInvalidString = errors.New("string is invalid")
 	ErrStringTooLong = errors.New("string exceeds maximum length")
 	ErrInvalidSeek   = errors.New("invalid seek")
+	ErrInvalidCount  = errors.New("count exceeds remaining data")
 )
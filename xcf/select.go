@@ -0,0 +1,194 @@
+package xcf
+
+import (
+	"image"
+	"image/color"
+	"io"
+	"sync"
+
+	"vimagination.zapto.org/limage"
+)
+
+// LayerSelector is a function that chooses which layers have their pixels
+// decoded.
+//
+// It is given the path of the layer and the layer itself, which has all of its
+// properties set, but whose Image is only set for layer groups.
+type LayerSelector func(LayerPath, limage.Layer) bool
+
+// WithLayerSelector makes the decoder read the properties of all of the
+// layers, but only decode the pixels of the layers chosen by the selector, and
+// of all of the layers within the chosen groups.
+//
+// The Image of each of the other layers is a *DeferredImage, which decodes the
+// pixels when they are first used.
+//
+// When given multiple times, the layers chosen by any of the selectors are
+// decoded.
+func WithLayerSelector(fn LayerSelector) DecoderOption {
+	return func(d *decoder) {
+		if prev := d.selector; prev != nil {
+			d.selector = func(p LayerPath, l limage.Layer) bool {
+				return prev(p, l) || fn(p, l)
+			}
+		} else {
+			d.selector = fn
+		}
+	}
+}
+
+// WithLayerNames decodes the pixels of the layers, and layer groups, with the
+// given names, as WithLayerSelector.
+func WithLayerNames(names ...string) DecoderOption {
+	return WithLayerSelector(func(_ LayerPath, l limage.Layer) bool {
+		for _, name := range names {
+			if l.Name == name {
+				return true
+			}
+		}
+
+		return false
+	})
+}
+
+// WithLayerPaths decodes the pixels of the layers, and layer groups, at the
+// given paths, as WithLayerSelector.
+func WithLayerPaths(paths ...LayerPath) DecoderOption {
+	return WithLayerSelector(func(p LayerPath, _ limage.Layer) bool {
+		for _, path := range paths {
+			if path.equalPath(p) {
+				return true
+			}
+		}
+
+		return false
+	})
+}
+
+// readSelectedLayers decodes the pixels of the layers chosen by the selector,
+// setting the images of the other layers to be decoded when first used.
+func readSelectedLayers(dr *reader, r io.ReaderAt, im limage.Image, layers []layer, base decoder) {
+	var (
+		chosen   = make(map[string]bool)
+		selected []layer
+	)
+
+	for _, l := range layers {
+		if l.failed {
+			continue
+		}
+
+		path := layerPath(l.itemPath)
+		tl := layerAt(im, path)
+
+		isChosen := chosen[string(l.itemPath[:len(l.itemPath)-1])] || base.selector(path, *tl)
+		chosen[string(l.itemPath)] = isChosen
+
+		if l.group {
+			continue
+		} else if isChosen {
+			selected = append(selected, l)
+		} else {
+			tl.Image = &DeferredImage{
+				Text:   l.text,
+				Masked: l.maskPtr != 0,
+				layer:  l,
+				d:      base,
+				r:      r,
+			}
+		}
+	}
+
+	forEachLayer(dr, r, selected, base, func(d *decoder, l *layer) {
+		if l.readPixels(d); l.Image != nil {
+			layerAt(im, layerPath(l.itemPath)).Image = l.Image
+		}
+	})
+}
+
+// layerAt returns the layer at the given path, which must exist.
+func layerAt(im limage.Image, path LayerPath) *limage.Layer {
+	for _, i := range path[:len(path)-1] {
+		im = im[i].Image.(limage.Image)
+	}
+
+	return &im[path[len(path)-1]]
+}
+
+// DeferredImage is the image of a layer that was not chosen by a
+// LayerSelector, the pixels of which are decoded when they are first used, or
+// when Decode is called.
+//
+// Encode writes the decoded image, along with its text and mask, failing if it
+// cannot be decoded.
+type DeferredImage struct {
+	// Text is the text of the layer, when it is a text layer, and Masked is
+	// true when the layer has a mask. The decoded image is wrapped in a
+	// limage.Text or limage.MaskedImage accordingly.
+	Text   limage.TextData
+	Masked bool
+
+	once  sync.Once
+	layer layer
+	d     decoder
+	r     io.ReaderAt
+	image image.Image
+	err   error
+}
+
+// Decode decodes the pixels of the layer, returning the image that would have
+// been the Image of the layer had it been chosen by the selector.
+//
+// The pixels are only decoded once, with the same result returned by each
+// call. In recovery mode, the image can be returned along with the problems
+// encountered, as with WithRecovery.
+func (di *DeferredImage) Decode() (image.Image, error) {
+	di.once.Do(func() {
+		d := di.d
+		d.reader = newReader(di.r)
+		d.decodeOptions = di.d.decodeOptions
+		l := di.layer
+
+		l.readPixels(&d)
+
+		problems := d.problems
+
+		if d.Err != nil {
+			problems = append(problems, d.WrapError(d.Err))
+		} else {
+			di.image = l.Image
+		}
+
+		for _, p := range problems {
+			p.Layer = l.index
+			p.LayerName = l.Name
+		}
+
+		di.err = joinErrors(problems)
+	})
+
+	return di.image, di.err
+}
+
+// ColorModel returns the colour model of the decoded image, which is
+// determined by the type of the layer, and so does not require the image to be
+// decoded.
+func (di *DeferredImage) ColorModel() color.Model {
+	return di.d.colorModel(di.layer.typ)
+}
+
+// Bounds returns the bounds of the layer, which do not require the image to be
+// decoded.
+func (di *DeferredImage) Bounds() image.Rectangle {
+	return image.Rect(0, 0, di.layer.LayerBounds.Dx(), di.layer.LayerBounds.Dy())
+}
+
+// At returns the colour of the decoded image at the given coords, which is
+// transparent when the image could not be decoded; Decode returns the reason.
+func (di *DeferredImage) At(x, y int) color.Color {
+	if im, _ := di.Decode(); im != nil {
+		return im.At(x, y)
+	}
+
+	return color.NRGBA{}
+}
@@ -204,7 +204,8 @@ func (q *quoteWriter) WriteString(s string) (int, error) {
 	return len(s), nil
 }
 
-func (e *encoder) WriteText(text limage.TextData, dx, dy uint32) {
+// textParasite builds the parasite that stores the given text data.
+func textParasite(text limage.TextData, dx, dy uint32) parasite {
 	var (
 		data []byte
 		base limage.TextDatum
@@ -244,18 +245,10 @@ func (e *encoder) WriteText(text limage.TextData, dx, dy uint32) {
 		"(hinting yes)\n"+
 		"\x00", base.Font, base.Size, r>>8, g>>8, b>>8, dx, dy)
 
-	// write base
-
-	e.WriteUint32(propTextLayerFlags)
-	e.WriteUint32(4)
-	e.WriteUint32(1)
-
-	e.WriteUint32(propParasites)
-	e.WriteUint32(uint32(4 + len(textParasiteName) + 1 + 4 + 4 + len(data)))
-	e.WriteString(textParasiteName)
-	e.WriteUint32(0) // flags
-	e.WriteUint32(uint32(len(data)))
-	e.Write(data)
+	return parasite{
+		name: textParasiteName,
+		data: data,
+	}
 }
 
 func writeTextMarkup(td limage.TextDatum, data []byte) []byte {
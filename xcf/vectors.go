@@ -1,105 +1,293 @@
 package xcf
 
-import "errors"
+import (
+	"errors"
 
-type vectors struct {
-	aIndex uint32
-	paths  []vpath
-}
+	"vimagination.zapto.org/limage"
+)
 
-type vpath struct {
-	name            string
-	tattoo          uint32
-	visible, linked bool
-	parasites
-	strokes []stroke
+// Path represents a Bézier path, which GIMP calls a vectors object.
+type Path struct {
+	Name      string
+	Tattoo    uint32
+	Visible   bool
+	Linked    bool
+	Parasites []limage.Parasite
+	Strokes   []Stroke
 }
 
-type stroke struct {
-	closed bool
-	points []point
+// Stroke is a single continuous section of a Path.
+//
+// The Points of a stroke are stored in groups of three: the control point
+// before an anchor, the anchor, and the control point after it.
+type Stroke struct {
+	Closed bool
+	Points []PathPoint
 }
 
-type point struct {
-	control                             bool
-	x, y, pressure, xtilt, ytilt, wheel float32
+// PathPoint is either an anchor or a control point of a Stroke, along with the
+// pressure, tilt and wheel values recorded by the input device.
+type PathPoint struct {
+	Control                             bool
+	X, Y, Pressure, XTilt, YTilt, Wheel float64
 }
 
-func (d *reader) ReadVectors() vectors {
+const (
+	vectorsVersion   = 1
+	strokeTypeBezier = 1
+	pathPointFloats  = 6 // x, y, pressure, xtilt, ytilt, wheel
+)
+
+// Minimum sizes, in bytes, of the structures of paths.
+const (
+	minPathSize     = 24 // name + tattoo + visible + linked + number of parasites + number of strokes
+	minParasiteSize = 12 // name + flags + length
+	minStrokeSize   = 16 // type + closed + number of floats + number of points
+)
+
+// ReadVectors reads the paths stored in the vectors property, also returning
+// the index of the active path. The image already has the given number of
+// paths.
+func (d *reader) ReadVectors(existing int) ([]Path, uint32) {
 	v := d.ReadUint32()
-	if v != 1 {
+	if v != vectorsVersion {
 		d.SetError(ErrUnknownVectorVersion)
-		return vectors{}
+
+		return nil, 0
 	}
 
-	var vs vectors
+	active := d.ReadUint32()
 
-	vs.aIndex = d.ReadUint32()
 	n := d.ReadUint32()
-	vs.paths = make([]vpath, n)
+	if !d.CheckPaths(int64(existing)+int64(n)) || !d.CheckCount(n, minPathSize) {
+		return nil, 0
+	}
+
+	paths := make([]Path, n)
 
-	for i := uint32(0); i < n; i++ {
-		vs.paths[i].name = d.ReadString()
-		vs.paths[i].tattoo = d.ReadUint32()
-		vs.paths[i].visible = d.ReadBoolProperty()
-		vs.paths[i].linked = d.ReadBoolProperty()
+	for i := range paths {
+		paths[i].Name = d.ReadString()
+		paths[i].Tattoo = d.ReadUint32()
+		paths[i].Visible = d.ReadBoolProperty()
+		paths[i].Linked = d.ReadBoolProperty()
 		m := d.ReadUint32()
 		k := d.ReadUint32()
-		vs.paths[n].parasites = make(parasites, m)
-		vs.paths[n].strokes = make([]stroke, k)
 
-		for j := uint32(0); j < m; j++ {
-			vs.paths[i].parasites[j] = d.ReadParasite()
+		if !d.CheckCount(m, minParasiteSize) {
+			return paths, active
+		}
+
+		ps := make(parasites, m)
+
+		for j := range ps {
+			ps[j] = d.ReadParasite()
+		}
+
+		paths[i].Parasites = ps.Export()
+
+		if paths[i].Strokes = d.readStrokes(k); d.Err != nil {
+			return paths, active
+		}
+	}
+
+	return paths, active
+}
+
+// ReadPath reads a path stored as an item, as GIMP does from version 18,
+// also returning whether the path is selected.
+func (d *reader) ReadPath() (Path, bool) {
+	var (
+		p        Path
+		selected bool
+	)
+
+	p.Name = d.ReadString()
+
+PropertyLoop:
+	for {
+		typ, plength := d.ReadProperty()
+		end := d.Pos() + int64(plength)
+
+		switch typ {
+		case propEnd:
+			if plength != 0 {
+				d.SetError(ErrInvalidProperties)
+			}
+
+			break PropertyLoop
+		case propSelectedPath:
+			selected = true
+		case propTattoo:
+			p.Tattoo = d.ReadUint32()
+		case propVisible:
+			p.Visible = d.ReadBoolProperty()
+		case propLinked:
+			p.Linked = d.ReadBoolProperty()
+		case propParasites:
+			p.Parasites = d.ReadParasites(plength).Export()
+		default:
+			d.Skip(plength)
+		}
+
+		d.RecoverProperty(end)
+	}
+
+	p.Strokes = d.readStrokes(d.ReadUint32())
+
+	return p, selected
+}
+
+func (d *reader) readStrokes(k uint32) []Stroke {
+	if !d.CheckCount(k, minStrokeSize) {
+		return nil
+	}
+
+	strokes := make([]Stroke, k)
+
+	for j := range strokes {
+		if d.ReadUint32() != strokeTypeBezier {
+			d.SetError(ErrUnknownStrokeType)
+
+			return strokes
 		}
 
-		for j := uint32(0); j < k; j++ {
-			b := d.ReadUint32()
-			if b != 1 {
-				d.SetError(ErrUnknownStrokeType)
-				return vs
+		strokes[j].Closed = d.ReadBoolProperty()
+
+		nf := d.ReadUint32()
+		if nf < 2 || nf > pathPointFloats {
+			d.SetError(ErrInvalidFloatsNumber)
+
+			return strokes
+		}
+
+		np := d.ReadUint32()
+		if !d.CheckCount(np, 4*(nf+1)) {
+			return strokes
+		}
+
+		points := make([]PathPoint, np)
+
+		for p := range points {
+			points[p] = PathPoint{
+				Control:  d.ReadUint32() != 0,
+				X:        float64(d.ReadFloat32()),
+				Y:        float64(d.ReadFloat32()),
+				Pressure: 1,
+				XTilt:    0.5,
+				YTilt:    0.5,
+				Wheel:    0.5,
+			}
+
+			if nf >= 3 {
+				points[p].Pressure = float64(d.ReadFloat32())
 			}
 
-			vs.paths[i].strokes[j].closed = d.ReadBoolProperty()
+			if nf >= 4 {
+				points[p].XTilt = float64(d.ReadFloat32())
+			}
 
-			nf := d.ReadUint32()
-			if nf < 2 || nf > 6 {
-				d.SetError(ErrInvalidFloatsNumber)
+			if nf >= 5 {
+				points[p].YTilt = float64(d.ReadFloat32())
+			}
 
-				return vs
+			if nf == 6 {
+				points[p].Wheel = float64(d.ReadFloat32())
 			}
+		}
+
+		strokes[j].Points = points
+	}
+
+	return strokes
+}
+
+// readPathItems reads the paths stored as items, returning them along with the
+// indexes of those that are selected, offset by first.
+func readPathItems(dr *reader, pathptrs []uint64, first int) ([]Path, []int) {
+	var (
+		paths    []Path
+		selected []int
+	)
+
+	for _, ptr := range pathptrs {
+		dr.Goto(ptr)
 
-			np := d.ReadUint32()
-			vs.paths[i].strokes[j].points = make([]point, np)
+		p, sel := dr.ReadPath()
+		if dr.Recover() { // the path is left out
+			continue
+		} else if dr.Err != nil {
+			break
+		} else if sel {
+			selected = append(selected, first+len(paths))
+		}
+
+		paths = append(paths, p)
+	}
+
+	return paths, selected
+}
+
+func vectorsLength(paths []Path) uint32 {
+	l := uint32(12) // version + active index + number of paths
+
+	for _, p := range paths {
+		l += 4 + uint32(len(p.Name)) + 1 // name
+		l += 20                          // tattoo + visible + linked + number of parasites + number of strokes
+
+		for _, pa := range importParasites(p.Parasites) {
+			l += 4 + uint32(len(pa.name)) + 1 + 4 + 4 + uint32(len(pa.data)) // name + flags + length + data
+		}
 
-			for ii := uint32(0); ii < np; ii++ {
-				vs.paths[i].strokes[j].points[ii].control = d.ReadBoolProperty()
-				vs.paths[i].strokes[j].points[ii].x = d.ReadFloat32()
-				vs.paths[i].strokes[j].points[ii].y = d.ReadFloat32()
-				vs.paths[i].strokes[j].points[ii].pressure = 1
-				vs.paths[i].strokes[j].points[ii].xtilt = 0.5
-				vs.paths[i].strokes[j].points[ii].ytilt = 0.5
-				vs.paths[i].strokes[j].points[ii].wheel = 0.5
+		for _, s := range p.Strokes {
+			l += 16                                              // type + closed + number of floats + number of points
+			l += uint32(len(s.Points)) * (4 + pathPointFloats*4) // type + floats
+		}
+	}
 
-				if nf >= 3 {
-					vs.paths[i].strokes[j].points[ii].pressure = d.ReadFloat32()
+	return l
+}
 
-					if nf >= 4 {
-						vs.paths[i].strokes[j].points[ii].xtilt = d.ReadFloat32()
+// WriteVectors writes the paths in the vectors property, along with the index
+// of the active path.
+func (e *encoder) WriteVectors(paths []Path, active uint32) {
+	e.WriteUint32(propVectors)
+	e.WriteUint32(vectorsLength(paths))
+	e.WriteUint32(vectorsVersion)
+	e.WriteUint32(active)
+	e.WriteUint32(uint32(len(paths)))
 
-						if nf >= 5 {
-							vs.paths[i].strokes[j].points[ii].ytilt = d.ReadFloat32()
+	for _, p := range paths {
+		ps := importParasites(p.Parasites)
 
-							if nf == 6 {
-								vs.paths[i].strokes[j].points[ii].wheel = d.ReadFloat32()
-							}
-						}
-					}
+		e.WriteString(p.Name)
+		e.WriteUint32(p.Tattoo)
+		e.WriteBoolProperty(p.Visible)
+		e.WriteBoolProperty(p.Linked)
+		e.WriteUint32(uint32(len(ps)))
+		e.WriteUint32(uint32(len(p.Strokes)))
+
+		for _, pa := range ps {
+			e.WriteString(pa.name)
+			e.WriteUint32(pa.flags)
+			e.WriteUint32(uint32(len(pa.data)))
+			e.Write(pa.data)
+		}
+
+		for _, s := range p.Strokes {
+			e.WriteUint32(strokeTypeBezier)
+			e.WriteBoolProperty(s.Closed)
+			e.WriteUint32(pathPointFloats)
+			e.WriteUint32(uint32(len(s.Points)))
+
+			for _, pt := range s.Points {
+				e.WriteBoolProperty(pt.Control)
+
+				for _, f := range [...]float64{pt.X, pt.Y, pt.Pressure, pt.XTilt, pt.YTilt, pt.Wheel} {
+					e.WriteFloat32(float32(f))
 				}
 			}
 		}
 	}
-
-	return vs
 }
 
 // Errors.
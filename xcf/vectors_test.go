@@ -0,0 +1,173 @@
+package xcf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+
+	"vimagination.zapto.org/limage"
+	"vimagination.zapto.org/memio"
+)
+
+func TestEncodePaths(t *testing.T) {
+	im := Image{
+		Image: limage.Image{
+			limage.Layer{
+				Name: "Layer",
+				Image: singleColourImage{
+					Colour: color.NRGBA{B: 255, A: 255},
+					Width:  20,
+					Height: 20,
+				},
+				LayerBounds: image.Rect(0, 0, 20, 20),
+			},
+		},
+		Paths: []Path{
+			{
+				Name:    "Triangle",
+				Tattoo:  7,
+				Visible: true,
+				Strokes: []Stroke{
+					{
+						Closed: true,
+						Points: []PathPoint{
+							{Control: true, X: 1, Y: 1, Pressure: 1, XTilt: 0.5, YTilt: 0.5, Wheel: 0.5},
+							{X: 1, Y: 1, Pressure: 1, XTilt: 0.5, YTilt: 0.5, Wheel: 0.5},
+							{Control: true, X: 1, Y: 1, Pressure: 1, XTilt: 0.5, YTilt: 0.5, Wheel: 0.5},
+							{Control: true, X: 10.5, Y: 2, Pressure: 0.25, XTilt: 0.125, YTilt: 0.75, Wheel: 0},
+							{X: 18, Y: 2, Pressure: 0.5, XTilt: 0.25, YTilt: 1, Wheel: 0.5},
+							{Control: true, X: 18, Y: 10, Pressure: 1, XTilt: 0.5, YTilt: 0.5, Wheel: 0.5},
+						},
+					},
+				},
+			},
+			{
+				Name:   "Line",
+				Linked: true,
+				Parasites: []limage.Parasite{
+					{Name: "path-data", Flags: 1, Data: []byte("line")},
+				},
+				Strokes: []Stroke{
+					{
+						Points: []PathPoint{
+							{Control: true, X: 3, Y: 15, Pressure: 1, XTilt: 0.5, YTilt: 0.5, Wheel: 0.5},
+							{X: 3, Y: 15, Pressure: 1, XTilt: 0.5, YTilt: 0.5, Wheel: 0.5},
+							{Control: true, X: 3, Y: 15, Pressure: 1, XTilt: 0.5, YTilt: 0.5, Wheel: 0.5},
+						},
+					},
+					{
+						Points: []PathPoint{
+							{Control: true, X: 5, Y: 15, Pressure: 1, XTilt: 0.5, YTilt: 0.5, Wheel: 0.5},
+							{X: 5, Y: 15, Pressure: 1, XTilt: 0.5, YTilt: 0.5, Wheel: 0.5},
+							{Control: true, X: 5, Y: 15, Pressure: 1, XTilt: 0.5, YTilt: 0.5, Wheel: 0.5},
+						},
+					},
+				},
+			},
+		},
+		SelectedPaths: []int{1},
+	}
+
+	var buf []byte
+
+	if err := Encode(memio.Create(&buf), im); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	d, err := DecodeImage(memio.Open(buf))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !reflect.DeepEqual(d.Paths, im.Paths) {
+		t.Errorf("expecting paths %v, got %v", im.Paths, d.Paths)
+	}
+
+	if !reflect.DeepEqual(d.SelectedPaths, im.SelectedPaths) {
+		t.Errorf("expecting selected paths %v, got %v", im.SelectedPaths, d.SelectedPaths)
+	}
+
+	for n, test := range [...]struct {
+		Name  string
+		Delta int
+	}{
+		{"Triangle", -8}, // number of paths
+		{"Triangle", 25}, // number of strokes
+		{"Line", 63},     // number of points
+	} {
+		crafted := append([]byte{}, buf...)
+		pos := bytes.Index(crafted, []byte(test.Name)) + test.Delta
+
+		binary.BigEndian.PutUint32(crafted[pos:], 0xffffffff)
+
+		if _, err := DecodeImage(memio.Open(crafted)); !errors.Is(err, ErrInvalidCount) {
+			t.Errorf("test %d: expecting error %v, got %v", n+1, ErrInvalidCount, err)
+		}
+	}
+}
+
+func TestPathStrokes(t *testing.T) {
+	point := func(control bool, x, y float64) PathPoint {
+		return PathPoint{Control: control, X: x, Y: y, Pressure: 1, XTilt: 0.5, YTilt: 0.5, Wheel: 0.5}
+	}
+
+	for n, test := range [...]struct {
+		Points  []pathPoint
+		Closed  bool
+		Strokes []Stroke
+	}{
+		{
+			Points: []pathPoint{
+				{pathPointMove, 0, 0},
+				{pathPointControl, 1, 0},
+				{pathPointControl, 2, 1},
+				{pathPointAnchor, 3, 3},
+			},
+			Strokes: []Stroke{
+				{
+					Points: []PathPoint{
+						point(true, 0, 0), point(false, 0, 0), point(true, 1, 0),
+						point(true, 2, 1), point(false, 3, 3), point(true, 3, 3),
+					},
+				},
+			},
+		},
+		{
+			Points: []pathPoint{
+				{pathPointMove, 0, 0},
+				{pathPointControl, 1, 0},
+				{pathPointControl, 2, 1},
+				{pathPointAnchor, 3, 3},
+				{pathPointControl, 4, 3},
+				{pathPointControl, 0, 1},
+				{pathPointMove, 5, 5},
+				{pathPointControl, 6, 5},
+				{pathPointControl, 5, 6},
+			},
+			Closed: true,
+			Strokes: []Stroke{
+				{
+					Closed: true,
+					Points: []PathPoint{
+						point(true, 0, 1), point(false, 0, 0), point(true, 1, 0),
+						point(true, 2, 1), point(false, 3, 3), point(true, 4, 3),
+					},
+				},
+				{
+					Closed: true,
+					Points: []PathPoint{
+						point(true, 5, 6), point(false, 5, 5), point(true, 6, 5),
+					},
+				},
+			},
+		},
+	} {
+		if strokes := pathStrokes(test.Points, test.Closed); !reflect.DeepEqual(strokes, test.Strokes) {
+			t.Errorf("test %d: expecting strokes %v, got %v", n+1, test.Strokes, strokes)
+		}
+	}
+}
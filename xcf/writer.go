@@ -3,6 +3,7 @@ package xcf
 import (
 	"errors"
 	"io"
+	"math"
 
 	"vimagination.zapto.org/byteio"
 )
@@ -10,6 +11,7 @@ import (
 type writer struct {
 	*byteio.StickyBigEndianWriter
 	*writerAtWriter
+	widePointers bool
 }
 
 func newWriter(w io.WriterAt) writer {
@@ -38,21 +40,56 @@ func (w writer) Write(p []byte) {
 	w.StickyBigEndianWriter.Write(p)
 }
 
+func (w writer) pointerSize() int64 {
+	if w.widePointers {
+		return 8
+	}
+
+	return 4
+}
+
+// WritePointer writes a file offset, which is 64-bit from version 11 and
+// 32-bit before that.
+func (w writer) WritePointer(ptr int64) {
+	writePointer(w.StickyBigEndianWriter, ptr, w.widePointers)
+}
+
+func writePointer(w *byteio.StickyBigEndianWriter, ptr int64, wide bool) {
+	if wide {
+		w.WriteInt64(ptr)
+	} else if ptr > math.MaxUint32 {
+		if w.Err == nil {
+			w.Err = ErrTooBig
+		}
+	} else {
+		w.WriteUint32(uint32(ptr))
+	}
+}
+
 func (w writer) WriteString(str string) {
 	w.WriteUint32(uint32(len(str)) + 1)
 	w.Write([]byte(str))
 	w.WriteUint8(0)
 }
 
+func (w writer) WriteBoolProperty(b bool) {
+	if b {
+		w.WriteUint32(1)
+	} else {
+		w.WriteUint32(0)
+	}
+}
+
 type pointerWriter struct {
 	bw      *byteio.StickyBigEndianWriter
 	toWrite uint32
 	obw     *byteio.StickyBigEndianWriter
+	wide    bool
 }
 
-func (p *pointerWriter) WritePointer(ptr uint32) {
+func (p *pointerWriter) WritePointer(ptr int64) {
 	if p.toWrite > 0 {
-		p.bw.WriteUint32(ptr)
+		writePointer(p.bw, ptr, p.wide)
 		p.toWrite--
 
 		if p.bw.Err != nil {
@@ -71,9 +108,10 @@ func (w writer) ReservePointers(n uint32) *pointerWriter {
 		},
 		toWrite: n,
 		obw:     w.StickyBigEndianWriter,
+		wide:    w.widePointers,
 	}
 
-	w.pos += int64(n) * 4
+	w.pos += int64(n) * w.pointerSize()
 
 	return p
 }
@@ -81,7 +119,7 @@ func (w writer) ReservePointers(n uint32) *pointerWriter {
 func (w writer) ReservePointerList(n uint32) *pointerWriter {
 	pw := w.ReservePointers(n)
 
-	w.WriteUint32(0)
+	w.WritePointer(0)
 
 	return pw
 }